@@ -1,8 +1,11 @@
 package control
 
 import (
+	"fmt"
 	"time"
+	"errors"
 	"math"
+	"sort"
 	"context"
 
 	"gijs.eu/vonkje/modbus"
@@ -19,6 +22,9 @@ type Config struct {
 	OverDischargePercentage int `mapstructure:"over-discharge-percentage"`
 	MinimumBatteryCapacity int `mapstructure:"minimum-battery-capacity"`
 	BatteryChargePercentage int `mapstructure:"battery-charge-percentage"`
+	CommandDuration uint `mapstructure:"command-duration"`
+	TimeOfUse TimeOfUseConfig `mapstructure:"time-of-use"`
+	ExportLimit ExportLimitConfig `mapstructure:"export-limit"`
 }
 
 type Control struct {
@@ -28,6 +34,11 @@ type Control struct {
 	logger *logrus.Logger
 	victoriaMetrics *victoria_metrics.VictoriaMetrics
 	modbus *modbus.Modbus
+	metrics *metrics.Store
+	touPeriods []modbus.TOUPeriod
+	ratedPower map[string]uint
+	exportDerated bool
+	exportDerating float64
 }
 
 func New(
@@ -37,6 +48,7 @@ func New(
 	logger *logrus.Logger,
 	victoriaMetrics *victoria_metrics.VictoriaMetrics,
 	modbus *modbus.Modbus,
+	store *metrics.Store,
 ) *Control {
 	return &Control{
 		config: config,
@@ -45,27 +57,139 @@ func New(
 		logger: logger,
 		victoriaMetrics: victoriaMetrics,
 		modbus: modbus,
+		metrics: store,
 	}
 }
 
+// minimumCommandDuration is used for battery commands when no longer duration is configured
+const minimumCommandDuration = 5 * time.Minute
+
+// commandLimit returns the limit of battery commands. Commands are sent again every interval, so they
+// only expire on the inverter when the control loop stops. The duration covers at least three intervals
+// so a single failed tick does not end a command.
+func (c *Control) commandLimit(interval time.Duration) modbus.ForceChargeLimit {
+	duration := time.Duration(c.config.CommandDuration) * time.Minute
+	if duration < minimumCommandDuration {
+		duration = minimumCommandDuration
+	}
+
+	if duration < 3 * interval {
+		c.logger.WithFields(logrus.Fields{"duration": duration, "interval": interval}).Warn("Battery command duration is too short for the interval, extending it")
+		duration = 3 * interval
+	}
+
+	return modbus.ForceChargeLimit{Duration: duration}
+}
+
+// maximumUnitDischargeWatts is the discharge power of a single LUNA2000 battery unit
+const maximumUnitDischargeWatts = 5000
+
+// batteryState is the battery of an inverter. The forcible commands control all battery units of an
+// inverter together, so the capacity is the average of its units.
 type batteryState struct {
 	inverter string
-	battery string
+	units uint
 	capacity float64
 }
 
+// getBatteries returns the battery of every inverter, sorted by inverter. Inverters with a battery unit
+// whose capacity is stale are left out, so they get no new command and their last one expires.
+func (c *Control) getBatteries() ([]batteryState, error) {
+	values, err := c.metrics.GetMetricValues("luna2000", "battery_capacity")
+	if err != nil {
+		return nil, err
+	}
+
+	batteries := []batteryState{}
+	indexes := make(map[string]int)
+	stale := make(map[string]bool)
+	for _, value := range values {
+		inverter := value.Fields["inverter"]
+
+		capacity, err := c.metrics.GetMetricValueAverage("luna2000", "battery_capacity", map[string]string{"inverter": inverter, "battery": value.Fields["battery"]}, 1)
+		if errors.Is(err, metrics.ErrStale) {
+			c.logger.WithError(err).WithFields(logrus.Fields{"inverter": inverter, "battery": value.Fields["battery"]}).Warn("Battery capacity is stale, skipping battery")
+			stale[inverter] = true
+			continue
+		}
+		if errors.Is(err, metrics.ErrNotEnoughValues) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		index, ok := indexes[inverter]
+		if !ok {
+			index = len(batteries)
+			indexes[inverter] = index
+			batteries = append(batteries, batteryState{inverter: inverter})
+		}
+
+		batteries[index].capacity += capacity
+		batteries[index].units++
+	}
+
+	fresh := []batteryState{}
+	for _, battery := range batteries {
+		if stale[battery.inverter] {
+			continue
+		}
+
+		battery.capacity /= float64(battery.units)
+		fresh = append(fresh, battery)
+	}
+
+	sort.Slice(fresh, func(i, j int) bool {
+		return fresh[i].inverter < fresh[j].inverter
+	})
+
+	return fresh, nil
+}
+
+// dischargeWatts splits watts over the batteries by their amount of units.
+func dischargeWatts(batteries []batteryState, watts uint) map[string]uint {
+	var units uint
+	for _, battery := range batteries {
+		units += battery.units
+	}
+
+	split := make(map[string]uint, len(batteries))
+	if units == 0 {
+		return split
+	}
+
+	for _, battery := range batteries {
+		split[battery.inverter] = watts * battery.units / units
+	}
+
+	return split
+}
+
 func (c *Control) Start() {
 	if !c.config.Run {
 		c.logger.Warn("Control loop is disabled")
 		return
 	}
 
+	if c.config.ExportLimit.Enabled {
+		go c.startExportLimit()
+	}
+
+	if c.config.TimeOfUse.Enabled {
+		c.startTimeOfUse()
+		return
+	}
+
 	c.logger.Infof("Waiting %d seconds before starting control loop to collect metrics", viper.GetInt("modbus.read-metrics-interval"))
 	time.Sleep(time.Duration(viper.GetInt("modbus.read-metrics-interval")) * time.Second)
 
 	c.logger.Info("Starting control loop")
 
-	ticker := time.NewTicker(time.Duration(viper.GetInt("modbus.read-metrics-interval")) * time.Second)
+	interval := time.Duration(viper.GetInt("modbus.read-metrics-interval")) * time.Second
+	limit := c.commandLimit(interval)
+
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
@@ -75,12 +199,12 @@ func (c *Control) Start() {
 			return
 		case <-ticker.C:
 			c.logger.Debug("Control loop tick")
-			metrics.SetMetricValue("control", "action", map[string]string{"action": "charge_batteries"}, 0)
-			metrics.SetMetricValue("control", "action", map[string]string{"action": "discharge_battery"}, 0)
-			metrics.SetMetricValue("control", "action", map[string]string{"action": "pull_from_grid"}, 0)
+			c.metrics.SetMetricValue("control", "action", map[string]string{"action": "charge_batteries"}, 0)
+			c.metrics.SetMetricValue("control", "action", map[string]string{"action": "discharge_battery"}, 0)
+			c.metrics.SetMetricValue("control", "action", map[string]string{"action": "pull_from_grid"}, 0)
 
 			// 1. Get current home energy consumption
-			avgHomeLoad, err := calculateHomeLoad()
+			avgHomeLoad, err := c.calculateHomeLoad()
 			if err != nil {
 				c.errChannel <- err
 				continue
@@ -93,7 +217,7 @@ func (c *Control) Start() {
 			}
 
 			// 2. Get current solar production
-			avgSolarIn, err := metrics.GetMetricLastEntryAverage("sun2000", "input_power")
+			avgSolarIn, err := c.metrics.GetMetricLastEntryAverage("sun2000", "input_power")
 			if err != nil {
 				c.errChannel <- err
 				continue
@@ -102,19 +226,11 @@ func (c *Control) Start() {
 			c.logger.WithFields(logrus.Fields{"avgSolarIn": avgSolarIn, "avgHomeLoad": avgHomeLoad}).Info("Solar production and home load")
 
 			// 3. Get current battery capacities
-			batteryMetricValues, err := metrics.GetMetricValues("luna2000", "battery_capacity")
+			batteries, err := c.getBatteries()
 			if err != nil {
 				c.errChannel <- err
 				continue
 			}
-			batteries := []batteryState{}
-			for _, batteryMetricValue := range batteryMetricValues {
-				batteries = append(batteries, batteryState{
-					inverter: batteryMetricValue.Fields["inverter"],
-					battery: batteryMetricValue.Fields["battery"],
-					capacity: batteryMetricValue.Values[len(batteryMetricValue.Values) - 1],
-				})
-			}
 
 			// Get over production in percentage
 			var overProduction float64
@@ -126,27 +242,27 @@ func (c *Control) Start() {
 				overProduction = 0
 				overProductionWatts = 0
 			}
-			metrics.SetMetricValue("control", "over_production", map[string]string{}, overProduction)
+			c.metrics.SetMetricValue("control", "over_production", map[string]string{}, overProduction)
 			c.logger.WithFields(logrus.Fields{"percentage": overProduction, "watts": overProductionWatts}).Info("Over production")
 
 			// 4. if solar over production is more than x%, charge battery
 			if overProduction > float64(c.config.MinimumSolarOverProduction) {
-				metrics.SetMetricValue("control", "action", map[string]string{"action": "charge_batteries"}, 1)
+				c.metrics.SetMetricValue("control", "action", map[string]string{"action": "charge_batteries"}, 1)
 
 				// charge batteries with 20% less than over production
 				batteryChargeWatts := uint(math.Floor(float64(overProductionWatts) * (float64(c.config.BatteryChargePercentage) / 100)))
 
 				for _, battery := range batteries {
 					if battery.capacity < 100 {
-						c.logger.WithFields(logrus.Fields{"inverter": battery.inverter, "battery": battery.battery, "capacity": battery.capacity, "watts": batteryChargeWatts}).Info("Battery is not fully charged, starting charge")
-						err := c.modbus.ChangeBatteryForceCharge(battery.inverter, battery.battery, modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, batteryChargeWatts)
+						c.logger.WithFields(logrus.Fields{"inverter": battery.inverter, "units": battery.units, "capacity": battery.capacity, "watts": batteryChargeWatts}).Info("Battery is not fully charged, starting charge")
+						err := c.modbus.ChangeBatteryForceCharge(modbus.WriteOrigin{Caller: "control", Reason: fmt.Sprintf("Solar over production of %d W", overProductionWatts)}, battery.inverter, modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, batteryChargeWatts, limit)
 						if err != nil {
 							c.errChannel <- err
 							continue
 						}
 					} else {
-						c.logger.WithFields(logrus.Fields{"inverter": battery.inverter, "battery": battery.battery, "watts": batteryChargeWatts}).Info("Battery is fully charged, stopping charge")
-						err := c.modbus.ChangeBatteryForceCharge(battery.inverter, battery.battery, modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP, 0)
+						c.logger.WithFields(logrus.Fields{"inverter": battery.inverter, "units": battery.units, "watts": batteryChargeWatts}).Info("Battery is fully charged, stopping charge")
+						err := c.modbus.ChangeBatteryForceCharge(modbus.WriteOrigin{Caller: "control", Reason: "Battery is fully charged"}, battery.inverter, modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP, 0, modbus.ForceChargeLimit{})
 						if err != nil {
 							c.errChannel <- err
 							continue
@@ -156,23 +272,26 @@ func (c *Control) Start() {
 
 				continue
 			} else {
-				metrics.SetMetricValue("control", "action", map[string]string{"action": "charge_batteries"}, 0)
+				c.metrics.SetMetricValue("control", "action", map[string]string{"action": "charge_batteries"}, 0)
 			}
 
 			// 5. if solar production < home energy consumption && battery capacity > 5%, discharge battery
 			wattsRequired := uint(math.Ceil(avgHomeLoad - avgSolarIn) * ((100 + float64(c.config.OverDischargePercentage)) / 100))
 			if avgSolarIn < avgHomeLoad {
 				if wattsRequired > 0 {
-					metrics.SetMetricValue("control", "action", map[string]string{"action": "discharge_battery"}, 1)
+					c.metrics.SetMetricValue("control", "action", map[string]string{"action": "discharge_battery"}, 1)
 				} else {
-					metrics.SetMetricValue("control", "action", map[string]string{"action": "discharge_battery"}, 0)
+					c.metrics.SetMetricValue("control", "action", map[string]string{"action": "discharge_battery"}, 0)
 				}
 
 				if wattsRequired > 0 {
 					c.logger.WithFields(logrus.Fields{"wattsRequired": wattsRequired}).Info("Discharging battery")
 				}
 
-				maxBatteryDischargeWatts := uint(len(batteries)) * 5000
+				var maxBatteryDischargeWatts uint
+				for _, battery := range batteries {
+					maxBatteryDischargeWatts += battery.units * maximumUnitDischargeWatts
+				}
 
 				var wattsFromGrid uint
 				if wattsRequired > maxBatteryDischargeWatts {
@@ -180,13 +299,13 @@ func (c *Control) Start() {
 					wattsRequired = maxBatteryDischargeWatts
 				}
 
-				wattsRequiredPerBattery := wattsRequired / uint(len(batteries))
+				wattsRequiredPerBattery := dischargeWatts(batteries, wattsRequired)
 
 				for _, battery := range batteries {
 					if battery.capacity < float64(c.config.MinimumBatteryCapacity) {
-						c.logger.WithFields(logrus.Fields{"inverter": battery.inverter, "battery": battery.battery, "capacity": battery.capacity}).Info("Battery capacity is too low, skipping discharge and setting battery to stop")
+						c.logger.WithFields(logrus.Fields{"inverter": battery.inverter, "units": battery.units, "capacity": battery.capacity}).Info("Battery capacity is too low, skipping discharge and setting battery to stop")
 
-						err := c.modbus.ChangeBatteryForceCharge(battery.inverter, battery.battery, modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP, 0)
+						err := c.modbus.ChangeBatteryForceCharge(modbus.WriteOrigin{Caller: "control", Reason: "Battery capacity is too low"}, battery.inverter, modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP, 0, modbus.ForceChargeLimit{})
 						if err != nil {
 							c.errChannel <- err
 						}
@@ -194,19 +313,19 @@ func (c *Control) Start() {
 						continue
 					}
 
-					c.logger.WithFields(logrus.Fields{"inverter": battery.inverter, "battery": battery.battery, "capacity": battery.capacity, "watts": wattsRequiredPerBattery}).Info("Discharging battery")
+					c.logger.WithFields(logrus.Fields{"inverter": battery.inverter, "units": battery.units, "capacity": battery.capacity, "watts": wattsRequiredPerBattery[battery.inverter]}).Info("Discharging battery")
 
-					err := c.modbus.ChangeBatteryForceCharge(battery.inverter, battery.battery, modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE, wattsRequiredPerBattery)
+					err := c.modbus.ChangeBatteryForceCharge(modbus.WriteOrigin{Caller: "control", Reason: fmt.Sprintf("Home load exceeds solar production by %d W", wattsRequired)}, battery.inverter, modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE, wattsRequiredPerBattery[battery.inverter], limit)
 					if err != nil {
 						c.errChannel <- err
 					}	
 				}
 
 				if wattsFromGrid > 0 {
-					metrics.SetMetricValue("control", "action", map[string]string{"action": "pull_from_grid"}, 1)
+					c.metrics.SetMetricValue("control", "action", map[string]string{"action": "pull_from_grid"}, 1)
 					c.logger.WithFields(logrus.Fields{"wattsFromGrid": wattsFromGrid}).Info("Pulling watts from grid")
 				} else {
-					metrics.SetMetricValue("control", "action", map[string]string{"action": "pull_from_grid"}, 0)
+					c.metrics.SetMetricValue("control", "action", map[string]string{"action": "pull_from_grid"}, 0)
 				}
 			}
 		}
@@ -0,0 +1,79 @@
+package control
+
+import (
+	"time"
+	"testing"
+
+	"gijs.eu/vonkje/metrics"
+
+	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newTestControl(t *testing.T, config metrics.Config) *Control {
+	store, err := metrics.NewStore(config, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+
+	err = store.AddMetric("luna2000", "battery_capacity", "The battery capacity", []string{"inverter", "battery"})
+	if err != nil {
+		t.Fatalf("Failed to add metric: %s", err)
+	}
+
+	return &Control{metrics: store, logger: logrus.New()}
+}
+
+func TestBatteriesWithTwoUnits(t *testing.T) {
+	c := newTestControl(t, metrics.Config{})
+	c.metrics.SetMetricValue("luna2000", "battery_capacity", map[string]string{"inverter": "inverter1", "battery": "1"}, 100)
+	c.metrics.SetMetricValue("luna2000", "battery_capacity", map[string]string{"inverter": "inverter1", "battery": "2"}, 60)
+	c.metrics.SetMetricValue("luna2000", "battery_capacity", map[string]string{"inverter": "inverter2", "battery": "1"}, 40)
+
+	batteries, err := c.getBatteries()
+	if err != nil {
+		t.Fatalf("Failed to get batteries: %s", err)
+	}
+
+	// One battery per inverter so every inverter gets a single command per tick
+	expected := []batteryState{
+		{inverter: "inverter1", units: 2, capacity: 80},
+		{inverter: "inverter2", units: 1, capacity: 40},
+	}
+	if len(batteries) != len(expected) {
+		t.Fatalf("Expected %d batteries, got %v", len(expected), batteries)
+	}
+
+	for i := range expected {
+		if batteries[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected[i], batteries[i])
+		}
+	}
+
+	// The inverter with two units discharges twice as much as the one with a single unit
+	watts := dischargeWatts(batteries, 3000)
+	if watts["inverter1"] != 2000 || watts["inverter2"] != 1000 {
+		t.Fatalf("Expected 2000 W and 1000 W, got %v", watts)
+	}
+}
+
+func TestStaleBatteries(t *testing.T) {
+	c := newTestControl(t, metrics.Config{StaleAfter: 1})
+	c.metrics.SetMetricValue("luna2000", "battery_capacity", map[string]string{"inverter": "inverter1", "battery": "1"}, 50)
+	c.metrics.SetMetricValue("luna2000", "battery_capacity", map[string]string{"inverter": "inverter1", "battery": "2"}, 50)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	// Only the second unit is still polled, the inverter is skipped until its first unit is fresh again
+	c.metrics.SetMetricValue("luna2000", "battery_capacity", map[string]string{"inverter": "inverter1", "battery": "2"}, 50)
+	c.metrics.SetMetricValue("luna2000", "battery_capacity", map[string]string{"inverter": "inverter2", "battery": "1"}, 70)
+
+	batteries, err := c.getBatteries()
+	if err != nil {
+		t.Fatalf("Failed to get batteries: %s", err)
+	}
+
+	if len(batteries) != 1 || batteries[0].inverter != "inverter2" {
+		t.Fatalf("Expected only the fresh battery of inverter2, got %v", batteries)
+	}
+}
@@ -0,0 +1,194 @@
+package control
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gijs.eu/vonkje/modbus"
+
+	"github.com/spf13/viper"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultExportLimitDeadband matches the 100 W resolution of the derating register
+const defaultExportLimitDeadband = 100
+
+type ExportLimitConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	MaximumExport int `mapstructure:"maximum-export"`
+	Deadband uint `mapstructure:"deadband"`
+	NegativePricesOnly bool `mapstructure:"negative-prices-only"`
+}
+
+// startExportLimit keeps the power exported to the grid at or below the configured maximum by derating the
+// inverters, using the active power of the power meter as feedback.
+func (c *Control) startExportLimit() {
+	interval := time.Duration(viper.GetInt("modbus.read-metrics-interval")) * time.Second
+	if interval == 0 {
+		c.logger.Warn("Export limit needs a read metrics interval, not starting it")
+		return
+	}
+
+	c.logger.WithFields(logrus.Fields{"maximumExport": c.config.ExportLimit.MaximumExport, "negativePricesOnly": c.config.ExportLimit.NegativePricesOnly}).Info("Starting export limit")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.logger.Info("Stopping export limit")
+			return
+		case now := <-ticker.C:
+			c.updateExportLimit(now)
+		}
+	}
+}
+
+// updateExportLimit derates the inverters by the export above the maximum, or lifts the derating once the
+// inverters could produce at their rated power without exceeding it.
+func (c *Control) updateExportLimit(now time.Time) {
+	active, err := c.exportLimitActive(now)
+	if err != nil {
+		c.errChannel <- err
+		return
+	}
+
+	if !active {
+		c.liftExportLimit("Export limit is not active")
+		return
+	}
+
+	ratedPower, err := c.getRatedPower()
+	if err != nil {
+		c.errChannel <- err
+		return
+	}
+
+	totalRatedPower := 0.0
+	for _, watts := range ratedPower {
+		totalRatedPower += float64(watts)
+	}
+
+	// Positive active power of the power meter is exported to the grid
+	export, err := c.metrics.GetMetricLastEntrySum("power_meter", "active_power")
+	if err != nil {
+		c.errChannel <- err
+		return
+	}
+
+	production, err := c.metrics.GetMetricLastEntrySum("sun2000", "active_power")
+	if err != nil {
+		c.errChannel <- err
+		return
+	}
+	production = production * 1000
+
+	target := math.Max(0, production - (export - float64(c.config.ExportLimit.MaximumExport)))
+	c.logger.WithFields(logrus.Fields{"export": export, "production": production, "target": target}).Debug("Export limit")
+
+	if target >= totalRatedPower {
+		c.liftExportLimit(fmt.Sprintf("Export of %.0f W is below the maximum of %d W", export, c.config.ExportLimit.MaximumExport))
+		return
+	}
+
+	deadband := float64(c.config.ExportLimit.Deadband)
+	if deadband == 0 {
+		deadband = defaultExportLimitDeadband
+	}
+
+	if c.exportDerated && math.Abs(target - c.exportDerating) < deadband {
+		return
+	}
+
+	origin := modbus.WriteOrigin{Caller: "control", Reason: fmt.Sprintf("Export of %.0f W exceeds the maximum of %d W", export, c.config.ExportLimit.MaximumExport)}
+	if export <= float64(c.config.ExportLimit.MaximumExport) {
+		origin.Reason = fmt.Sprintf("Export of %.0f W has room below the maximum of %d W", export, c.config.ExportLimit.MaximumExport)
+	}
+
+	// Split the target over the inverters by their rated power
+	for inverter, watts := range ratedPower {
+		share := uint(math.Floor(target * float64(watts) / totalRatedPower))
+
+		err := c.modbus.SetActivePowerDerating(origin, inverter, share)
+		if err != nil {
+			c.errChannel <- err
+			return
+		}
+	}
+
+	c.logger.WithFields(logrus.Fields{"export": export, "production": production, "derating": target}).Info("Derated inverters to limit export")
+	c.metrics.SetMetricValue("control", "export_limit_derating", map[string]string{}, target)
+
+	c.exportDerated = true
+	c.exportDerating = target
+}
+
+// liftExportLimit lifts the derating of the inverters when the export limit derated them.
+func (c *Control) liftExportLimit(reason string) {
+	if !c.exportDerated {
+		return
+	}
+
+	for _, inverter := range c.modbus.GetInverters() {
+		err := c.modbus.ResetActivePowerDerating(modbus.WriteOrigin{Caller: "control", Reason: reason}, inverter)
+		if err != nil {
+			c.errChannel <- err
+			return
+		}
+	}
+
+	c.logger.WithFields(logrus.Fields{"reason": reason}).Info("Lifted export limit derating")
+	c.metrics.SetMetricValue("control", "export_limit_derating", map[string]string{}, 0)
+
+	c.exportDerated = false
+	c.exportDerating = 0
+}
+
+// exportLimitActive reports whether export is limited now. When limited to negative prices only, the price
+// of the current hour has to be known.
+func (c *Control) exportLimitActive(now time.Time) (bool, error) {
+	if !c.config.ExportLimit.NegativePricesOnly {
+		return true, nil
+	}
+
+	hour := now.Truncate(time.Hour)
+	prices, err := c.getPowerPrices(hour, hour.Add(time.Hour))
+	if err != nil {
+		return false, err
+	}
+
+	price, ok := prices[hour.Unix()]
+	if !ok {
+		c.logger.Warn("No power price known for the current hour, not limiting export")
+		return false, nil
+	}
+
+	return price < 0, nil
+}
+
+// getRatedPower returns the rated power of every inverter in watts. It is read once as it does not change.
+func (c *Control) getRatedPower() (map[string]uint, error) {
+	if c.ratedPower != nil {
+		return c.ratedPower, nil
+	}
+
+	ratedPower := make(map[string]uint)
+	for _, inverter := range c.modbus.GetInverters() {
+		watts, err := c.modbus.GetRatedPower(inverter)
+		if err != nil {
+			return nil, err
+		}
+
+		ratedPower[inverter] = watts
+	}
+
+	if len(ratedPower) == 0 {
+		return nil, fmt.Errorf("No inverters to limit export with")
+	}
+
+	c.ratedPower = ratedPower
+
+	return ratedPower, nil
+}
@@ -0,0 +1,167 @@
+package control
+
+import (
+	"fmt"
+	"time"
+	"math"
+	"reflect"
+	"strconv"
+
+	"gijs.eu/vonkje/modbus"
+
+	"github.com/sirupsen/logrus"
+)
+
+type TimeOfUseConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	ChargeHours uint `mapstructure:"charge-hours"`
+}
+
+// startTimeOfUse programs the time of use working mode of every battery to charge from the grid during the
+// cheapest hours of the day, instead of sending forcible commands every interval. The schedule is checked
+// every hour so the next day is added once its prices are known.
+func (c *Control) startTimeOfUse() {
+	c.logger.WithFields(logrus.Fields{"chargeHours": c.config.TimeOfUse.ChargeHours}).Info("Starting time of use control")
+
+	c.updateTimeOfUse(time.Now())
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.logger.Info("Stopping time of use control")
+			return
+		case now := <-ticker.C:
+			c.updateTimeOfUse(now)
+		}
+	}
+}
+
+// updateTimeOfUse programs a charge period for today and tomorrow when their prices are known. The batteries
+// are only written when the periods changed.
+func (c *Control) updateTimeOfUse(now time.Time) {
+	periods := []modbus.TOUPeriod{}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	for _, day := range []time.Time{today, today.AddDate(0, 0, 1)} {
+		prices, err := c.getPowerPrices(day, day.AddDate(0, 0, 1))
+		if err != nil {
+			c.errChannel <- err
+			return
+		}
+
+		period, ok := cheapestPeriod(prices, day, c.config.TimeOfUse.ChargeHours)
+		if ok {
+			periods = append(periods, period)
+		}
+	}
+
+	if len(periods) == 0 {
+		c.logger.Warn("No power prices known, keeping the current time of use periods")
+		return
+	}
+
+	if reflect.DeepEqual(periods, c.touPeriods) {
+		return
+	}
+
+	origin := modbus.WriteOrigin{Caller: "control", Reason: fmt.Sprintf("Charging from the grid during the %d cheapest hours", c.config.TimeOfUse.ChargeHours)}
+	for _, inverter := range c.modbus.GetBatteryInverters() {
+		err := c.modbus.SetTOUPeriods(origin, inverter, periods)
+		if err != nil {
+			c.errChannel <- err
+			return
+		}
+
+		err = c.modbus.SetGridCharge(origin, inverter, true)
+		if err != nil {
+			c.errChannel <- err
+			return
+		}
+
+		err = c.modbus.SetWorkingMode(origin, inverter, modbus.WorkingModeTimeOfUseLuna2000)
+		if err != nil {
+			c.errChannel <- err
+			return
+		}
+	}
+
+	c.logger.WithFields(logrus.Fields{"periods": periods}).Info("Programmed time of use periods")
+	c.touPeriods = periods
+}
+
+// cheapestPeriod returns the charge period of hours consecutive hours with the lowest total price on day.
+// Hours without a price are skipped.
+func cheapestPeriod(prices map[int64]float64, day time.Time, hours uint) (modbus.TOUPeriod, bool) {
+	best := math.Inf(1)
+	bestStart := -1
+
+	for start := 0; start + int(hours) <= 24; start++ {
+		total := 0.0
+		complete := true
+
+		for hour := start; hour < start + int(hours); hour++ {
+			price, ok := prices[day.Add(time.Duration(hour) * time.Hour).Unix()]
+			if !ok {
+				complete = false
+				break
+			}
+
+			total += price
+		}
+
+		if complete && total < best {
+			best = total
+			bestStart = start
+		}
+	}
+
+	if bestStart < 0 || hours == 0 {
+		return modbus.TOUPeriod{}, false
+	}
+
+	return modbus.TOUPeriod{
+		Start: uint16(bestStart * 60),
+		End: uint16((bestStart + int(hours)) * 60),
+		Days: []time.Weekday{day.Weekday()},
+	}, true
+}
+
+// getPowerPrices returns the hourly power price between start and end by unix timestamp, averaged over the
+// price sources.
+func (c *Control) getPowerPrices(start time.Time, end time.Time) (map[int64]float64, error) {
+	response, err := c.victoriaMetrics.QueryTimeRange("avg(power_price)", start, end.Add(-time.Hour), "1h")
+	if err != nil {
+		return nil, err
+	}
+
+	prices := make(map[int64]float64)
+	for _, result := range response.Data.Result {
+		for _, value := range result.Values {
+			if len(value) != 2 {
+				continue
+			}
+
+			timestamp, ok := value[0].(float64)
+			if !ok {
+				continue
+			}
+
+			text, ok := value[1].(string)
+			if !ok {
+				continue
+			}
+
+			price, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				continue
+			}
+
+			prices[int64(timestamp)] = price
+		}
+	}
+
+	return prices, nil
+}
@@ -0,0 +1,51 @@
+package http
+
+import (
+	"time"
+	"strconv"
+	"net/http"
+
+	"gijs.eu/vonkje/modbus"
+)
+
+// defaultAuditLimit is the amount of audit entries returned when the request does not set a limit
+const defaultAuditLimit = 100
+
+// getAudit returns the register writes in the audit trail, newest first. The entries can be filtered with
+// the inverter, caller, since (RFC 3339) and limit query parameters.
+func (httpServer *HTTP) getAudit(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	filter := modbus.AuditFilter{
+		Inverter: query.Get("inverter"),
+		Caller: query.Get("caller"),
+		Limit: defaultAuditLimit,
+	}
+
+	if since := query.Get("since"); since != "" {
+		var err error
+		filter.Since, err = time.Parse(time.RFC3339, since)
+		if err != nil {
+			httpServer.SendErrorResponse(w, "Invalid since, expected an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 {
+			httpServer.SendErrorResponse(w, "Invalid limit, expected a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := httpServer.modbus.GetAuditEntries(filter)
+	if err != nil {
+		httpServer.log.WithError(err).Error("Failed to read the audit trail")
+		httpServer.SendErrorResponse(w, "Failed to read the audit trail", http.StatusInternalServerError)
+		return
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, entries)
+}
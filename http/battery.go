@@ -0,0 +1,125 @@
+package http
+
+import (
+	"fmt"
+	"errors"
+	"net/http"
+	"encoding/json"
+
+	"gijs.eu/vonkje/modbus"
+
+	"github.com/gorilla/mux"
+)
+
+type batterySettings struct {
+	WorkingMode modbus.WorkingMode `json:"working_mode"`
+	WorkingModeLabel string `json:"working_mode_label"`
+	GridCharge bool `json:"grid_charge"`
+	TOUPeriods []modbus.TOUPeriod `json:"tou_periods"`
+}
+
+// requestOrigin returns the origin of a write requested through the API for the audit trail
+func requestOrigin(req *http.Request) modbus.WriteOrigin {
+	return modbus.WriteOrigin{Caller: "http", Reason: fmt.Sprintf("Requested by %s", req.RemoteAddr)}
+}
+
+// sendSettingError answers a failed settings request, invalid settings are the fault of the client
+func (httpServer *HTTP) sendSettingError(w http.ResponseWriter, err error) {
+	if errors.Is(err, modbus.ErrInvalidSetting) {
+		httpServer.SendErrorResponse(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if errors.Is(err, modbus.ErrInverterNotFound) {
+		httpServer.SendErrorResponse(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	httpServer.log.WithError(err).Error("Settings request failed")
+	httpServer.SendErrorResponse(w, err.Error(), http.StatusBadGateway)
+}
+
+// getBatterySettings returns the working mode, grid charge switch and time of use periods of a battery
+func (httpServer *HTTP) getBatterySettings(w http.ResponseWriter, req *http.Request) {
+	inverter := mux.Vars(req)["inverter"]
+
+	mode, err := httpServer.modbus.GetWorkingMode(inverter)
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	gridCharge, err := httpServer.modbus.GetGridCharge(inverter)
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	periods, err := httpServer.modbus.GetTOUPeriods(inverter)
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, batterySettings{
+		WorkingMode: mode,
+		WorkingModeLabel: httpServer.modbus.WorkingModeLabel(mode),
+		GridCharge: gridCharge,
+		TOUPeriods: periods,
+	})
+}
+
+// setWorkingMode changes the working mode of a battery
+func (httpServer *HTTP) setWorkingMode(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		WorkingMode *modbus.WorkingMode `json:"working_mode"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.WorkingMode == nil {
+		httpServer.SendErrorResponse(w, "Invalid body, expected {\"working_mode\": <number>}", http.StatusBadRequest)
+		return
+	}
+
+	err := httpServer.modbus.SetWorkingMode(requestOrigin(req), mux.Vars(req)["inverter"], *body.WorkingMode)
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, nil)
+}
+
+// setGridCharge allows or forbids a battery to charge from the grid
+func (httpServer *HTTP) setGridCharge(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Enabled *bool `json:"enabled"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Enabled == nil {
+		httpServer.SendErrorResponse(w, "Invalid body, expected {\"enabled\": true|false}", http.StatusBadRequest)
+		return
+	}
+
+	err := httpServer.modbus.SetGridCharge(requestOrigin(req), mux.Vars(req)["inverter"], *body.Enabled)
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, nil)
+}
+
+// setTOUPeriods replaces the time of use periods of a battery
+func (httpServer *HTTP) setTOUPeriods(w http.ResponseWriter, req *http.Request) {
+	periods := []modbus.TOUPeriod{}
+	if err := json.NewDecoder(req.Body).Decode(&periods); err != nil {
+		httpServer.SendErrorResponse(w, "Invalid body, expected a list of periods", http.StatusBadRequest)
+		return
+	}
+
+	err := httpServer.modbus.SetTOUPeriods(requestOrigin(req), mux.Vars(req)["inverter"], periods)
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, nil)
+}
@@ -0,0 +1,31 @@
+package http
+
+import (
+	"net/http"
+	"encoding/json"
+)
+
+type dryRunState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// getDryRun returns whether writes to the inverters are disabled
+func (httpServer *HTTP) getDryRun(w http.ResponseWriter, req *http.Request) {
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, dryRunState{Enabled: httpServer.modbus.DryRun()})
+}
+
+// setDryRun enables or disables writes to the inverters until the next restart
+func (httpServer *HTTP) setDryRun(w http.ResponseWriter, req *http.Request) {
+	// A missing or misspelled key must not turn dry run off
+	body := struct {
+		Enabled *bool `json:"enabled"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Enabled == nil {
+		httpServer.SendErrorResponse(w, "Invalid body, expected {\"enabled\": true|false}", http.StatusBadRequest)
+		return
+	}
+
+	httpServer.modbus.SetDryRun(*body.Enabled)
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, dryRunState{Enabled: httpServer.modbus.DryRun()})
+}
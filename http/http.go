@@ -8,6 +8,8 @@ import (
 	"net/http/pprof"
 	"time"
 
+	"gijs.eu/vonkje/modbus"
+
 	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -24,6 +26,7 @@ type HTTP struct {
 	ctx 	context.Context
 	log 	*logrus.Logger
 	router 	*mux.Router
+	modbus 	*modbus.Modbus
 }
 
 func New(
@@ -31,6 +34,7 @@ func New(
 	errChannel 	chan error,
 	ctx 	context.Context,
 	logger 	*logrus.Logger,
+	modbus 	*modbus.Modbus,
 ) *HTTP {
 	return &HTTP{
 		config: config,
@@ -38,6 +42,7 @@ func New(
 		ctx: ctx,
 		log: logger,
 		router: mux.NewRouter(),
+		modbus: modbus,
 	}
 }
 
@@ -50,6 +55,27 @@ func (httpServer *HTTP) Start() {
 	httpServer.router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 	httpServer.router.HandleFunc("/debug/pprof/trace", pprof.Trace)
 
+	// Inverter states
+	httpServer.router.HandleFunc("/api/states", httpServer.getStates).Methods(http.MethodGet)
+	httpServer.router.HandleFunc("/api/states/changes", httpServer.getStateChanges).Methods(http.MethodGet)
+
+	// Register writes
+	httpServer.router.HandleFunc("/api/audit", httpServer.getAudit).Methods(http.MethodGet)
+	httpServer.router.HandleFunc("/api/dry-run", httpServer.getDryRun).Methods(http.MethodGet)
+	httpServer.router.HandleFunc("/api/dry-run", httpServer.setDryRun).Methods(http.MethodPut)
+
+	// Battery settings
+	httpServer.router.HandleFunc("/api/inverters/{inverter}/battery", httpServer.getBatterySettings).Methods(http.MethodGet)
+	httpServer.router.HandleFunc("/api/inverters/{inverter}/battery/working-mode", httpServer.setWorkingMode).Methods(http.MethodPut)
+	httpServer.router.HandleFunc("/api/inverters/{inverter}/battery/grid-charge", httpServer.setGridCharge).Methods(http.MethodPut)
+	httpServer.router.HandleFunc("/api/inverters/{inverter}/battery/tou-periods", httpServer.setTOUPeriods).Methods(http.MethodPut)
+
+	// Active power limits
+	httpServer.router.HandleFunc("/api/inverters/{inverter}/power-limit", httpServer.getPowerLimit).Methods(http.MethodGet)
+	httpServer.router.HandleFunc("/api/inverters/{inverter}/power-limit/derating", httpServer.setDerating).Methods(http.MethodPut)
+	httpServer.router.HandleFunc("/api/inverters/{inverter}/power-limit/derating", httpServer.resetDerating).Methods(http.MethodDelete)
+	httpServer.router.HandleFunc("/api/inverters/{inverter}/power-limit/export-limitation", httpServer.setExportLimitation).Methods(http.MethodPut)
+
 	// Error handlers
 	httpServer.router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		httpServer.SendErrorResponse(w, "Route not found", http.StatusNotFound)
@@ -0,0 +1,105 @@
+package http
+
+import (
+	"net/http"
+	"encoding/json"
+
+	"gijs.eu/vonkje/modbus"
+
+	"github.com/gorilla/mux"
+)
+
+type powerLimitSettings struct {
+	Derating modbus.ActivePowerDerating `json:"derating"`
+	ExportLimitation modbus.ExportLimitation `json:"export_limitation"`
+}
+
+// getPowerLimit returns the active power derating and grid export limitation of an inverter
+func (httpServer *HTTP) getPowerLimit(w http.ResponseWriter, req *http.Request) {
+	inverter := mux.Vars(req)["inverter"]
+
+	derating, err := httpServer.modbus.GetActivePowerDerating(inverter)
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	limitation, err := httpServer.modbus.GetExportLimitation(inverter)
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, powerLimitSettings{
+		Derating: derating,
+		ExportLimitation: limitation,
+	})
+}
+
+// setDerating limits the active power of an inverter in watts or as a percentage of its rated power
+func (httpServer *HTTP) setDerating(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		MaximumPower *uint `json:"maximum_power"`
+		MaximumPercentage *float64 `json:"maximum_percentage"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || (body.MaximumPower == nil && body.MaximumPercentage == nil) {
+		httpServer.SendErrorResponse(w, "Invalid body, expected {\"maximum_power\": <watts>} or {\"maximum_percentage\": <percentage>}", http.StatusBadRequest)
+		return
+	}
+
+	inverter := mux.Vars(req)["inverter"]
+
+	if body.MaximumPower != nil {
+		err := httpServer.modbus.SetActivePowerDerating(requestOrigin(req), inverter, *body.MaximumPower)
+		if err != nil {
+			httpServer.sendSettingError(w, err)
+			return
+		}
+	}
+
+	if body.MaximumPercentage != nil {
+		err := httpServer.modbus.SetActivePowerPercentage(requestOrigin(req), inverter, *body.MaximumPercentage)
+		if err != nil {
+			httpServer.sendSettingError(w, err)
+			return
+		}
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, nil)
+}
+
+// resetDerating lifts the active power derating of an inverter
+func (httpServer *HTTP) resetDerating(w http.ResponseWriter, req *http.Request) {
+	err := httpServer.modbus.ResetActivePowerDerating(requestOrigin(req), mux.Vars(req)["inverter"])
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, nil)
+}
+
+// setExportLimitation changes the grid export limitation of an inverter
+func (httpServer *HTTP) setExportLimitation(w http.ResponseWriter, req *http.Request) {
+	body := struct {
+		Mode *modbus.ActivePowerControlMode `json:"mode"`
+		MaximumPower int `json:"maximum_power"`
+		MaximumPercentage float64 `json:"maximum_percentage"`
+	}{}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil || body.Mode == nil {
+		httpServer.SendErrorResponse(w, "Invalid body, expected {\"mode\": <number>, \"maximum_power\": <watts>, \"maximum_percentage\": <percentage>}", http.StatusBadRequest)
+		return
+	}
+
+	err := httpServer.modbus.SetExportLimitation(requestOrigin(req), mux.Vars(req)["inverter"], modbus.ExportLimitation{
+		Mode: *body.Mode,
+		MaximumPower: body.MaximumPower,
+		MaximumPercentage: body.MaximumPercentage,
+	})
+	if err != nil {
+		httpServer.sendSettingError(w, err)
+		return
+	}
+
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, nil)
+}
@@ -0,0 +1,15 @@
+package http
+
+import (
+	"net/http"
+)
+
+// getStates returns the decoded status and alarm registers of all inverters
+func (httpServer *HTTP) getStates(w http.ResponseWriter, req *http.Request) {
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, httpServer.modbus.GetStates())
+}
+
+// getStateChanges returns the most recent changes of the status and alarm registers
+func (httpServer *HTTP) getStateChanges(w http.ResponseWriter, req *http.Request) {
+	httpServer.WriteJSONResponse(w, req, http.StatusOK, httpServer.modbus.GetStateChanges())
+}
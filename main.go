@@ -9,21 +9,26 @@ import (
 
 	"gijs.eu/vonkje/http"
 	"gijs.eu/vonkje/modbus"
+	"gijs.eu/vonkje/metrics"
 	"gijs.eu/vonkje/control"
+	"gijs.eu/vonkje/simulator"
 	"gijs.eu/vonkje/power_prices"
 	"gijs.eu/vonkje/packages/victoria_metrics"
 
 	"github.com/spf13/viper"
 	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Config struct {
 	LogLevel 			string `mapstructure:"log-level"`
 	HTTP 				http.Config `mapstructure:"http"`
 	Modbus 				modbus.Config `mapstructure:"modbus"`
+	Metrics 			metrics.Config `mapstructure:"metrics"`
 	VictoriaMetrics 	victoria_metrics.Config `mapstructure:"victoria-metrics"`
 	PowerPrices 		power_prices.Config `mapstructure:"power-prices"`
 	Control 			control.Config `mapstructure:"control"`
+	Simulator 			simulator.Config `mapstructure:"simulator"`
 }
 
 var (
@@ -89,26 +94,92 @@ func main() {
 	stopCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	modbusClient, err := modbus.New(config.Modbus, errChannel, stopCtx, logger)
+	// Running "vonkje simulator" serves simulated inverters instead of running the plant
+	if flag.Arg(0) == "simulator" {
+		simulatorServer, err := simulator.New(config.Simulator, errChannel, stopCtx, logger)
+		if err != nil {
+			logger.WithError(err).Panic("Failed to create modbus simulator")
+		}
+		simulatorServer.Start()
+
+		logger.Info("Exited")
+		return
+	}
+
+	// Running "vonkje modbus read|write|scan" accesses a single register range for debugging
+	if flag.Arg(0) == "modbus" {
+		err := modbus.RunCommand(config.Modbus, flag.Args()[1:], os.Stdout, logger)
+		if err != nil {
+			logger.WithError(err).Error("Modbus command failed")
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// Without a stale threshold the control loop stops trusting metrics after 3 missed polls
+	if config.Metrics.StaleAfter == 0 {
+		config.Metrics.StaleAfter = 3 * config.Modbus.ReadMetricsInterval
+	}
+
+	// Every poll adds a value, so the retention covers the retention times the read interval
+	if config.Metrics.SampleInterval == 0 {
+		config.Metrics.SampleInterval = config.Modbus.ReadMetricsInterval
+	}
+
+	// Metrics are served from the default Prometheus registry at /metrics
+	metricsStore, err := metrics.NewStore(config.Metrics, prometheus.DefaultRegisterer)
+	if err != nil {
+		logger.WithError(err).Panic("Failed to create metrics store")
+	}
+
+	modbusClient, err := modbus.New(config.Modbus, errChannel, stopCtx, logger, metricsStore)
 	if err != nil {
 		logger.WithError(err).Panic("Failed to create modbus client")
 	}
-	go modbusClient.Start()
 
-	httpServer := http.New(config.HTTP, errChannel, stopCtx, logger)
-	go httpServer.Start()
+	// Restore the history after the profile metrics are added and before the first poll. A snapshot which
+	// can not be read only costs the history, so it does not stop Vonkje from starting.
+	if config.Metrics.SnapshotPath != "" {
+		err = metricsStore.ReadSnapshot(config.Metrics.SnapshotPath)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to restore metrics snapshot, starting without history")
+		}
+		go metricsStore.StartSnapshots(stopCtx, errChannel)
+	}
 
 	victoriaMetricsClient := victoria_metrics.New(config.VictoriaMetrics)
 
+	// Fill the history up to now, on a fresh host or after a crash the snapshot is missing or behind. The
+	// warm up has a timeout, so an unreachable Victoria Metrics only delays polling and costs the history.
+	if config.Metrics.WarmUp {
+		err = metricsStore.WarmUp(stopCtx, victoriaMetricsClient)
+		if err != nil {
+			logger.WithError(err).Warn("Failed to warm up metrics from Victoria Metrics, continuing without its history")
+		}
+	}
+
+	go modbusClient.Start()
+
+	httpServer := http.New(config.HTTP, errChannel, stopCtx, logger, modbusClient)
+	go httpServer.Start()
+
 	powerPricesClient := power_prices.New(config.PowerPrices, errChannel, stopCtx, logger, victoriaMetricsClient)
 	go powerPricesClient.Start()
 
-	controlClient := control.New(config.Control, errChannel, stopCtx, logger, victoriaMetricsClient, modbusClient)
+	controlClient := control.New(config.Control, errChannel, stopCtx, logger, victoriaMetricsClient, modbusClient, metricsStore)
 	go controlClient.Start()
 
 	<-stopCtx.Done()
 
 	modbusClient.Close()
 
+	if config.Metrics.SnapshotPath != "" {
+		err = metricsStore.WriteSnapshot(config.Metrics.SnapshotPath)
+		if err != nil {
+			logger.WithError(err).Error("Failed to write metrics snapshot")
+		}
+	}
+
 	logger.Info("Exited")
 }
@@ -15,4 +15,10 @@ var controlMetrics = []Metric{
 		Help: "The a percentage of solar over production",
 		Fields: []string{},
 	},
+	{
+		Namespace: "control",
+		Name: "export_limit_derating",
+		Help: "The total active power the inverters are derated to by the export limit",
+		Fields: []string{},
+	},
 }
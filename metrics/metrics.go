@@ -2,14 +2,63 @@ package metrics
 
 import (
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+// defaultRetention is 1 days worth of data if we have a value every 15 seconds
+const defaultRetention = 5760
+
+type Config struct {
+	StaleAfter uint `mapstructure:"stale-after"`
+	// Retention is the amount of samples kept per series
+	Retention uint `mapstructure:"retention"`
+	// MetricRetention overrides the retention by namespace or by namespace_name, the most specific wins
+	MetricRetention map[string]uint `mapstructure:"metric-retention"`
+	// SnapshotPath is the file the samples are saved to and restored from on startup, empty disables it
+	SnapshotPath string `mapstructure:"snapshot-path"`
+	// SnapshotInterval is how often a snapshot is written in seconds
+	SnapshotInterval uint `mapstructure:"snapshot-interval"`
+	// SampleInterval is the time between values of a series in seconds, together with the retention it is the
+	// time window of history restored on startup
+	SampleInterval uint `mapstructure:"sample-interval"`
+	// WarmUp backfills the device metrics from VictoriaMetrics on startup
+	WarmUp bool `mapstructure:"warm-up"`
+	// WarmUpLabels select the series of this Vonkje in VictoriaMetrics, like the job and instance labels
+	// added by the scraper
+	WarmUpLabels map[string]string `mapstructure:"warm-up-labels"`
+	// WarmUpTimeout is how long the warm up may take in seconds
+	WarmUpTimeout uint `mapstructure:"warm-up-timeout"`
+}
+
+// retention returns the amount of samples kept per series of a metric.
+func (c Config) retention(namespace string, name string) int {
+	if retention, ok := c.MetricRetention[metricKey(namespace, name)]; ok {
+		return int(retention)
+	}
+
+	if retention, ok := c.MetricRetention[namespace]; ok {
+		return int(retention)
+	}
+
+	if c.Retention > 0 {
+		return int(c.Retention)
+	}
+
+	return defaultRetention
+}
+
+// Sample is a value of a series and the time it was set.
+type Sample struct {
+	Time time.Time
+	Value float64
+}
+
 type MetricValue struct {
 	Fields map[string]string
-	Values []float64
+	Samples []Sample
 }
 
 type Metric struct {
@@ -19,294 +68,399 @@ type Metric struct {
 	Fields []string
 
 	Values []MetricValue
-	PrometheusGauge *prometheus.GaugeVec
 }
 
-var metrics = []Metric{}
+// series is a set of labels of a metric and its samples.
+type series struct {
+	fields map[string]string
+	samples *ring
+	// live is set once a value is set, series which are only backfilled from history are not used by queries
+	// so a series of a removed inverter does not turn every query stale
+	live bool
+}
+
+// storedMetric is a metric in a store. Every metric has its own lock so polls of different metrics do not
+// wait on each other.
+type storedMetric struct {
+	lock sync.RWMutex
+	definition Metric
+	retention int
+	series []*series
+	gauge *prometheus.GaugeVec
+}
+
+// Store keeps the recent values of metrics and exports their last value as Prometheus gauges. A store is
+// safe for concurrent use.
+type Store struct {
+	lock sync.RWMutex
+	registerer prometheus.Registerer
+	config Config
+	metrics map[string]*storedMetric
+	// pending is the history of metrics which were not added yet when it was restored, like those of SunSpec
+	// devices which are added on the first poll
+	pending map[string][]MetricValue
+	// snapshotLock keeps the periodic and the final snapshot from being written at the same time
+	snapshotLock sync.Mutex
+	// staleAfter is the age of the newest sample after which queries fail with ErrStale, 0 disables it
+	staleAfter time.Duration
+	now func() time.Time
+}
 
 var (
 	ErrNotEnoughValues = fmt.Errorf("Not enough values")
 	ErrMetricNotFound = fmt.Errorf("Metric not found")
+	ErrStale = fmt.Errorf("Metric is stale")
 )
 
-func init() {
-	metrics = append(metrics, sun2000Metrics...)
-	metrics = append(metrics, luna2000Metrics...)
-	metrics = append(metrics, powerMeterMetrics...)
-	metrics = append(metrics, controlMetrics...)
+// NewStore returns a store with the modbus and control metrics. The gauges are registered with registerer,
+// which is the default Prometheus registry for the metrics served over HTTP and a new registry in tests.
+func NewStore(config Config, registerer prometheus.Registerer) (*Store, error) {
+	s := &Store{
+		registerer: registerer,
+		config: config,
+		metrics: make(map[string]*storedMetric),
+		pending: make(map[string][]MetricValue),
+		staleAfter: time.Duration(config.StaleAfter) * time.Second,
+		now: time.Now,
+	}
+
+	for _, metric := range append(append([]Metric{}, modbusMetrics...), controlMetrics...) {
+		err := s.AddMetric(metric.Namespace, metric.Name, metric.Help, metric.Fields)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	for index, metric := range metrics {
-		metric.Values = []MetricValue{}
-		metric.PrometheusGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
-				Namespace: metric.Namespace,
-				Name: metric.Name,
-				Help: metric.Help,
-			},
-			metric.Fields,
-		)
+	return s, nil
+}
 
-		metrics[index] = metric
-	}
+func metricKey(namespace string, name string) string {
+	return namespace + "_" + name
 }
 
-func AddMetric(namespace string, name string, help string, fields []string) *Metric {
-	metrics = append(metrics, Metric{
+// AddMetric adds a metric to the store. Adding a metric which already exists does nothing.
+func (s *Store) AddMetric(namespace string, name string, help string, fields []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	key := metricKey(namespace, name)
+	if _, ok := s.metrics[key]; ok {
+		return nil
+	}
+
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: namespace,
 		Name: name,
 		Help: help,
-		Fields: fields,
-		Values: []MetricValue{},
-		PrometheusGauge: promauto.NewGaugeVec(prometheus.GaugeOpts{
+	}, fields)
+
+	err := s.registerer.Register(gauge)
+	if err != nil {
+		return fmt.Errorf("Failed to register metric %s: %w", key, err)
+	}
+
+	metric := &storedMetric{
+		definition: Metric{
 			Namespace: namespace,
 			Name: name,
 			Help: help,
-		}, fields),
-	})
-
-	return &metrics[len(metrics) - 1]
-}
+			Fields: append([]string{}, fields...),
+		},
+		retention: s.config.retention(namespace, name),
+		gauge: gauge,
+	}
 
-func GetMetric(namespace string, name string) *Metric {
-	for _, metric := range metrics {
-		if metric.Namespace == namespace && metric.Name == name {
-			return &metric
-		}
+	// The metric is not in the store yet, so nothing else holds it
+	for _, value := range s.pending[key] {
+		metric.backfill(value, s.historySince(metric))
 	}
+	delete(s.pending, key)
+
+	s.metrics[key] = metric
 
 	return nil
 }
 
-func GetMetricValueAverage(namespace string, name string, labels map[string]string, entries uint) (float64, error) {
-	var newMetric *Metric
-	for _, metric := range metrics {
-		if metric.Namespace == namespace && metric.Name == name {
-			newMetric = &metric
-			break
-		}
+// historySince returns the start of the history kept of a metric, the zero time when no sample interval is
+// configured.
+func (s *Store) historySince(metric *storedMetric) time.Time {
+	if s.config.SampleInterval == 0 {
+		return time.Time{}
 	}
 
-	if newMetric == nil {
-		return 0, ErrMetricNotFound
+	return s.now().Add(-time.Duration(metric.retention) * time.Duration(s.config.SampleInterval) * time.Second)
+}
+
+func (s *Store) getMetric(namespace string, name string) *storedMetric {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.metrics[metricKey(namespace, name)]
+}
+
+// GetMetric returns a copy of the metric with its values, or false when it does not exist.
+func (s *Store) GetMetric(namespace string, name string) (Metric, bool) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
+		return Metric{}, false
 	}
 
-	var matches *MetricValue
-	for _, metricValue := range newMetric.Values {
-		match := true
-		for key, value := range labels {
-			if metricValue.Fields[key] != value {
-				match = false
-				break
-			}
-		}
+	metric.lock.RLock()
+	defer metric.lock.RUnlock()
+
+	copied := metric.definition
+	copied.Values = metric.values()
+
+	return copied, true
+}
+
+// values returns a copy of the live series, the caller holds the lock.
+func (m *storedMetric) values() []MetricValue {
+	return m.copySeries(false)
+}
 
-		if !match {
+// copySeries returns a copy of the series, including those only backfilled from history when all is set.
+// The caller holds the lock.
+func (m *storedMetric) copySeries(all bool) []MetricValue {
+	values := make([]MetricValue, 0, len(m.series))
+	for _, series := range m.series {
+		if !all && !series.live {
 			continue
 		}
 
-		matches = &metricValue
+		values = append(values, MetricValue{
+			Fields: series.copyFields(),
+			Samples: series.samples.all(),
+		})
 	}
 
-	if matches == nil {
-		return 0, ErrMetricNotFound
+	return values
+}
+
+func (s *series) copyFields() map[string]string {
+	fields := make(map[string]string, len(s.fields))
+	for key, value := range s.fields {
+		fields[key] = value
 	}
 
-	if uint(len(matches.Values)) < entries {
-		return 0, ErrNotEnoughValues
+	return fields
+}
+
+// matches reports whether the series has all labels.
+func (s *series) matches(labels map[string]string) bool {
+	for key, value := range labels {
+		if s.fields[key] != value {
+			return false
+		}
 	}
 
-	var sum float64
-	for i := len(matches.Values) - int(entries); i < len(matches.Values); i++ {
-		sum += matches.Values[i]
+	return true
+}
+
+// match returns the last live series with all labels, the caller holds the lock.
+func (m *storedMetric) match(labels map[string]string) *series {
+	var matches *series
+	for _, series := range m.series {
+		if series.live && series.matches(labels) {
+			matches = series
+		}
 	}
 
-	return sum / float64(entries), nil
+	return matches
 }
 
-func GetMetricAverage(namespace string, name string, entries uint) (float64, error) {
-	var newMetric *Metric
-	for _, metric := range metrics {
-		if metric.Namespace == namespace && metric.Name == name {
-			newMetric = &metric
-			break
+// find returns the series with exactly labels, the caller holds the lock. Metrics have few series, so
+// comparing them is cheaper than building a key for every value set.
+func (m *storedMetric) find(labels map[string]string) *series {
+	for _, series := range m.series {
+		if len(series.fields) == len(labels) && series.matches(labels) {
+			return series
 		}
 	}
 
-	if newMetric == nil {
+	return nil
+}
+
+func (s *Store) GetMetricValueAverage(namespace string, name string, labels map[string]string, entries uint) (float64, error) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
 		return 0, ErrMetricNotFound
 	}
 
-	if len(newMetric.Values) == 0 {
-		return 0, ErrNotEnoughValues
+	metric.lock.RLock()
+	defer metric.lock.RUnlock()
+
+	matches := metric.match(labels)
+	if matches == nil {
+		return 0, ErrMetricNotFound
 	}
 
-	var totalEntries uint
-	for _, metricValue := range newMetric.Values {
-		totalEntries += uint(len(metricValue.Values))
+	err := s.checkStale(metric, matches)
+	if err != nil {
+		return 0, err
 	}
 
-	if totalEntries < entries {
+	if uint(matches.samples.len()) < entries {
 		return 0, ErrNotEnoughValues
 	}
 
 	var sum float64
-	for _, metricValue := range newMetric.Values {
-		for i := len(metricValue.Values) - int(entries); i < len(metricValue.Values); i++ {
-			sum += metricValue.Values[i]
-		}
+	for i := matches.samples.len() - int(entries); i < matches.samples.len(); i++ {
+		sum += matches.samples.at(i).Value
 	}
 
-	return sum / float64(entries * uint(len(newMetric.Values))), nil
+	return sum / float64(entries), nil
 }
 
-func GetMetricLastEntryAverage(namespace string, name string) (float64, error) {
-	var newMetric *Metric
-	for _, metric := range metrics {
-		if metric.Namespace == namespace && metric.Name == name {
-			newMetric = &metric
-			break
-		}
+// checkStale returns ErrStale when the newest sample of series is older than the stale threshold, the
+// caller holds the lock of the metric.
+func (s *Store) checkStale(metric *storedMetric, series *series) error {
+	if s.staleAfter == 0 || series.samples.len() == 0 {
+		return nil
 	}
 
-	if newMetric == nil {
-		return 0, ErrMetricNotFound
+	age := s.now().Sub(series.samples.last().Time)
+	if age > s.staleAfter {
+		return fmt.Errorf("%w: %s_%s %v was last set %s ago", ErrStale, metric.definition.Namespace, metric.definition.Name, series.fields, age.Truncate(time.Second))
 	}
 
-	if len(newMetric.Values) == 0 {
-		return 0, ErrNotEnoughValues
-	}
+	return nil
+}
 
+// sumLastEntries sums the last entries of every live series and returns the amount of series summed, the
+// caller holds the lock.
+func (s *Store) sumLastEntries(metric *storedMetric, entries uint) (float64, uint, error) {
 	var sum float64
-	for _, metricValue := range newMetric.Values {
-		sum += metricValue.Values[len(metricValue.Values) - 1]
-	}
+	var count uint
+	for _, series := range metric.series {
+		if !series.live {
+			continue
+		}
 
-	return sum / float64(len(newMetric.Values)), nil
-}
+		err := s.checkStale(metric, series)
+		if err != nil {
+			return 0, 0, err
+		}
 
-func GetMetricLastEntrySum(namespace string, name string) (float64, error) {
-	var newMetric *Metric
-	for _, metric := range metrics {
-		if metric.Namespace == namespace && metric.Name == name {
-			newMetric = &metric
-			break
+		if uint(series.samples.len()) < entries {
+			return 0, 0, ErrNotEnoughValues
 		}
-	}
 
-	if newMetric == nil {
-		return 0, ErrMetricNotFound
+		for i := series.samples.len() - int(entries); i < series.samples.len(); i++ {
+			sum += series.samples.at(i).Value
+		}
+		count++
 	}
 
-	if len(newMetric.Values) == 0 {
-		return 0, ErrNotEnoughValues
+	if count == 0 {
+		return 0, 0, ErrNotEnoughValues
 	}
 
-	var sum float64
-	for _, metricValue := range newMetric.Values {
-		sum += metricValue.Values[len(metricValue.Values) - 1]
+	return sum, count, nil
+}
+
+func (s *Store) GetMetricAverage(namespace string, name string, entries uint) (float64, error) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
+		return 0, ErrMetricNotFound
 	}
 
-	return sum, nil
-}
+	metric.lock.RLock()
+	defer metric.lock.RUnlock()
 
-func GetMetricAverageSum(namespace string, name string, entries uint) (float64, error) {
-	var newMetric *Metric
-	for _, metric := range metrics {
-		if metric.Namespace == namespace && metric.Name == name {
-			newMetric = &metric
-			break
-		}
+	sum, count, err := s.sumLastEntries(metric, entries)
+	if err != nil {
+		return 0, err
 	}
 
-	if newMetric == nil {
+	return sum / float64(entries * count), nil
+}
+
+func (s *Store) GetMetricLastEntryAverage(namespace string, name string) (float64, error) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
 		return 0, ErrMetricNotFound
 	}
 
-	if len(newMetric.Values) == 0 {
-		return 0, ErrNotEnoughValues
-	}
+	metric.lock.RLock()
+	defer metric.lock.RUnlock()
 
-	var totalEntries uint
-	for _, metricValue := range newMetric.Values {
-		totalEntries += uint(len(metricValue.Values))
+	sum, count, err := s.sumLastEntries(metric, 1)
+	if err != nil {
+		return 0, err
 	}
 
-	if totalEntries < entries {
-		return 0, ErrNotEnoughValues
-	}
+	return sum / float64(count), nil
+}
 
-	var sum float64
-	for _, metricValue := range newMetric.Values {
-		for i := len(metricValue.Values) - int(entries); i < len(metricValue.Values); i++ {
-			sum += metricValue.Values[i]
-		}
+func (s *Store) GetMetricLastEntrySum(namespace string, name string) (float64, error) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
+		return 0, ErrMetricNotFound
 	}
 
-	return sum / float64(entries), nil
+	metric.lock.RLock()
+	defer metric.lock.RUnlock()
+
+	sum, _, err := s.sumLastEntries(metric, 1)
+
+	return sum, err
 }
 
-func GetMetricValues(namespace string, name string) ([]MetricValue, error) {
-	var newMetric *Metric
-	for _, metric := range metrics {
-		if metric.Namespace == namespace && metric.Name == name {
-			newMetric = &metric
-			break
-		}
+func (s *Store) GetMetricAverageSum(namespace string, name string, entries uint) (float64, error) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
+		return 0, ErrMetricNotFound
 	}
 
-	if newMetric == nil {
-		return nil, ErrMetricNotFound
+	metric.lock.RLock()
+	defer metric.lock.RUnlock()
+
+	sum, _, err := s.sumLastEntries(metric, entries)
+	if err != nil {
+		return 0, err
 	}
 
-	return newMetric.Values, nil
+	return sum / float64(entries), nil
 }
 
-func SetMetricValue(namespace string, name string, labels map[string]string, value float64) {
-	var newMetric *Metric
-	var metricIndex int
-	for i, metric := range metrics {
-		if metric.Namespace == namespace && metric.Name == name {
-			newMetric = &metric
-			metricIndex = i
-			break
-		}
+// GetMetricValues returns a copy of every series of the metric.
+func (s *Store) GetMetricValues(namespace string, name string) ([]MetricValue, error) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
+		return nil, ErrMetricNotFound
 	}
 
-	if newMetric == nil {
+	metric.lock.RLock()
+	defer metric.lock.RUnlock()
+
+	return metric.values(), nil
+}
+
+// SetMetricValue appends value to the series with labels and sets its gauge. Values of metrics which do not
+// exist are dropped.
+func (s *Store) SetMetricValue(namespace string, name string, labels map[string]string, value float64) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
 		return
 	}
 
-	var matches *MetricValue
-	var matchesIndex int
-	for i, metricValue := range newMetric.Values {
-		match := true
-		for key, value := range labels {
-			if metricValue.Fields[key] != value {
-				match = false
-				break
-			}
-		}
+	metric.lock.Lock()
+	defer metric.lock.Unlock()
 
-		if !match {
-			continue
+	target := metric.find(labels)
+	if target == nil {
+		fields := make(map[string]string, len(labels))
+		for key, value := range labels {
+			fields[key] = value
 		}
 
-		matchesIndex = i
-		matches = &metricValue
+		target = &series{fields: fields, samples: newRing(metric.retention)}
+		metric.series = append(metric.series, target)
 	}
 
-	if matches != nil {
-		matches.Values = append(matches.Values, value)
-		if len(matches.Values) > 5760 { // 1 days worth of data if we have a value every 15 seconds
-			matches.Values = matches.Values[1:]
-		}
-		newMetric.Values[matchesIndex] = *matches
-	} else {
-		newMetric.Values = append(newMetric.Values, MetricValue{
-			Fields: labels,
-			Values: []float64{value},
-		})
-	}
+	target.samples.push(Sample{Time: s.now(), Value: value})
+	target.live = true
 
-	metrics[metricIndex] = *newMetric
-	newMetric.PrometheusGauge.With(labels).Set(value)
+	metric.gauge.With(labels).Set(value)
 }
@@ -1,42 +1,159 @@
 package metrics
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+func newTestStore(t *testing.T) *Store {
+	store, err := NewStore(Config{}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+
+	return store
+}
+
 func TestGet(t *testing.T) {
-	AddMetric("tests", "get_test", "A test testing the get function", []string{
+	store := newTestStore(t)
+	store.AddMetric("tests", "get_test", "A test testing the get function", []string{
 		"inverter",
 		"string",
 	})
 
-	metric := GetMetric("tests", "get_test")
-	if metric == nil {
+	metric, ok := store.GetMetric("tests", "get_test")
+	if !ok {
 		t.Fatalf("Metric not found")
 	}
 
 	if metric.Name != "get_test" {
 		t.Fatalf("Incorrect name")
 	}
+
+	_, ok = store.GetMetric("tests", "unknown")
+	if ok {
+		t.Fatalf("Expected an unknown metric not to be found")
+	}
 }
 
 func TestSet(t *testing.T) {
-	AddMetric("tests", "set_test", "A test testing the set function", []string{
+	store := newTestStore(t)
+	store.AddMetric("tests", "set_test", "A test testing the set function", []string{
 		"inverter",
 		"string",
 	})
 
-	SetMetricValue("tests", "set_test", map[string]string{
+	store.SetMetricValue("tests", "set_test", map[string]string{
 		"inverter": "1",
 		"string": "1",
 	}, 1.0)
 
-	metric := GetMetric("tests", "set_test")
-	if metric == nil {
+	metric, ok := store.GetMetric("tests", "set_test")
+	if !ok {
 		t.Fatalf("Metric not found")
 	}
 
-	if metric.Values[0].Values[0] != 1.0 {
+	if metric.Values[0].Samples[0].Value != 1.0 {
 		t.Fatalf("Incorrect value")
 	}
+
+	// The returned values are a copy
+	metric.Values[0].Samples[0].Value = 2.0
+	value, err := store.GetMetricValueAverage("tests", "set_test", map[string]string{"inverter": "1"}, 1)
+	if err != nil || value != 1.0 {
+		t.Fatalf("Expected the stored value to be unchanged, got %f, %v", value, err)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	store := newTestStore(t)
+	store.AddMetric("tests", "query_test", "A test testing the query functions", []string{"inverter"})
+
+	for i := 1; i <= 3; i++ {
+		store.SetMetricValue("tests", "query_test", map[string]string{"inverter": "1"}, float64(i))
+		store.SetMetricValue("tests", "query_test", map[string]string{"inverter": "2"}, float64(i * 10))
+	}
+
+	tests := []struct {
+		name string
+		query func() (float64, error)
+		expected float64
+	}{
+		{name: "value_average", query: func() (float64, error) { return store.GetMetricValueAverage("tests", "query_test", map[string]string{"inverter": "2"}, 2) }, expected: 25},
+		{name: "average", query: func() (float64, error) { return store.GetMetricAverage("tests", "query_test", 2) }, expected: 13.75},
+		{name: "last_entry_average", query: func() (float64, error) { return store.GetMetricLastEntryAverage("tests", "query_test") }, expected: 16.5},
+		{name: "last_entry_sum", query: func() (float64, error) { return store.GetMetricLastEntrySum("tests", "query_test") }, expected: 33},
+		{name: "average_sum", query: func() (float64, error) { return store.GetMetricAverageSum("tests", "query_test", 2) }, expected: 27.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := test.query()
+			if err != nil {
+				t.Fatalf("Query failed: %s", err)
+			}
+
+			if value != test.expected {
+				t.Fatalf("Expected %f, got %f", test.expected, value)
+			}
+		})
+	}
+
+	_, err := store.GetMetricAverage("tests", "query_test", 4)
+	if err != ErrNotEnoughValues {
+		t.Fatalf("Expected not enough values, got %v", err)
+	}
+
+	_, err = store.GetMetricLastEntrySum("tests", "unknown")
+	if err != ErrMetricNotFound {
+		t.Fatalf("Expected metric not found, got %v", err)
+	}
+}
+
+func TestIsolatedStores(t *testing.T) {
+	first := newTestStore(t)
+	second := newTestStore(t)
+
+	first.SetMetricValue("modbus", "dry_run", map[string]string{}, 1)
+
+	_, err := second.GetMetricLastEntrySum("modbus", "dry_run")
+	if err != ErrNotEnoughValues {
+		t.Fatalf("Expected the second store to be empty, got %v", err)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	store := newTestStore(t)
+	store.AddMetric("tests", "concurrent_test", "A test testing concurrent access", []string{"inverter"})
+
+	var wait sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wait.Add(2)
+
+		go func(inverter string) {
+			defer wait.Done()
+
+			for j := 0; j < 1000; j++ {
+				store.SetMetricValue("tests", "concurrent_test", map[string]string{"inverter": inverter}, float64(j))
+			}
+		}(fmt.Sprint(i))
+
+		go func() {
+			defer wait.Done()
+
+			for j := 0; j < 1000; j++ {
+				store.GetMetricLastEntrySum("tests", "concurrent_test")
+				store.GetMetricValues("tests", "concurrent_test")
+			}
+		}()
+	}
+	wait.Wait()
+
+	sum, err := store.GetMetricLastEntrySum("tests", "concurrent_test")
+	if err != nil || sum != 8 * 999 {
+		t.Fatalf("Expected every series to end at 999, got %f, %v", sum, err)
+	}
 }
@@ -0,0 +1,61 @@
+package metrics
+
+var modbusMetrics = []Metric{
+	{
+		Namespace: "modbus",
+		Name: "poll_duration",
+		Help: "The time in seconds it took to read all registers of a connection",
+		Fields: []string{
+			"connection",
+		},
+	},
+	{
+		Namespace: "modbus",
+		Name: "poll_requests",
+		Help: "The amount of read requests made to read all registers of a connection",
+		Fields: []string{
+			"connection",
+		},
+	},
+	{
+		Namespace: "modbus",
+		Name: "connection_state",
+		Help: "The state of a connection, 1 for the current state",
+		Fields: []string{
+			"connection",
+			"state",
+		},
+	},
+	{
+		Namespace: "modbus",
+		Name: "connection_failures",
+		Help: "The amount of consecutive failed requests or connection attempts of a connection",
+		Fields: []string{
+			"connection",
+		},
+	},
+	{
+		Namespace: "modbus",
+		Name: "dry_run",
+		Help: "1 when writes to the inverters are disabled and only recorded",
+		Fields: []string{},
+	},
+	{
+		Namespace: "modbus",
+		Name: "dry_run_command",
+		Help: "The value which would have been written to a register in dry-run mode",
+		Fields: []string{
+			"inverter",
+			"register",
+			"caller",
+		},
+	},
+	{
+		Namespace: "modbus",
+		Name: "clock_drift",
+		Help: "The seconds the clock of an inverter is ahead of Vonkje, negative when behind",
+		Fields: []string{
+			"inverter",
+		},
+	},
+}
@@ -0,0 +1,84 @@
+package metrics
+
+import (
+	"sort"
+	"time"
+)
+
+// ring keeps the newest samples of a series up to its capacity, overwriting the oldest sample once full.
+// The buffer grows by doubling until it reaches the capacity, after that pushing never allocates.
+type ring struct {
+	samples []Sample
+	// start is the index of the oldest sample
+	start int
+	length int
+	capacity int
+}
+
+func newRing(capacity int) *ring {
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &ring{
+		samples: make([]Sample, 0, min(capacity, 16)),
+		capacity: capacity,
+	}
+}
+
+func (r *ring) push(sample Sample) {
+	if r.length < r.capacity {
+		if r.length == len(r.samples) && len(r.samples) == cap(r.samples) {
+			r.grow()
+		}
+
+		r.samples = r.samples[:r.length + 1]
+		r.samples[r.length] = sample
+		r.length++
+		return
+	}
+
+	r.samples[r.start] = sample
+	r.start = (r.start + 1) % r.capacity
+}
+
+// grow doubles the buffer up to the capacity. It is only called before the buffer wraps, so the samples
+// are still in order.
+func (r *ring) grow() {
+	samples := make([]Sample, len(r.samples), min(cap(r.samples) * 2, r.capacity))
+	copy(samples, r.samples)
+	r.samples = samples
+}
+
+func (r *ring) len() int {
+	return r.length
+}
+
+// at returns the sample at index i, counting from the oldest sample.
+func (r *ring) at(i int) Sample {
+	return r.samples[(r.start + i) % len(r.samples)]
+}
+
+func (r *ring) last() Sample {
+	return r.at(r.length - 1)
+}
+
+// since returns a copy of the samples at or after t, oldest first. Samples are pushed in order of time,
+// so the first one is found with a binary search.
+func (r *ring) since(t time.Time) []Sample {
+	first := sort.Search(r.length, func(i int) bool {
+		return !r.at(i).Time.Before(t)
+	})
+
+	samples := make([]Sample, 0, r.length - first)
+	for i := first; i < r.length; i++ {
+		samples = append(samples, r.at(i))
+	}
+
+	return samples
+}
+
+// all returns a copy of the samples, oldest first.
+func (r *ring) all() []Sample {
+	return r.since(time.Time{})
+}
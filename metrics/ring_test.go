@@ -0,0 +1,124 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRing(t *testing.T) {
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	r := newRing(40)
+	for i := 0; i < 100; i++ {
+		r.push(Sample{Time: start.Add(time.Duration(i) * time.Second), Value: float64(i)})
+	}
+
+	if r.len() != 40 {
+		t.Fatalf("Expected 40 samples, got %d", r.len())
+	}
+
+	if cap(r.samples) != 40 {
+		t.Fatalf("Expected the buffer to stop growing at the capacity, got %d", cap(r.samples))
+	}
+
+	samples := r.all()
+	for i, sample := range samples {
+		if sample.Value != float64(60 + i) {
+			t.Fatalf("Expected sample %d to be %d, got %f", i, 60 + i, sample.Value)
+		}
+	}
+
+	if r.last().Value != 99 {
+		t.Fatalf("Expected the last sample to be 99, got %f", r.last().Value)
+	}
+
+	since := r.since(start.Add(90 * time.Second))
+	if len(since) != 10 || since[0].Value != 90 {
+		t.Fatalf("Expected 10 samples from 90, got %v", since)
+	}
+
+	// The copy does not share the buffer
+	samples[0].Value = -1
+	if r.at(0).Value != 60 {
+		t.Fatalf("Expected the ring to be unchanged, got %f", r.at(0).Value)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	config := Config{
+		Retention: 100,
+		MetricRetention: map[string]uint{
+			"control": 10,
+			"control_home_load": 20,
+		},
+	}
+
+	tests := []struct {
+		namespace string
+		name string
+		expected int
+	}{
+		{namespace: "control", name: "home_load", expected: 20},
+		{namespace: "control", name: "battery_target", expected: 10},
+		{namespace: "modbus", name: "input_power", expected: 100},
+	}
+
+	for _, test := range tests {
+		retention := config.retention(test.namespace, test.name)
+		if retention != test.expected {
+			t.Fatalf("Expected retention %d for %s_%s, got %d", test.expected, test.namespace, test.name, retention)
+		}
+	}
+
+	if retention := (Config{}).retention("modbus", "input_power"); retention != defaultRetention {
+		t.Fatalf("Expected the default retention, got %d", retention)
+	}
+
+	store, err := NewStore(config, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+
+	store.AddMetric("control", "retention_test", "A test testing the retention", []string{})
+	for i := 0; i < 50; i++ {
+		store.SetMetricValue("control", "retention_test", map[string]string{}, float64(i))
+	}
+
+	values, err := store.GetMetricValues("control", "retention_test")
+	if err != nil || len(values[0].Samples) != 10 {
+		t.Fatalf("Expected 10 samples, got %v, %v", values, err)
+	}
+}
+
+func BenchmarkRingPush(b *testing.B) {
+	r := newRing(defaultRetention)
+	sample := Sample{Time: time.Now(), Value: 1}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.push(sample)
+	}
+}
+
+func BenchmarkSetMetricValue(b *testing.B) {
+	store, err := NewStore(Config{}, prometheus.NewRegistry())
+	if err != nil {
+		b.Fatalf("Failed to create store: %s", err)
+	}
+
+	labels := map[string]string{"inverter": "1", "string": "1"}
+	store.AddMetric("tests", "benchmark", "A benchmark of setting values", []string{"inverter", "string"})
+
+	// Fill the buffer so the benchmark measures inserts into a full ring
+	for i := 0; i < defaultRetention; i++ {
+		store.SetMetricValue("tests", "benchmark", labels, float64(i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.SetMetricValue("tests", "benchmark", labels, float64(i))
+	}
+}
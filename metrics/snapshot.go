@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"bufio"
+	"errors"
+	"context"
+	"encoding/gob"
+	"path/filepath"
+)
+
+const (
+	// snapshotVersion is increased when the format of a snapshot changes, older snapshots are then ignored
+	snapshotVersion = 1
+
+	defaultSnapshotInterval = 5 * time.Minute
+)
+
+var ErrSnapshotVersion = fmt.Errorf("Unsupported snapshot version")
+
+type snapshot struct {
+	Version int
+	Time time.Time
+	Metrics []snapshotMetric
+}
+
+type snapshotMetric struct {
+	Namespace string
+	Name string
+	Series []MetricValue
+}
+
+// WriteSnapshot writes the samples of every metric to path as gob. The snapshot is written to a temporary
+// file which replaces path once complete, so a crash while writing leaves the previous snapshot intact.
+func (s *Store) WriteSnapshot(path string) error {
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+
+	data := snapshot{
+		Version: snapshotVersion,
+		Time: s.now(),
+	}
+
+	s.lock.RLock()
+	metrics := make([]*storedMetric, 0, len(s.metrics))
+	for _, metric := range s.metrics {
+		metrics = append(metrics, metric)
+	}
+	s.lock.RUnlock()
+
+	for _, metric := range metrics {
+		// Series which were restored but not set since are kept until their samples are older than the
+		// history, so the history of a device which is offline for a while is not lost
+		metric.lock.RLock()
+		series := metric.copySeries(true)
+		metric.lock.RUnlock()
+
+		if len(series) == 0 {
+			continue
+		}
+
+		data.Metrics = append(data.Metrics, snapshotMetric{
+			Namespace: metric.definition.Namespace,
+			Name: metric.definition.Name,
+			Series: series,
+		})
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path) + ".*.tmp")
+	if err != nil {
+		return fmt.Errorf("Failed to create metrics snapshot: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	err = gob.NewEncoder(writer).Encode(data)
+	if err != nil {
+		return fmt.Errorf("Failed to encode metrics snapshot: %w", err)
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		return fmt.Errorf("Failed to write metrics snapshot: %w", err)
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return fmt.Errorf("Failed to write metrics snapshot: %w", err)
+	}
+
+	err = file.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to write metrics snapshot: %w", err)
+	}
+
+	err = os.Rename(file.Name(), path)
+	if err != nil {
+		return fmt.Errorf("Failed to replace metrics snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// ReadSnapshot restores the samples in the snapshot at path. Only samples newer than those already in a
+// series are added, so it should be called before the first poll. Samples outside the retention or older
+// than the retention times the sample interval are dropped. Metrics which are not in the store yet are
+// restored when they are added. Restored series are not used by queries until a value is set, so series of
+// inverters which are no longer polled do not turn queries stale, and the gauges are not set, so Prometheus
+// does not see restored values as fresh. A missing snapshot is not an error.
+func (s *Store) ReadSnapshot(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to open metrics snapshot: %w", err)
+	}
+	defer file.Close()
+
+	// Decode everything before restoring anything, so a corrupt snapshot leaves the store empty
+	data := snapshot{}
+	err = gob.NewDecoder(bufio.NewReader(file)).Decode(&data)
+	if err != nil {
+		return fmt.Errorf("Failed to decode metrics snapshot %s: %w", path, err)
+	}
+
+	if data.Version != snapshotVersion {
+		return fmt.Errorf("%w %d in %s", ErrSnapshotVersion, data.Version, path)
+	}
+
+	for _, restored := range data.Metrics {
+		s.lock.Lock()
+		metric := s.metrics[metricKey(restored.Namespace, restored.Name)]
+		if metric == nil {
+			key := metricKey(restored.Namespace, restored.Name)
+			s.pending[key] = append(s.pending[key], restored.Series...)
+			s.lock.Unlock()
+			continue
+		}
+		s.lock.Unlock()
+
+		since := s.historySince(metric)
+
+		metric.lock.Lock()
+		for _, value := range restored.Series {
+			metric.backfill(value, since)
+		}
+		metric.lock.Unlock()
+	}
+
+	return nil
+}
+
+// backfill adds the samples of a series from history, the caller holds the lock. Samples before since or
+// which are not newer than the last sample of the series are dropped.
+func (m *storedMetric) backfill(value MetricValue, since time.Time) {
+	samples := value.Samples
+	if len(samples) > m.retention {
+		samples = samples[len(samples) - m.retention:]
+	}
+
+	target := m.find(value.Fields)
+	for _, sample := range samples {
+		if sample.Time.Before(since) {
+			continue
+		}
+
+		// Series are only created for samples within the history, so series which are no longer set expire
+		if target == nil {
+			target = &series{fields: value.Fields, samples: newRing(m.retention)}
+			m.series = append(m.series, target)
+		}
+
+		// The ring relies on samples being in order of time
+		if target.samples.len() > 0 && !sample.Time.After(target.samples.last().Time) {
+			continue
+		}
+
+		target.samples.push(sample)
+	}
+}
+
+// StartSnapshots writes a snapshot to the configured path every interval until ctx is done. The final
+// snapshot on shutdown is left to the caller, after polling has stopped.
+func (s *Store) StartSnapshots(ctx context.Context, errChannel chan error) {
+	if s.config.SnapshotPath == "" {
+		return
+	}
+
+	interval := time.Duration(s.config.SnapshotInterval) * time.Second
+	if interval == 0 {
+		interval = defaultSnapshotInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.WriteSnapshot(s.config.SnapshotPath)
+			if err != nil {
+				errChannel <- err
+			}
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"os"
+	"time"
+	"testing"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	store := newTestStore(t)
+	store.AddMetric("tests", "snapshot_test", "A test testing snapshots", []string{"inverter"})
+
+	for i := 0; i < 20; i++ {
+		store.now = func() time.Time { return start.Add(time.Duration(i) * 15 * time.Second) }
+		store.SetMetricValue("tests", "snapshot_test", map[string]string{"inverter": "1"}, float64(i))
+	}
+
+	err := store.WriteSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+
+	// The restoring store keeps fewer samples than were saved and starts 5 intervals later, so only the
+	// samples of the last 8 intervals are restored
+	restored, err := NewStore(Config{SampleInterval: 15, MetricRetention: map[string]uint{"tests": 8}}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	restored.now = func() time.Time { return start.Add(25 * 15 * time.Second) }
+	restored.AddMetric("tests", "snapshot_test", "A test testing snapshots", []string{"inverter"})
+
+	err = restored.ReadSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+
+	// Restored history is only used once the series is set again
+	_, err = restored.GetMetricLastEntrySum("tests", "snapshot_test")
+	if err != ErrNotEnoughValues {
+		t.Fatalf("Expected restored series to be unused before a value is set, got %v", err)
+	}
+
+	restored.SetMetricValue("tests", "snapshot_test", map[string]string{"inverter": "1"}, 25)
+
+	window, err := restored.GetMetricWindow("tests", "snapshot_test", map[string]string{"inverter": "1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("Failed to get window: %s", err)
+	}
+
+	if len(window.Samples) != 4 || window.Samples[0].Value != 17 || !window.Samples[2].Time.Equal(start.Add(19 * 15 * time.Second)) {
+		t.Fatalf("Expected samples 17 to 19 with their times followed by the new value, got %v", window.Samples)
+	}
+
+	average, err := restored.GetMetricValueAverage("tests", "snapshot_test", map[string]string{"inverter": "1"}, 2)
+	if err != nil || average != 22 {
+		t.Fatalf("Expected an average of 22, got %f, %v", average, err)
+	}
+}
+
+func TestSnapshotOrphanSeries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	store := newTestStore(t)
+	store.now = func() time.Time { return start }
+	store.AddMetric("tests", "orphan_test", "A test testing orphan series", []string{"inverter"})
+	store.SetMetricValue("tests", "orphan_test", map[string]string{"inverter": "1"}, 1)
+	store.SetMetricValue("tests", "orphan_test", map[string]string{"inverter": "removed"}, 2)
+
+	err := store.WriteSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+
+	restored, err := NewStore(Config{StaleAfter: 45, SampleInterval: 15, Retention: 100}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	restored.AddMetric("tests", "orphan_test", "A test testing orphan series", []string{"inverter"})
+
+	now := start.Add(time.Minute)
+	restored.now = func() time.Time { return now }
+
+	err = restored.ReadSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+
+	// Only the inverter which is still polled is set, long after the stale threshold of the removed one
+	now = start.Add(time.Hour)
+	restored.SetMetricValue("tests", "orphan_test", map[string]string{"inverter": "1"}, 3)
+
+	sum, err := restored.GetMetricLastEntrySum("tests", "orphan_test")
+	if err != nil || sum != 3 {
+		t.Fatalf("Expected a sum of 3 without the removed inverter, got %f, %v", sum, err)
+	}
+
+	average, err := restored.GetMetricLastEntryAverage("tests", "orphan_test")
+	if err != nil || average != 3 {
+		t.Fatalf("Expected an average of 3 without the removed inverter, got %f, %v", average, err)
+	}
+
+	// The removed inverter expires once its samples are older than the history
+	now = start.Add(1000 * 15 * time.Second)
+	restored.SetMetricValue("tests", "orphan_test", map[string]string{"inverter": "1"}, 4)
+
+	err = restored.WriteSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+
+	expired, err := NewStore(Config{SampleInterval: 15, Retention: 100}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	expired.now = func() time.Time { return now }
+	expired.AddMetric("tests", "orphan_test", "A test testing orphan series", []string{"inverter"})
+
+	err = expired.ReadSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+
+	metric := expired.getMetric("tests", "orphan_test")
+	if len(metric.series) != 1 || metric.series[0].fields["inverter"] != "1" {
+		t.Fatalf("Expected only the series of the polled inverter to be restored, got %d series", len(metric.series))
+	}
+}
+
+func TestSnapshotLateMetric(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+
+	store := newTestStore(t)
+	store.AddMetric("tests", "late_test", "A test testing metrics added after restoring", []string{})
+	store.SetMetricValue("tests", "late_test", map[string]string{}, 1)
+
+	err := store.WriteSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to write snapshot: %s", err)
+	}
+
+	// Like SunSpec metrics, the metric is added after the snapshot is read
+	restored := newTestStore(t)
+	err = restored.ReadSnapshot(path)
+	if err != nil {
+		t.Fatalf("Failed to read snapshot: %s", err)
+	}
+
+	restored.AddMetric("tests", "late_test", "A test testing metrics added after restoring", []string{})
+	restored.SetMetricValue("tests", "late_test", map[string]string{}, 3)
+
+	average, err := restored.GetMetricValueAverage("tests", "late_test", map[string]string{}, 2)
+	if err != nil || average != 2 {
+		t.Fatalf("Expected an average of 2 with the restored value, got %f, %v", average, err)
+	}
+}
+
+func TestCorruptSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.snapshot")
+
+	store := newTestStore(t)
+	err := store.ReadSnapshot(path)
+	if err != nil {
+		t.Fatalf("Expected a missing snapshot to be ignored, got %s", err)
+	}
+
+	err = os.WriteFile(path, []byte("not a snapshot"), 0644)
+	if err != nil {
+		t.Fatalf("Failed to write file: %s", err)
+	}
+
+	err = store.ReadSnapshot(path)
+	if err == nil {
+		t.Fatalf("Expected a corrupt snapshot to fail")
+	}
+
+	_, err = store.GetMetricLastEntrySum("modbus", "dry_run")
+	if err != ErrNotEnoughValues {
+		t.Fatalf("Expected the store to be empty, got %v", err)
+	}
+}
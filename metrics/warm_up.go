@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+	"sort"
+	"context"
+	"strconv"
+	"strings"
+
+	"gijs.eu/vonkje/packages/victoria_metrics"
+)
+
+const defaultWarmUpTimeout = 30 * time.Second
+
+// warmUpNamespaces are the namespaces of the device profiles, which are polled and scraped into VictoriaMetrics
+var warmUpNamespaces = map[string]bool{
+	"sun2000": true,
+	"luna2000": true,
+	"power_meter": true,
+}
+
+// WarmUp backfills the device metrics with their history from VictoriaMetrics, covering the retention of
+// every metric at one sample per sample interval. Only series with the configured warm up labels are queried,
+// so other Vonkjes or scrape targets writing to the same VictoriaMetrics are left out. Like ReadSnapshot only
+// samples newer than those already in a series are added, so the history extends a restored snapshot up to
+// now. It gives up after the warm up timeout or when ctx is done and should be called before the first poll.
+func (s *Store) WarmUp(ctx context.Context, victoriaMetrics *victoria_metrics.VictoriaMetrics) error {
+	if s.config.SampleInterval == 0 {
+		return fmt.Errorf("Warm up needs a sample interval")
+	}
+
+	if len(s.config.WarmUpLabels) == 0 {
+		return fmt.Errorf("Warm up needs labels selecting the series of this Vonkje")
+	}
+
+	timeout := time.Duration(s.config.WarmUpTimeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultWarmUpTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	s.lock.RLock()
+	metrics := make([]*storedMetric, 0, len(s.metrics))
+	for _, metric := range s.metrics {
+		if warmUpNamespaces[metric.definition.Namespace] {
+			metrics = append(metrics, metric)
+		}
+	}
+	s.lock.RUnlock()
+
+	interval := time.Duration(s.config.SampleInterval) * time.Second
+	step := fmt.Sprintf("%ds", s.config.SampleInterval)
+	selector := warmUpSelector(s.config.WarmUpLabels)
+	end := s.now()
+
+	for _, metric := range metrics {
+		start := end.Add(-time.Duration(metric.retention) * interval)
+		name := metricKey(metric.definition.Namespace, metric.definition.Name)
+
+		// The rollup over one step only returns points with a sample in that step, instead of repeating the
+		// last value over gaps which would make a metric look fresh while Vonkje was down
+		query := fmt.Sprintf("default_rollup(%s{%s}[%s])", name, selector, step)
+
+		response, err := victoriaMetrics.QueryTimeRangeContext(ctx, query, start, end, step)
+		if err != nil {
+			return fmt.Errorf("Failed to query history of %s: %w", name, err)
+		}
+
+		metric.lock.Lock()
+		for _, result := range response.Data.Result {
+			value, ok := historyValue(metric.definition.Fields, s.config.WarmUpLabels, result.Metric, result.Values)
+			if !ok {
+				continue
+			}
+
+			metric.backfill(value, start)
+		}
+		metric.lock.Unlock()
+	}
+
+	return nil
+}
+
+// warmUpSelector returns the label matchers selecting labels, sorted so the query is stable.
+func warmUpSelector(labels map[string]string) string {
+	matchers := make([]string, 0, len(labels))
+	for name, value := range labels {
+		matchers = append(matchers, name + "=" + strconv.Quote(value))
+	}
+	sort.Strings(matchers)
+
+	return strings.Join(matchers, ",")
+}
+
+// historyValue converts a series returned by VictoriaMetrics to a metric value with the fields of the metric.
+// Missing fields are empty like Prometheus exports them. Series with labels which are neither a field nor
+// one of the selected labels are not ours and are ignored.
+func historyValue(fields []string, selected map[string]string, labels map[string]string, values [][]interface{}) (MetricValue, bool) {
+	value := MetricValue{
+		Fields: make(map[string]string, len(fields)),
+		Samples: make([]Sample, 0, len(values)),
+	}
+
+	for _, field := range fields {
+		value.Fields[field] = labels[field]
+	}
+
+	for label := range labels {
+		_, field := value.Fields[label]
+		_, ok := selected[label]
+		if label != "__name__" && !field && !ok {
+			return MetricValue{}, false
+		}
+	}
+
+	for _, point := range values {
+		if len(point) != 2 {
+			continue
+		}
+
+		timestamp, ok := point[0].(float64)
+		if !ok {
+			continue
+		}
+
+		text, ok := point[1].(string)
+		if !ok {
+			continue
+		}
+
+		sample, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			continue
+		}
+
+		value.Samples = append(value.Samples, Sample{
+			Time: time.UnixMilli(int64(timestamp * 1000)),
+			Value: sample,
+		})
+	}
+
+	return value, true
+}
@@ -0,0 +1,108 @@
+package metrics
+
+import (
+	"fmt"
+	"time"
+	"context"
+	"testing"
+	"net/http"
+	"net/http/httptest"
+
+	"gijs.eu/vonkje/packages/victoria_metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newWarmUpStore(t *testing.T, config Config) *Store {
+	config.SampleInterval = 15
+	config.WarmUpLabels = map[string]string{"job": "vonkje"}
+
+	store, err := NewStore(config, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+
+	return store
+}
+
+func TestWarmUp(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	queries := []string{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		queries = append(queries, query)
+
+		if query != `default_rollup(sun2000_input_power{job="vonkje"}[15s])` {
+			fmt.Fprint(w, `{"status":"success","data":{"resultType":"matrix","result":[]}}`)
+			return
+		}
+
+		// The second series has a label this Vonkje does not export, like one of another scrape target
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"inverter":"1","job":"vonkje"},"values":[[%d,"100"],[%d,"200"],[%d,"300"]]},{"metric":{"inverter":"1","job":"vonkje","site":"other"},"values":[[%d,"900"]]}]}}`, now.Add(-30 * time.Second).Unix(), now.Add(-15 * time.Second).Unix(), now.Unix(), now.Add(-time.Second).Unix())
+	}))
+	defer server.Close()
+
+	store := newWarmUpStore(t, Config{})
+	store.now = func() time.Time { return now }
+	store.AddMetric("sun2000", "input_power", "The input power", []string{"inverter"})
+	store.AddMetric("tests", "warm_up_test", "A test testing the warm up", []string{})
+
+	// A restored snapshot is extended with the newer history
+	store.lock.RLock()
+	metric := store.metrics[metricKey("sun2000", "input_power")]
+	store.lock.RUnlock()
+	metric.backfill(MetricValue{
+		Fields: map[string]string{"inverter": "1"},
+		Samples: []Sample{{Time: now.Add(-15 * time.Second), Value: 150}},
+	}, time.Time{})
+
+	err := store.WarmUp(context.Background(), victoria_metrics.New(victoria_metrics.Config{URL: server.URL}))
+	if err != nil {
+		t.Fatalf("Failed to warm up: %s", err)
+	}
+
+	for _, query := range queries {
+		if query == `default_rollup(tests_warm_up_test{job="vonkje"}[15s])` {
+			t.Fatalf("Expected only device metrics to be queried")
+		}
+	}
+
+	if len(metric.series) != 1 {
+		t.Fatalf("Expected the foreign series to be ignored, got %d series", len(metric.series))
+	}
+
+	// History is only used once the series is polled again
+	store.SetMetricValue("sun2000", "input_power", map[string]string{"inverter": "1"}, 400)
+
+	window, err := store.GetMetricWindow("sun2000", "input_power", map[string]string{"inverter": "1"}, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to get window: %s", err)
+	}
+
+	if len(window.Samples) != 3 || window.Samples[0].Value != 150 || window.Samples[1].Value != 300 || !window.Samples[1].Time.Equal(now) {
+		t.Fatalf("Expected the snapshot sample followed by the newer history, got %v", window.Samples)
+	}
+}
+
+func TestWarmUpTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer server.Close()
+	defer close(hang)
+
+	store := newWarmUpStore(t, Config{WarmUpTimeout: 1})
+	store.AddMetric("sun2000", "input_power", "The input power", []string{"inverter"})
+
+	start := time.Now()
+	err := store.WarmUp(context.Background(), victoria_metrics.New(victoria_metrics.Config{URL: server.URL}))
+	if err == nil {
+		t.Fatalf("Expected a hanging Victoria Metrics to fail the warm up")
+	}
+
+	if time.Since(start) > 5 * time.Second {
+		t.Fatalf("Expected the warm up to give up after its timeout, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Window is the samples of a series within a duration before now, oldest first.
+type Window struct {
+	Fields map[string]string
+	Samples []Sample
+}
+
+// GetMetricWindows returns a window of every series of the metric matching labels. It fails with ErrStale
+// when the newest sample of one of them is older than the stale threshold.
+func (s *Store) GetMetricWindows(namespace string, name string, labels map[string]string, duration time.Duration) ([]Window, error) {
+	metric := s.getMetric(namespace, name)
+	if metric == nil {
+		return nil, ErrMetricNotFound
+	}
+
+	metric.lock.RLock()
+	defer metric.lock.RUnlock()
+
+	since := s.now().Add(-duration)
+
+	windows := []Window{}
+	for _, series := range metric.series {
+		if !series.live || !series.matches(labels) {
+			continue
+		}
+
+		err := s.checkStale(metric, series)
+		if err != nil {
+			return nil, err
+		}
+
+		windows = append(windows, Window{
+			Fields: series.copyFields(),
+			Samples: series.samples.since(since),
+		})
+	}
+
+	if len(windows) == 0 {
+		return nil, ErrMetricNotFound
+	}
+
+	return windows, nil
+}
+
+// GetMetricWindow returns the window of the series matching labels. Like GetMetricValueAverage the last
+// series is used when labels match more than one.
+func (s *Store) GetMetricWindow(namespace string, name string, labels map[string]string, duration time.Duration) (Window, error) {
+	windows, err := s.GetMetricWindows(namespace, name, labels, duration)
+	if err != nil {
+		return Window{}, err
+	}
+
+	return windows[len(windows) - 1], nil
+}
+
+func (w Window) Average() (float64, error) {
+	if len(w.Samples) == 0 {
+		return 0, ErrNotEnoughValues
+	}
+
+	var sum float64
+	for _, sample := range w.Samples {
+		sum += sample.Value
+	}
+
+	return sum / float64(len(w.Samples)), nil
+}
+
+func (w Window) Min() (float64, error) {
+	if len(w.Samples) == 0 {
+		return 0, ErrNotEnoughValues
+	}
+
+	min := math.Inf(1)
+	for _, sample := range w.Samples {
+		min = math.Min(min, sample.Value)
+	}
+
+	return min, nil
+}
+
+func (w Window) Max() (float64, error) {
+	if len(w.Samples) == 0 {
+		return 0, ErrNotEnoughValues
+	}
+
+	max := math.Inf(-1)
+	for _, sample := range w.Samples {
+		max = math.Max(max, sample.Value)
+	}
+
+	return max, nil
+}
+
+func (w Window) Last() (float64, error) {
+	if len(w.Samples) == 0 {
+		return 0, ErrNotEnoughValues
+	}
+
+	return w.Samples[len(w.Samples) - 1].Value, nil
+}
+
+// Percentile returns the percentile between 0 and 100 of the values, interpolating between the two closest
+// values.
+func (w Window) Percentile(percentile float64) (float64, error) {
+	if percentile < 0 || percentile > 100 {
+		return 0, fmt.Errorf("Percentile %f is not between 0 and 100", percentile)
+	}
+
+	if len(w.Samples) == 0 {
+		return 0, ErrNotEnoughValues
+	}
+
+	values := make([]float64, len(w.Samples))
+	for i, sample := range w.Samples {
+		values[i] = sample.Value
+	}
+	sort.Float64s(values)
+
+	rank := percentile / 100 * float64(len(values) - 1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+
+	return values[lower] + (values[upper] - values[lower]) * (rank - float64(lower)), nil
+}
+
+// Rate returns the change per second between the first and the last sample, for counters like the
+// accumulated yield.
+func (w Window) Rate() (float64, error) {
+	if len(w.Samples) < 2 {
+		return 0, ErrNotEnoughValues
+	}
+
+	first := w.Samples[0]
+	last := w.Samples[len(w.Samples) - 1]
+
+	seconds := last.Time.Sub(first.Time).Seconds()
+	if seconds <= 0 {
+		return 0, ErrNotEnoughValues
+	}
+
+	return (last.Value - first.Value) / seconds, nil
+}
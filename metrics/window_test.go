@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"time"
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestWindow(t *testing.T) {
+	store := newTestStore(t)
+	store.AddMetric("tests", "window_test", "A test testing windowed queries", []string{"inverter"})
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time {
+		return now
+	}
+
+	// A sample every minute for 10 minutes, counting up from 1
+	for i := 1; i <= 10; i++ {
+		now = now.Add(time.Minute)
+		store.SetMetricValue("tests", "window_test", map[string]string{"inverter": "1"}, float64(i))
+	}
+
+	window, err := store.GetMetricWindow("tests", "window_test", map[string]string{"inverter": "1"}, 5 * time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to get window: %s", err)
+	}
+
+	if len(window.Samples) != 6 || window.Samples[0].Value != 5 {
+		t.Fatalf("Expected the samples from 5 minutes ago, got %+v", window.Samples)
+	}
+
+	tests := []struct {
+		name string
+		query func() (float64, error)
+		expected float64
+	}{
+		{name: "average", query: window.Average, expected: 7.5},
+		{name: "min", query: window.Min, expected: 5},
+		{name: "max", query: window.Max, expected: 10},
+		{name: "last", query: window.Last, expected: 10},
+		{name: "median", query: func() (float64, error) { return window.Percentile(50) }, expected: 7.5},
+		{name: "percentile_90", query: func() (float64, error) { return window.Percentile(90) }, expected: 9.5},
+		{name: "rate", query: window.Rate, expected: 1.0 / 60},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := test.query()
+			if err != nil {
+				t.Fatalf("Query failed: %s", err)
+			}
+
+			if value != test.expected {
+				t.Fatalf("Expected %f, got %f", test.expected, value)
+			}
+		})
+	}
+
+	_, err = Window{}.Average()
+	if err != ErrNotEnoughValues {
+		t.Fatalf("Expected an empty window to have not enough values, got %v", err)
+	}
+}
+
+func TestStale(t *testing.T) {
+	store, err := NewStore(Config{StaleAfter: 60}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create store: %s", err)
+	}
+	store.AddMetric("tests", "stale_test", "A test testing stale metrics", []string{"inverter"})
+
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	store.now = func() time.Time {
+		return now
+	}
+
+	store.SetMetricValue("tests", "stale_test", map[string]string{"inverter": "1"}, 1)
+	store.SetMetricValue("tests", "stale_test", map[string]string{"inverter": "2"}, 2)
+
+	// Polling of inverter 2 stalls
+	now = now.Add(45 * time.Second)
+	store.SetMetricValue("tests", "stale_test", map[string]string{"inverter": "1"}, 1)
+	now = now.Add(30 * time.Second)
+
+	_, err = store.GetMetricValueAverage("tests", "stale_test", map[string]string{"inverter": "1"}, 1)
+	if err != nil {
+		t.Fatalf("Expected inverter 1 to be fresh, got %s", err)
+	}
+
+	_, err = store.GetMetricLastEntrySum("tests", "stale_test")
+	if !errors.Is(err, ErrStale) {
+		t.Fatalf("Expected a sum over a stale series to be stale, got %v", err)
+	}
+
+	_, err = store.GetMetricWindow("tests", "stale_test", map[string]string{"inverter": "2"}, 5 * time.Minute)
+	if !errors.Is(err, ErrStale) {
+		t.Fatalf("Expected the window of inverter 2 to be stale, got %v", err)
+	}
+}
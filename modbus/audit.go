@@ -0,0 +1,148 @@
+package modbus
+
+import (
+	"os"
+	"sync"
+	"time"
+	"bufio"
+	"encoding/json"
+)
+
+// maxAuditEntriesInMemory is the amount of entries kept when no audit file is configured.
+const maxAuditEntriesInMemory = 1000
+
+// WriteOrigin describes who writes to a register and why, for the audit trail.
+type WriteOrigin struct {
+	Caller string
+	Reason string
+}
+
+// AuditEntry is a single register write.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	Inverter string `json:"inverter"`
+	UnitId uint8 `json:"unit_id"`
+	Register string `json:"register,omitempty"`
+	Address uint16 `json:"address"`
+	OldValue *float64 `json:"old_value,omitempty"`
+	NewValue *float64 `json:"new_value,omitempty"`
+	OldWords []uint16 `json:"old_words"`
+	NewWords []uint16 `json:"new_words"`
+	Caller string `json:"caller"`
+	Reason string `json:"reason"`
+	Verified bool `json:"verified"`
+	DryRun bool `json:"dry_run,omitempty"`
+	Attempts int `json:"attempts"`
+	Error string `json:"error,omitempty"`
+}
+
+// AuditFilter selects audit entries. Empty fields match everything.
+type AuditFilter struct {
+	Inverter string
+	Caller string
+	Since time.Time
+	Limit int
+}
+
+// auditTrail appends every write to a JSON lines file so the trail survives restarts. Without a file
+// the most recent entries are kept in memory.
+type auditTrail struct {
+	lock sync.Mutex
+	path string
+	entries []AuditEntry
+}
+
+func newAuditTrail(path string) *auditTrail {
+	return &auditTrail{
+		path: path,
+	}
+}
+
+func (a *auditTrail) record(entry AuditEntry) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if a.path == "" {
+		a.entries = append(a.entries, entry)
+		if len(a.entries) > maxAuditEntriesInMemory {
+			a.entries = a.entries[len(a.entries) - maxAuditEntriesInMemory:]
+		}
+
+		return nil
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(a.path, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// query returns the entries matching filter, newest first.
+func (a *auditTrail) query(filter AuditFilter) ([]AuditEntry, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	entries := a.entries
+	if a.path != "" {
+		var err error
+		entries, err = a.read()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	matches := []AuditEntry{}
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if (filter.Inverter != "" && entry.Inverter != filter.Inverter) || (filter.Caller != "" && entry.Caller != filter.Caller) || entry.Time.Before(filter.Since) {
+			continue
+		}
+
+		matches = append(matches, entry)
+		if filter.Limit > 0 && len(matches) >= filter.Limit {
+			break
+		}
+	}
+
+	return matches, nil
+}
+
+func (a *auditTrail) read() ([]AuditEntry, error) {
+	file, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return []AuditEntry{}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := AuditEntry{}
+
+		// A line cut off by a crash should not hide the rest of the trail
+		if json.Unmarshal(scanner.Bytes(), &entry) != nil {
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
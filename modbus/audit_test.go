@@ -0,0 +1,183 @@
+package modbus
+
+import (
+	"os"
+	"time"
+	"testing"
+	"path/filepath"
+
+	"github.com/simonvetter/modbus"
+)
+
+func TestAuditTrailQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	start := time.Now()
+
+	trail := newAuditTrail(path)
+	entries := []AuditEntry{
+		{Time: start.Add(-time.Hour), Inverter: "inverter1", Register: "a", Caller: "control"},
+		{Time: start, Inverter: "inverter2", Register: "b", Caller: "control"},
+		{Time: start.Add(time.Minute), Inverter: "inverter1", Register: "c", Caller: "proxy"},
+	}
+
+	for _, entry := range entries {
+		err := trail.record(entry)
+		if err != nil {
+			t.Fatalf("Failed to record entry: %s", err)
+		}
+	}
+
+	// A line cut off by a crash is skipped
+	file, err := os.OpenFile(path, os.O_APPEND | os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open audit file: %s", err)
+	}
+	file.WriteString("{\"time\":")
+	file.Close()
+
+	tests := []struct {
+		name string
+		filter AuditFilter
+		expected []string
+	}{
+		{name: "all", filter: AuditFilter{}, expected: []string{"c", "b", "a"}},
+		{name: "inverter", filter: AuditFilter{Inverter: "inverter1"}, expected: []string{"c", "a"}},
+		{name: "caller", filter: AuditFilter{Caller: "control"}, expected: []string{"b", "a"}},
+		{name: "since", filter: AuditFilter{Since: start}, expected: []string{"c", "b"}},
+		{name: "limit", filter: AuditFilter{Limit: 1}, expected: []string{"c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A new trail reads the entries written before a restart
+			matches, err := newAuditTrail(path).query(test.filter)
+			if err != nil {
+				t.Fatalf("Failed to query audit trail: %s", err)
+			}
+
+			if len(matches) != len(test.expected) {
+				t.Fatalf("Expected %d entries, got %+v", len(test.expected), matches)
+			}
+
+			for i, register := range test.expected {
+				if matches[i].Register != register {
+					t.Fatalf("Expected register %s at %d, got %s", register, i, matches[i].Register)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteVerification(t *testing.T) {
+	writeRetryDelay = 0
+
+	tests := []struct {
+		name string
+		ignoreWrites int
+		attempts int
+		verified bool
+	}{
+		{name: "accepted", ignoreWrites: 0, attempts: 1, verified: true},
+		{name: "retried", ignoreWrites: 2, attempts: 3, verified: true},
+		{name: "mismatch", ignoreWrites: 10, attempts: 3, verified: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeClient()
+			m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1, Luna2000: true})
+			registers := m.profiles[ProfileLuna2000].Registers
+			client.set(1, registers["forcible_charge_power_battery_1"].Address, 0, 2500)
+			client.set(1, registers["forcible_charge_discharge_battery_1"].Address, MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE)
+			client.ignoreWrites = test.ignoreWrites
+
+			err := m.ChangeBatteryForceCharge(testOrigin, "inverter1", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP, 0, ForceChargeLimit{})
+			if test.verified && err != nil {
+				t.Fatalf("Failed to change force charge: %s", err)
+			}
+
+			if !test.verified && err == nil {
+				t.Fatalf("Expected an error when the register does not read back")
+			}
+
+			entries, err := m.GetAuditEntries(AuditFilter{Inverter: "inverter1"})
+			if err != nil {
+				t.Fatalf("Failed to query audit trail: %s", err)
+			}
+
+			// A failed write stops the sequence, so the mode is only written when the powers are verified
+			entry := entries[0]
+			if !test.verified {
+				if len(entries) != 1 || entry.Verified || entry.Error == "" || entry.Attempts != test.attempts {
+					t.Fatalf("Expected a single failed entry after %d attempts, got %+v", test.attempts, entries)
+				}
+
+				return
+			}
+
+			if len(entries) != 3 || entry.Register != "forcible_charge_discharge_battery_1" {
+				t.Fatalf("Expected the mode to be the last of 3 entries, got %+v", entries)
+			}
+
+			if entries[2].Attempts != test.attempts || !entry.Verified {
+				t.Fatalf("Expected %d attempts and a verified write, got %+v", test.attempts, entries)
+			}
+
+			if *entry.OldValue != 2 || *entry.NewValue != 0 {
+				t.Fatalf("Expected old value 2 and new value 0, got %v and %v", *entry.OldValue, *entry.NewValue)
+			}
+
+			if entry.Caller != testOrigin.Caller || entry.Reason != testOrigin.Reason {
+				t.Fatalf("Expected the origin to be recorded, got %s %s", entry.Caller, entry.Reason)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	client := newFakeClient()
+	m, p := newTestProxy(t, client, ProxyConfig{WriteableRegisters: []string{"luna2000.forcible_charge_power_battery_1"}})
+	m.SetDryRun(true)
+
+	err := m.ChangeBatteryForceCharge(testOrigin, "inverter2", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE, 3000, testLimit)
+	if err != nil {
+		t.Fatalf("Failed to change force charge: %s", err)
+	}
+
+	address := m.profiles[ProfileLuna2000].Registers["forcible_charge_power_battery_1"].Address
+	_, err = p.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 2, Addr: address, Quantity: 2, IsWrite: true, Args: []uint16{0, 2500}})
+	if err != nil {
+		t.Fatalf("Expected the proxy write to be acknowledged, got %s", err)
+	}
+
+	if len(client.writes) != 0 || client.reads != 0 {
+		t.Fatalf("Expected no requests in dry-run mode, got %d writes and %d reads", len(client.writes), client.reads)
+	}
+
+	entries, err := m.GetAuditEntries(AuditFilter{Inverter: "inverter2"})
+	if err != nil {
+		t.Fatalf("Failed to query audit trail: %s", err)
+	}
+
+	if len(entries) != 5 {
+		t.Fatalf("Expected 5 recorded writes, got %+v", entries)
+	}
+
+	for _, entry := range entries {
+		if !entry.DryRun || entry.Verified {
+			t.Fatalf("Expected a dry-run entry, got %+v", entry)
+		}
+	}
+
+	value, err := m.metrics.GetMetricValueAverage("modbus", "dry_run_command", map[string]string{"inverter": "inverter2", "register": "forcible_discharge_power_battery_1", "caller": "test"}, 1)
+	if err != nil || value != 3 {
+		t.Fatalf("Expected the intended discharge power of 3 kW, got %f (%v)", value, err)
+	}
+
+	m.SetDryRun(false)
+
+	err = m.ChangeBatteryForceCharge(testOrigin, "inverter2", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP, 0, ForceChargeLimit{})
+	if err != nil || len(client.writes) == 0 {
+		t.Fatalf("Expected writes after disabling dry-run mode, got %d writes (%v)", len(client.writes), err)
+	}
+}
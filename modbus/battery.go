@@ -0,0 +1,262 @@
+package modbus
+
+import (
+	"fmt"
+	"time"
+	"sort"
+)
+
+// WorkingMode is the working mode of the LUNA2000 energy storage system (47086).
+type WorkingMode uint16
+
+const (
+	WorkingModeAdaptive WorkingMode = iota
+	WorkingModeFixedChargeDischarge
+	WorkingModeMaximiseSelfConsumption
+	WorkingModeTimeOfUseLG
+	WorkingModeFullyFedToGrid
+	WorkingModeTimeOfUseLuna2000
+)
+
+const (
+	// touPeriodsAddress is the start of the LUNA2000 time of use table: the amount of periods followed by
+	// 3 registers per period. The table is read and written at once so it is not part of the profile.
+	touPeriodsAddress uint16 = 47255
+	touMaxPeriods = 14
+	touPeriodsQuantity = 1 + 3 * touMaxPeriods
+	minutesPerDay = 24 * 60
+)
+
+var ErrInvalidSetting = fmt.Errorf("Invalid setting")
+
+// TOUPeriod is a period of the time of use working mode. Start and End are minutes since midnight in the
+// time zone of the inverter.
+type TOUPeriod struct {
+	Start uint16 `json:"start"`
+	End uint16 `json:"end"`
+	Discharge bool `json:"discharge"`
+	Days []time.Weekday `json:"days"`
+}
+
+// getBatteryInverter returns the config of an inverter with a luna2000 battery.
+func (m *Modbus) getBatteryInverter(inverter string) (Inverter, error) {
+	inverterConfig, err := m.getInverterConfig(inverter)
+	if err != nil {
+		return Inverter{}, err
+	}
+
+	if !inverterConfig.hasProfile(ProfileLuna2000) {
+		return Inverter{}, fmt.Errorf("Inverter %s does not have a luna2000 battery connected", inverter)
+	}
+
+	return inverterConfig, nil
+}
+
+// GetBatteryInverters returns the names of the inverters with a luna2000 battery.
+func (m *Modbus) GetBatteryInverters() []string {
+	inverters := []string{}
+	for _, connection := range m.connections {
+		for _, inverter := range connection.config.Inverters {
+			if inverter.hasProfile(ProfileLuna2000) {
+				inverters = append(inverters, inverter.Name)
+			}
+		}
+	}
+	sort.Strings(inverters)
+
+	return inverters
+}
+
+// readBatteryRegister returns the value of a luna2000 register of the inverter with the gain applied.
+func (m *Modbus) readBatteryRegister(inverter string, key string) (float64, error) {
+	inverterConfig, err := m.getBatteryInverter(inverter)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.readRegister(inverterConfig, ProfileLuna2000, key)
+}
+
+// writeBatteryRegister writes a luna2000 register of the inverter with verification and audit.
+func (m *Modbus) writeBatteryRegister(origin WriteOrigin, inverter string, key string, value float64) error {
+	inverterConfig, err := m.getBatteryInverter(inverter)
+	if err != nil {
+		return err
+	}
+
+	return m.writeRegisters(origin, inverterConfig, ProfileLuna2000, []registerWrite{{key: key, value: value}})
+}
+
+// GetWorkingMode returns the working mode of the battery of the inverter.
+func (m *Modbus) GetWorkingMode(inverter string) (WorkingMode, error) {
+	value, err := m.readBatteryRegister(inverter, "working_mode")
+	return WorkingMode(value), err
+}
+
+// SetWorkingMode changes the working mode of the battery of the inverter.
+func (m *Modbus) SetWorkingMode(origin WriteOrigin, inverter string, mode WorkingMode) error {
+	if _, ok := m.profiles[ProfileLuna2000].Registers["working_mode"].States[uint32(mode)]; !ok {
+		return fmt.Errorf("%w: unknown working mode %d", ErrInvalidSetting, mode)
+	}
+
+	return m.writeBatteryRegister(origin, inverter, "working_mode", float64(mode))
+}
+
+// WorkingModeLabel returns the label of a working mode from the luna2000 profile.
+func (m *Modbus) WorkingModeLabel(mode WorkingMode) string {
+	register := m.profiles[ProfileLuna2000].Registers["working_mode"]
+	return stateText(register.activeStates(uint32(mode)))
+}
+
+// GetGridCharge returns whether the battery of the inverter may charge from the grid.
+func (m *Modbus) GetGridCharge(inverter string) (bool, error) {
+	value, err := m.readBatteryRegister(inverter, "charge_from_grid")
+	return value != 0, err
+}
+
+// SetGridCharge allows or forbids the battery of the inverter to charge from the grid.
+func (m *Modbus) SetGridCharge(origin WriteOrigin, inverter string, enabled bool) error {
+	value := 0.0
+	if enabled {
+		value = 1
+	}
+
+	return m.writeBatteryRegister(origin, inverter, "charge_from_grid", value)
+}
+
+// GetTOUPeriods returns the periods of the time of use working mode of the inverter.
+func (m *Modbus) GetTOUPeriods(inverter string) ([]TOUPeriod, error) {
+	inverterConfig, err := m.getBatteryInverter(inverter)
+	if err != nil {
+		return nil, err
+	}
+
+	connection, err := m.getConnection(inverterConfig.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	words, _, err := connection.readRegisters(priorityControl, inverterConfig.UnitId, touPeriodsAddress, touPeriodsQuantity)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTOUPeriods(words)
+}
+
+// SetTOUPeriods replaces the periods of the time of use working mode of the inverter. The periods take
+// effect once the working mode is time of use.
+func (m *Modbus) SetTOUPeriods(origin WriteOrigin, inverter string, periods []TOUPeriod) error {
+	words, err := encodeTOUPeriods(periods)
+	if err != nil {
+		return err
+	}
+
+	inverterConfig, err := m.getBatteryInverter(inverter)
+	if err != nil {
+		return err
+	}
+
+	return m.writeRawRegisters(origin, inverterConfig, "time_of_use_periods", touPeriodsAddress, words)
+}
+
+// encodeTOUPeriods returns the time of use table for periods. Each period takes its start, its end and
+// a register with the discharge flag in the high byte and a bit per day, starting at Sunday, in the low byte.
+func encodeTOUPeriods(periods []TOUPeriod) ([]uint16, error) {
+	err := validateTOUPeriods(periods)
+	if err != nil {
+		return nil, err
+	}
+
+	words := make([]uint16, touPeriodsQuantity)
+	words[0] = uint16(len(periods))
+
+	for i, period := range periods {
+		var flags uint16
+		if period.Discharge {
+			flags = 1 << 8
+		}
+
+		for _, day := range period.Days {
+			flags |= 1 << uint16(day)
+		}
+
+		words[1 + i * 3] = period.Start
+		words[2 + i * 3] = period.End
+		words[3 + i * 3] = flags
+	}
+
+	return words, nil
+}
+
+func decodeTOUPeriods(words []uint16) ([]TOUPeriod, error) {
+	if len(words) != touPeriodsQuantity || words[0] > touMaxPeriods {
+		return nil, fmt.Errorf("Invalid time of use table %v", words)
+	}
+
+	periods := []TOUPeriod{}
+	for i := 0; i < int(words[0]); i++ {
+		flags := words[3 + i * 3]
+
+		period := TOUPeriod{
+			Start: words[1 + i * 3],
+			End: words[2 + i * 3],
+			Discharge: flags >> 8 != 0,
+			Days: []time.Weekday{},
+		}
+
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if flags & (1 << uint16(day)) != 0 {
+				period.Days = append(period.Days, day)
+			}
+		}
+
+		periods = append(periods, period)
+	}
+
+	return periods, nil
+}
+
+// validateTOUPeriods checks the periods the inverter would refuse: more than 14 periods, periods outside
+// a day, without days or overlapping on a day.
+func validateTOUPeriods(periods []TOUPeriod) error {
+	if len(periods) > touMaxPeriods {
+		return fmt.Errorf("%w: at most %d time of use periods are supported, got %d", ErrInvalidSetting, touMaxPeriods, len(periods))
+	}
+
+	for i, period := range periods {
+		if period.Start >= period.End || period.End > minutesPerDay {
+			return fmt.Errorf("%w: period %d from minute %d to %d is not within a day", ErrInvalidSetting, i + 1, period.Start, period.End)
+		}
+
+		if len(period.Days) == 0 {
+			return fmt.Errorf("%w: period %d has no days", ErrInvalidSetting, i + 1)
+		}
+
+		for _, day := range period.Days {
+			if day < time.Sunday || day > time.Saturday {
+				return fmt.Errorf("%w: period %d has invalid day %d", ErrInvalidSetting, i + 1, day)
+			}
+		}
+
+		for j, other := range periods[:i] {
+			if period.Start < other.End && other.Start < period.End && sharesDay(period.Days, other.Days) {
+				return fmt.Errorf("%w: period %d overlaps period %d", ErrInvalidSetting, i + 1, j + 1)
+			}
+		}
+	}
+
+	return nil
+}
+
+func sharesDay(a []time.Weekday, b []time.Weekday) bool {
+	for _, day := range a {
+		for _, other := range b {
+			if day == other {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,118 @@
+package modbus
+
+import (
+	"time"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestTOUPeriods(t *testing.T) {
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1}, Inverter{Name: "inverter2", UnitId: 2, Luna2000: true})
+
+	periods := []TOUPeriod{
+		{Start: 60, End: 360, Days: []time.Weekday{time.Sunday, time.Saturday}},
+		{Start: 1020, End: 1260, Discharge: true, Days: []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}},
+	}
+
+	err := m.SetTOUPeriods(testOrigin, "inverter2", periods)
+	if err != nil {
+		t.Fatalf("Failed to set periods: %s", err)
+	}
+
+	expected := []uint16{2, 60, 360, 0x0041, 1020, 1260, 0x013e}
+	for i, value := range expected {
+		if client.get(2, touPeriodsAddress + uint16(i)) != value {
+			t.Fatalf("Expected %d at %d, got %d", value, touPeriodsAddress + uint16(i), client.get(2, touPeriodsAddress + uint16(i)))
+		}
+	}
+
+	if len(client.writes) != 1 || len(client.writes[0].values) != touPeriodsQuantity {
+		t.Fatalf("Expected the table to be written at once, got %+v", client.writes)
+	}
+
+	read, err := m.GetTOUPeriods("inverter2")
+	if err != nil {
+		t.Fatalf("Failed to get periods: %s", err)
+	}
+
+	if !reflect.DeepEqual(read, periods) {
+		t.Fatalf("Expected %+v, got %+v", periods, read)
+	}
+
+	_, err = m.GetTOUPeriods("inverter1")
+	if err == nil {
+		t.Fatalf("Expected an error for an inverter without battery")
+	}
+}
+
+func TestTOUPeriodsValidation(t *testing.T) {
+	weekend := []time.Weekday{time.Saturday, time.Sunday}
+
+	tests := []struct {
+		name string
+		periods []TOUPeriod
+	}{
+		{name: "end_before_start", periods: []TOUPeriod{{Start: 120, End: 60, Days: weekend}}},
+		{name: "past_midnight", periods: []TOUPeriod{{Start: 1380, End: 1500, Days: weekend}}},
+		{name: "no_days", periods: []TOUPeriod{{Start: 60, End: 120}}},
+		{name: "invalid_day", periods: []TOUPeriod{{Start: 60, End: 120, Days: []time.Weekday{7}}}},
+		{name: "overlap", periods: []TOUPeriod{{Start: 60, End: 120, Days: weekend}, {Start: 90, End: 180, Days: []time.Weekday{time.Sunday}}}},
+		{name: "too_many", periods: make([]TOUPeriod, touMaxPeriods + 1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := encodeTOUPeriods(test.periods)
+			if !errors.Is(err, ErrInvalidSetting) {
+				t.Fatalf("Expected an invalid setting, got %v", err)
+			}
+		})
+	}
+
+	// Overlapping times on different days are fine
+	_, err := encodeTOUPeriods([]TOUPeriod{{Start: 60, End: 120, Days: []time.Weekday{time.Monday}}, {Start: 60, End: 120, Days: weekend}})
+	if err != nil {
+		t.Fatalf("Expected periods on different days to be accepted, got %s", err)
+	}
+}
+
+func TestWorkingModeAndGridCharge(t *testing.T) {
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1, Luna2000: true})
+	registers := m.profiles[ProfileLuna2000].Registers
+
+	err := m.SetWorkingMode(testOrigin, "inverter1", WorkingModeTimeOfUseLuna2000)
+	if err != nil {
+		t.Fatalf("Failed to set working mode: %s", err)
+	}
+
+	err = m.SetGridCharge(testOrigin, "inverter1", true)
+	if err != nil {
+		t.Fatalf("Failed to set grid charge: %s", err)
+	}
+
+	if client.get(1, registers["working_mode"].Address) != 5 || client.get(1, registers["charge_from_grid"].Address) != 1 {
+		t.Fatalf("Expected working mode 5 and grid charge enabled")
+	}
+
+	mode, err := m.GetWorkingMode("inverter1")
+	if err != nil || mode != WorkingModeTimeOfUseLuna2000 {
+		t.Fatalf("Expected the time of use mode, got %d (%v)", mode, err)
+	}
+
+	if m.WorkingModeLabel(mode) != "Time of use (LUNA2000)" {
+		t.Fatalf("Unexpected label %q", m.WorkingModeLabel(mode))
+	}
+
+	enabled, err := m.GetGridCharge("inverter1")
+	if err != nil || !enabled {
+		t.Fatalf("Expected grid charge to be enabled, got %v (%v)", enabled, err)
+	}
+
+	err = m.SetWorkingMode(testOrigin, "inverter1", WorkingMode(42))
+	if !errors.Is(err, ErrInvalidSetting) {
+		t.Fatalf("Expected an unknown working mode to be refused, got %v", err)
+	}
+}
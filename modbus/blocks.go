@@ -0,0 +1,75 @@
+package modbus
+
+import (
+	"sort"
+)
+
+// maxReadQuantity is the maximum amount of registers a single modbus read may request.
+const maxReadQuantity = 125
+
+type blockRegister struct {
+	key string
+	register Register
+}
+
+// registerBlock is a contiguous address range read with a single request.
+type registerBlock struct {
+	address uint16
+	quantity uint16
+	registers []blockRegister
+}
+
+// buildRegisterBlocks groups registers by address into blocks of at most maxQuantity registers. Registers
+// are only added to a block when the amount of unused registers in between does not exceed maxGap, as
+// some devices refuse reads covering addresses they do not define.
+func buildRegisterBlocks(registers map[string]Register, maxGap uint16, maxQuantity uint16) []registerBlock {
+	if maxQuantity == 0 || maxQuantity > maxReadQuantity {
+		maxQuantity = maxReadQuantity
+	}
+
+	sorted := []blockRegister{}
+	for key, register := range registers {
+		sorted = append(sorted, blockRegister{key: key, register: register})
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].register.Address == sorted[j].register.Address {
+			return sorted[i].key < sorted[j].key
+		}
+
+		return sorted[i].register.Address < sorted[j].register.Address
+	})
+
+	blocks := []registerBlock{}
+	for _, entry := range sorted {
+		register := entry.register
+
+		if len(blocks) > 0 {
+			block := &blocks[len(blocks) - 1]
+			end := uint32(block.address) + uint32(block.quantity)
+			registerEnd := uint32(register.Address) + uint32(register.Quantity)
+
+			if uint32(register.Address) <= end + uint32(maxGap) && registerEnd - uint32(block.address) <= uint32(maxQuantity) {
+				if registerEnd > end {
+					block.quantity = uint16(registerEnd - uint32(block.address))
+				}
+				block.registers = append(block.registers, entry)
+				continue
+			}
+		}
+
+		blocks = append(blocks, registerBlock{
+			address: register.Address,
+			quantity: register.Quantity,
+			registers: []blockRegister{entry},
+		})
+	}
+
+	return blocks
+}
+
+// words returns the words of register out of the words read for the block.
+func (b registerBlock) words(register Register, values []uint16) []uint16 {
+	offset := register.Address - b.address
+	return values[offset:offset + register.Quantity]
+}
@@ -0,0 +1,61 @@
+package modbus
+
+import (
+	"testing"
+)
+
+func TestBuildRegisterBlocks(t *testing.T) {
+	registers := map[string]Register{
+		"a": {Address: 100, Quantity: 1, Type: RegisterTypeUint16},
+		"b": {Address: 101, Quantity: 2, Type: RegisterTypeInt32},
+		"c": {Address: 105, Quantity: 1, Type: RegisterTypeUint16},
+		"d": {Address: 200, Quantity: 2, Type: RegisterTypeUint32},
+		"e": {Address: 320, Quantity: 2, Type: RegisterTypeUint32},
+	}
+
+	tests := []struct {
+		name string
+		maxGap uint16
+		maxQuantity uint16
+		expected [][2]uint16
+	}{
+		{name: "no_gap", maxGap: 0, expected: [][2]uint16{{100, 3}, {105, 1}, {200, 2}, {320, 2}}},
+		{name: "gap", maxGap: 2, expected: [][2]uint16{{100, 6}, {200, 2}, {320, 2}}},
+		{name: "large_gap", maxGap: 200, expected: [][2]uint16{{100, 102}, {320, 2}}},
+		{name: "quantity", maxGap: 200, maxQuantity: 3, expected: [][2]uint16{{100, 3}, {105, 1}, {200, 2}, {320, 2}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			blocks := buildRegisterBlocks(registers, test.maxGap, test.maxQuantity)
+			if len(blocks) != len(test.expected) {
+				t.Fatalf("Expected %d blocks, got %d: %+v", len(test.expected), len(blocks), blocks)
+			}
+
+			for i, block := range blocks {
+				if block.address != test.expected[i][0] || block.quantity != test.expected[i][1] {
+					t.Fatalf("Expected block %d to be %v, got %d+%d", i, test.expected[i], block.address, block.quantity)
+				}
+
+				if block.quantity > maxReadQuantity {
+					t.Fatalf("Block %d exceeds the read limit", i)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateMetricsRegistersBlockRead(t *testing.T) {
+	client := newFakeClient()
+	m := newTestModbus(client)
+	profile := m.profiles[ProfilePowerMeter]
+
+	requests, err := m.updateMetricsRegisters(m.connections["test"], Inverter{Name: "inverter1", UnitId: 1}, profile)
+	if err != nil {
+		t.Fatalf("Failed to update metrics: %s", err)
+	}
+
+	if requests != 1 || client.reads != 1 {
+		t.Fatalf("Expected the power meter to be read in 1 request, got %d", client.reads)
+	}
+}
@@ -0,0 +1,67 @@
+package modbus
+
+import (
+	"sync"
+	"time"
+)
+
+type cachedRegister struct {
+	value uint16
+	readAt time.Time
+}
+
+// registerCache keeps the last value read of every holding register per unit id, so reads of other
+// tools can be answered without using the bus.
+type registerCache struct {
+	lock sync.Mutex
+	units map[uint8]map[uint16]cachedRegister
+}
+
+func newRegisterCache() *registerCache {
+	return &registerCache{
+		units: make(map[uint8]map[uint16]cachedRegister),
+	}
+}
+
+func (c *registerCache) store(unitId uint8, address uint16, values []uint16, readAt time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	registers, ok := c.units[unitId]
+	if !ok {
+		registers = make(map[uint16]cachedRegister)
+		c.units[unitId] = registers
+	}
+
+	for i, value := range values {
+		registers[address + uint16(i)] = cachedRegister{value: value, readAt: readAt}
+	}
+}
+
+// load returns the cached values of quantity registers starting at address. It only succeeds when every
+// register was read after notBefore.
+func (c *registerCache) load(unitId uint8, address uint16, quantity uint16, notBefore time.Time) ([]uint16, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	values := make([]uint16, quantity)
+	for i := range values {
+		register, ok := c.units[unitId][address + uint16(i)]
+		if !ok || register.readAt.Before(notBefore) {
+			return nil, false
+		}
+
+		values[i] = register.value
+	}
+
+	return values, true
+}
+
+func (c *registerCache) invalidate(unitId uint8, address uint16, quantity uint16) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := uint16(0); i < quantity; i++ {
+		delete(c.units[unitId], address + i)
+	}
+}
@@ -0,0 +1,315 @@
+package modbus
+
+import (
+	"io"
+	"fmt"
+	"flag"
+	"time"
+	"strings"
+
+	"gijs.eu/vonkje/metrics"
+
+	"github.com/sirupsen/logrus"
+	"github.com/simonvetter/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const callerCommand = "cli"
+
+const commandUsage = "Usage: vonkje modbus read|write|scan --connection <name> --unit <id> [options]"
+
+// scanBlockQuantity is the amount of registers a scan tries to read at once before reading them one by one.
+const scanBlockQuantity = 16
+
+var ErrWriteNotConfirmed = fmt.Errorf("Refusing to write without --confirm")
+
+type commandOptions struct {
+	connection string
+	unitId uint
+	address uint
+	end uint
+	registerType string
+	quantity uint
+	gain float64
+	value float64
+	confirm bool
+	dryRun bool
+}
+
+// RunCommand runs the read, write or scan command in args on a connection from the config and prints the
+// result to output.
+func RunCommand(config Config, args []string, output io.Writer, logger *logrus.Logger) error {
+	if len(args) == 0 {
+		return fmt.Errorf(commandUsage)
+	}
+
+	command := args[0]
+	options, err := parseCommandOptions(command, args[1:], output)
+	if err != nil {
+		return err
+	}
+	options.dryRun = options.dryRun || config.DryRun
+
+	var connectionConfig *ConnectionConfig
+	for i := range config.Connections {
+		if config.Connections[i].Name == options.connection {
+			connectionConfig = &config.Connections[i]
+		}
+	}
+
+	if connectionConfig == nil {
+		return fmt.Errorf("Connection %q not found in the config", options.connection)
+	}
+
+	clientConfig, err := connectionConfig.clientConfiguration()
+	if err != nil {
+		return err
+	}
+
+	client, err := modbus.NewClient(clientConfig)
+	if err != nil {
+		return err
+	}
+
+	err = client.SetEncoding(modbus.BIG_ENDIAN, modbus.HIGH_WORD_FIRST)
+	if err != nil {
+		return err
+	}
+
+	// Metrics of a command are not served, the connection only needs somewhere to put them
+	store, err := metrics.NewStore(metrics.Config{}, prometheus.NewRegistry())
+	if err != nil {
+		return err
+	}
+
+	// Fail right away instead of retrying like the poller does
+	connection := newConnection(*connectionConfig, client, reconnectConfig{failuresBeforeDown: 1, minBackoff: time.Hour}, store, logger)
+	defer connection.close()
+
+	// Writes go through the same verified and audited path as those of a running Vonkje
+	m := &Modbus{
+		config: config,
+		logger: logger,
+		audit: newAuditTrail(config.AuditFile),
+		metrics: store,
+	}
+	m.dryRun.Store(options.dryRun)
+
+	return options.run(command, m, connection, output)
+}
+
+func parseCommandOptions(command string, args []string, output io.Writer) (commandOptions, error) {
+	options := commandOptions{}
+
+	flags := flag.NewFlagSet("vonkje modbus " + command, flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&options.connection, "connection", "", "Name of the connection in the config")
+	flags.UintVar(&options.unitId, "unit", 1, "Unit id of the device")
+
+	switch command {
+	case "read", "write":
+		flags.UintVar(&options.address, "address", 0, "Address of the register")
+		flags.StringVar(&options.registerType, "type", "uint16", "Type of the register: " + registerTypeList())
+		flags.UintVar(&options.quantity, "quantity", 0, "Amount of registers, required for strings")
+		flags.Float64Var(&options.gain, "gain", 1, "The value is divided by the gain when reading and multiplied when writing")
+	case "scan":
+		flags.UintVar(&options.address, "start", 0, "First address to scan")
+		flags.UintVar(&options.end, "end", 0, "Last address to scan")
+	default:
+		return options, fmt.Errorf("Unknown command %q. %s", command, commandUsage)
+	}
+
+	if command == "write" {
+		flags.Float64Var(&options.value, "value", 0, "Value to write, before applying the gain")
+		flags.BoolVar(&options.confirm, "confirm", false, "Actually write, without it the words which would be written are printed")
+		flags.BoolVar(&options.dryRun, "dry-run", false, "Do not write, also enabled by dry-run in the config")
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return options, err
+	}
+
+	if options.connection == "" {
+		return options, fmt.Errorf("--connection is required")
+	}
+
+	if options.unitId > 255 || options.address > 0xffff || options.end > 0xffff {
+		return options, fmt.Errorf("Unit id or address out of range")
+	}
+
+	if command == "scan" && options.end < options.address {
+		return options, fmt.Errorf("--end must not be before --start")
+	}
+
+	return options, nil
+}
+
+// register returns the register described by the options.
+func (o commandOptions) register() (Register, error) {
+	registerType, err := parseRegisterType(o.registerType)
+	if err != nil {
+		return Register{}, err
+	}
+
+	quantity := uint16(o.quantity)
+	if quantity == 0 {
+		quantity = registerTypeQuantities[registerType]
+	}
+
+	if !validRegisterQuantity(registerType, quantity) || o.gain <= 0 {
+		return Register{}, fmt.Errorf("Invalid quantity %d or gain %g for type %s", quantity, o.gain, registerType)
+	}
+
+	return Register{
+		Name: fmt.Sprint(o.address),
+		Address: uint16(o.address),
+		Gain: o.gain,
+		Quantity: quantity,
+		Type: registerType,
+	}, nil
+}
+
+func (o commandOptions) run(command string, m *Modbus, connection *Connection, output io.Writer) error {
+	switch command {
+	case "read":
+		return o.read(connection, output)
+	case "write":
+		return o.write(m, connection, output)
+	case "scan":
+		return o.scan(connection, output)
+	}
+
+	return fmt.Errorf("Unknown command %q", command)
+}
+
+func (o commandOptions) read(connection *Connection, output io.Writer) error {
+	register, err := o.register()
+	if err != nil {
+		return err
+	}
+
+	words, _, err := connection.readRegisters(priorityPoll, uint8(o.unitId), register.Address, register.Quantity)
+	if err != nil {
+		return err
+	}
+
+	return printRegister(output, register, words)
+}
+
+// inverter returns the inverter of the connection with the unit id of the options, or an unnamed one for a
+// unit which is not in the config.
+func (o commandOptions) inverter(connection *Connection) Inverter {
+	for _, inverter := range connection.config.Inverters {
+		if uint(inverter.UnitId) == o.unitId {
+			return inverter
+		}
+	}
+
+	return Inverter{Name: fmt.Sprintf("%s unit %d", connection.config.Name, o.unitId), UnitId: uint8(o.unitId)}
+}
+
+func (o commandOptions) write(m *Modbus, connection *Connection, output io.Writer) error {
+	register, err := o.register()
+	if err != nil {
+		return err
+	}
+
+	words, err := EncodeRegister(register, o.value * register.Gain)
+	if err != nil {
+		return err
+	}
+
+	if !o.confirm {
+		fmt.Fprintf(output, "Would write %s to address %d of unit %d\n", formatWords(words), register.Address, o.unitId)
+		return ErrWriteNotConfirmed
+	}
+
+	origin := WriteOrigin{Caller: callerCommand, Reason: "vonkje modbus write"}
+	err = m.writeRegister(origin, connection, o.inverter(connection), register.Name, register, words)
+	if err != nil {
+		return err
+	}
+
+	if m.DryRun() {
+		fmt.Fprintf(output, "Dry run, not writing %s to address %d of unit %d\n", formatWords(words), register.Address, o.unitId)
+		return nil
+	}
+
+	fmt.Fprintf(output, "Wrote %s to address %d of unit %d\n", formatWords(words), register.Address, o.unitId)
+
+	words, _, err = connection.readRegisters(priorityPoll, uint8(o.unitId), register.Address, register.Quantity)
+	if err != nil {
+		return err
+	}
+
+	return printRegister(output, register, words)
+}
+
+// scan reads every address in the range and prints the ones the device answers. Blocks are read at once
+// and only read register by register when the device refuses the block.
+func (o commandOptions) scan(connection *Connection, output io.Writer) error {
+	for address := uint32(o.address); address <= uint32(o.end); address += scanBlockQuantity {
+		quantity := uint32(scanBlockQuantity)
+		if address + quantity > uint32(o.end) + 1 {
+			quantity = uint32(o.end) + 1 - address
+		}
+
+		words, _, err := connection.readRegisters(priorityPoll, uint8(o.unitId), uint16(address), uint16(quantity))
+		if err == nil {
+			for i, word := range words {
+				printScanned(output, address + uint32(i), word)
+			}
+
+			continue
+		}
+
+		if !isDeviceError(err) {
+			return err
+		}
+
+		for i := uint32(0); i < quantity; i++ {
+			words, _, err := connection.readRegisters(priorityPoll, uint8(o.unitId), uint16(address + i), 1)
+			if err != nil {
+				if !isDeviceError(err) {
+					return err
+				}
+
+				continue
+			}
+
+			printScanned(output, address + i, words[0])
+		}
+	}
+
+	return nil
+}
+
+func printRegister(output io.Writer, register Register, words []uint16) error {
+	value, text, err := DecodeRegister(register, words)
+	if err != nil {
+		return err
+	}
+
+	if register.Type == RegisterTypeString {
+		fmt.Fprintf(output, "%d %s: %q (%s)\n", register.Address, register.Type, text, formatWords(words))
+		return nil
+	}
+
+	fmt.Fprintf(output, "%d %s: %g (%s)\n", register.Address, register.Type, value / register.Gain, formatWords(words))
+
+	return nil
+}
+
+func printScanned(output io.Writer, address uint32, word uint16) {
+	fmt.Fprintf(output, "%d: %d (0x%04x)\n", address, word, word)
+}
+
+func formatWords(words []uint16) string {
+	formatted := []string{}
+	for _, word := range words {
+		formatted = append(formatted, fmt.Sprintf("0x%04x", word))
+	}
+
+	return strings.Join(formatted, " ")
+}
@@ -0,0 +1,126 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func runTestCommand(t *testing.T, client *fakeClient, audit *auditTrail, args ...string) (string, error) {
+	options, err := parseCommandOptions(args[0], append([]string{"--connection", "test"}, args[1:]...), &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("Failed to parse %v: %s", args, err)
+	}
+
+	store := newTestStore()
+	m := &Modbus{logger: logrus.New(), audit: audit, metrics: store}
+	m.dryRun.Store(options.dryRun)
+
+	output := &bytes.Buffer{}
+	connection := newConnection(ConnectionConfig{Name: "test", Inverters: []Inverter{{Name: "inverter1", UnitId: 1}}}, client, reconnectConfig{}, store, logrus.New())
+	err = options.run(args[0], m, connection, output)
+
+	return output.String(), err
+}
+
+func TestCommandRead(t *testing.T) {
+	client := newFakeClient()
+	client.set(1, 37004, 815)
+	client.set(1, 32080, 0xffff, 0xfc18)
+	client.set(2, 30000, 0x5355, 0x4e32, 0x3030, 0x3000)
+
+	tests := []struct {
+		name string
+		args []string
+		expected string
+	}{
+		{name: "uint16", args: []string{"read", "--address", "37004", "--gain", "10"}, expected: "37004 uint16: 81.5 (0x032f)"},
+		{name: "int32", args: []string{"read", "--address", "32080", "--type", "int32"}, expected: "32080 int32: -1000 (0xffff 0xfc18)"},
+		{name: "string", args: []string{"read", "--unit", "2", "--address", "30000", "--type", "string", "--quantity", "4"}, expected: `30000 string: "SUN2000" (0x5355 0x4e32 0x3030 0x3000)`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output, err := runTestCommand(t, client, newAuditTrail(""), test.args...)
+			if err != nil {
+				t.Fatalf("Failed to read: %s", err)
+			}
+
+			if strings.TrimSpace(output) != test.expected {
+				t.Fatalf("Expected %q, got %q", test.expected, output)
+			}
+		})
+	}
+}
+
+func TestCommandWrite(t *testing.T) {
+	client := newFakeClient()
+	audit := newAuditTrail("")
+
+	_, err := runTestCommand(t, client, audit, "write", "--unit", "2", "--address", "47247", "--type", "uint32", "--value", "2.5", "--gain", "1000")
+	if !errors.Is(err, ErrWriteNotConfirmed) || len(client.writes) != 0 {
+		t.Fatalf("Expected the write to be refused without confirmation, got %v and %d writes", err, len(client.writes))
+	}
+
+	output, err := runTestCommand(t, client, audit, "write", "--unit", "2", "--address", "47247", "--type", "uint32", "--value", "2.5", "--gain", "1000", "--confirm")
+	if err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+
+	if client.get(2, 47248) != 2500 || !strings.Contains(output, "47247 uint32: 2.5") {
+		t.Fatalf("Expected 2500 to be written and read back, got %q", output)
+	}
+
+	client.writes = nil
+	output, err = runTestCommand(t, client, audit, "write", "--unit", "1", "--address", "47247", "--type", "uint32", "--value", "3", "--gain", "1000", "--confirm", "--dry-run")
+	if err != nil || len(client.writes) != 0 || !strings.Contains(output, "Dry run") {
+		t.Fatalf("Expected no write in dry-run mode, got %q and %d writes (%v)", output, len(client.writes), err)
+	}
+
+	// Both writes are audited, newest first, and the unit of a configured inverter is recorded by its name
+	entries, err := audit.query(AuditFilter{Caller: callerCommand})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, got %v, %v", entries, err)
+	}
+
+	if entries[0].Inverter != "inverter1" || !entries[0].DryRun || *entries[0].NewValue != 3 {
+		t.Fatalf("Expected the dry run write of inverter1, got %+v", entries[0])
+	}
+
+	if entries[1].Inverter != "test unit 2" || !entries[1].Verified || entries[1].Register != "47247" || *entries[1].NewValue != 2.5 {
+		t.Fatalf("Expected the verified write of unit 2, got %+v", entries[1])
+	}
+}
+
+func TestCommandScan(t *testing.T) {
+	client := newFakeClient()
+	client.set(1, 100, 1, 2, 3)
+	client.illegal = map[uint16]bool{101: true}
+
+	output, err := runTestCommand(t, client, newAuditTrail(""), "scan", "--start", "100", "--end", "102")
+	if err != nil {
+		t.Fatalf("Failed to scan: %s", err)
+	}
+
+	expected := "100: 1 (0x0001)\n102: 3 (0x0003)\n"
+	if output != expected {
+		t.Fatalf("Expected %q, got %q", expected, output)
+	}
+}
+
+func TestParseCommandOptions(t *testing.T) {
+	for _, args := range [][]string{
+		{"read", "--address", "100"},
+		{"scan", "--connection", "test", "--start", "200", "--end", "100"},
+		{"erase", "--connection", "test"},
+		{"read", "--connection", "test", "--address", "70000"},
+	} {
+		_, err := parseCommandOptions(args[0], args[1:], &bytes.Buffer{})
+		if err == nil {
+			t.Fatalf("Expected %v to be rejected", args)
+		}
+	}
+}
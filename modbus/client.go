@@ -0,0 +1,16 @@
+package modbus
+
+import (
+	"github.com/simonvetter/modbus"
+)
+
+// registerClient is the register access used by a connection. It is satisfied by *modbus.ModbusClient
+// and allows the collector and control writes to be tested without an inverter.
+type registerClient interface {
+	Open() error
+	Close() error
+	SetUnitId(id uint8) error
+	ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error)
+	WriteRegister(addr uint16, value uint16) error
+	WriteRegisters(addr uint16, values []uint16) error
+}
@@ -0,0 +1,156 @@
+package modbus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	callerClockSync = "clock-sync"
+
+	defaultClockSyncInterval = time.Hour
+	defaultMaximumClockDrift = 10 * time.Second
+)
+
+type ClockSyncConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	Interval uint `mapstructure:"interval"`
+	MaximumDrift uint `mapstructure:"maximum-drift"`
+	TimeZone string `mapstructure:"time-zone"`
+}
+
+// InverterClock is the clock of an inverter. Drift is positive when the inverter is ahead of Vonkje.
+type InverterClock struct {
+	Time time.Time `json:"time"`
+	TimeZoneOffset int `json:"time_zone_offset"`
+	Drift time.Duration `json:"drift"`
+}
+
+// clockLocation returns the time zone the inverter clocks are set to, the local time zone by default.
+func (m *Modbus) clockLocation() (*time.Location, error) {
+	if m.config.ClockSync.TimeZone == "" {
+		return time.Local, nil
+	}
+
+	location, err := time.LoadLocation(m.config.ClockSync.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("Unknown clock sync time zone %q: %w", m.config.ClockSync.TimeZone, err)
+	}
+
+	return location, nil
+}
+
+// GetClock reads the system time and time zone of the inverter. The system time is in seconds since the
+// epoch, the time zone is the offset of local time from UTC in minutes.
+func (m *Modbus) GetClock(inverter string) (InverterClock, error) {
+	inverterConfig, err := m.getSun2000Inverter(inverter)
+	if err != nil {
+		return InverterClock{}, err
+	}
+
+	offset, err := m.readRegister(inverterConfig, ProfileSun2000, "time_zone")
+	if err != nil {
+		return InverterClock{}, err
+	}
+
+	// Compare against the middle of the request to leave out most of the round trip
+	before := time.Now()
+	seconds, err := m.readRegister(inverterConfig, ProfileSun2000, "system_time")
+	if err != nil {
+		return InverterClock{}, err
+	}
+	now := before.Add(time.Since(before) / 2)
+
+	inverterTime := time.Unix(int64(seconds), 0).In(time.FixedZone("", int(offset) * 60))
+
+	return InverterClock{
+		Time: inverterTime,
+		TimeZoneOffset: int(offset),
+		Drift: inverterTime.Sub(now).Truncate(time.Second),
+	}, nil
+}
+
+// SetClock sets the time zone of the inverter to the current offset of location and its system time to now.
+func (m *Modbus) SetClock(origin WriteOrigin, inverter string, location *time.Location) error {
+	inverterConfig, err := m.getSun2000Inverter(inverter)
+	if err != nil {
+		return err
+	}
+
+	_, offset := time.Now().In(location).Zone()
+
+	err = m.writeRegisters(origin, inverterConfig, ProfileSun2000, []registerWrite{{key: "time_zone", value: float64(offset / 60)}})
+	if err != nil {
+		return err
+	}
+
+	// The time is taken after the time zone write so a slow write does not make it stale
+	return m.writeRegisters(origin, inverterConfig, ProfileSun2000, []registerWrite{{key: "system_time", value: float64(time.Now().Unix())}})
+}
+
+// startClockSync checks the clocks of the inverters every interval and corrects those which drifted or have
+// the wrong time zone, for example after a daylight saving time change.
+func (m *Modbus) startClockSync() {
+	if !m.config.ClockSync.Enabled {
+		return
+	}
+
+	interval := time.Duration(m.config.ClockSync.Interval) * time.Minute
+	if interval == 0 {
+		interval = defaultClockSyncInterval
+	}
+
+	m.logger.WithFields(logrus.Fields{"interval": interval}).Info("Starting inverter clock sync")
+
+	m.syncClocks()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			m.syncClocks()
+		}
+	}
+}
+
+func (m *Modbus) syncClocks() {
+	location, err := m.clockLocation()
+	if err != nil {
+		m.errChannel <- err
+		return
+	}
+
+	maximumDrift := time.Duration(m.config.ClockSync.MaximumDrift) * time.Second
+	if maximumDrift == 0 {
+		maximumDrift = defaultMaximumClockDrift
+	}
+
+	for _, inverter := range m.GetInverters() {
+		clock, err := m.GetClock(inverter)
+		if err != nil {
+			m.errChannel <- err
+			continue
+		}
+
+		m.metrics.SetMetricValue("modbus", "clock_drift", map[string]string{"inverter": inverter}, clock.Drift.Seconds())
+
+		_, offset := time.Now().In(location).Zone()
+		if clock.Drift.Abs() <= maximumDrift && clock.TimeZoneOffset == offset / 60 {
+			continue
+		}
+
+		m.logger.WithFields(logrus.Fields{"inverter": inverter, "drift": clock.Drift, "timeZoneOffset": clock.TimeZoneOffset, "expectedTimeZoneOffset": offset / 60}).Warn("Correcting inverter clock")
+
+		origin := WriteOrigin{Caller: callerClockSync, Reason: fmt.Sprintf("Clock drifted %s with time zone offset %d minutes", clock.Drift, clock.TimeZoneOffset)}
+		err = m.SetClock(origin, inverter, location)
+		if err != nil {
+			m.errChannel <- err
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package modbus
+
+import (
+	"time"
+	"testing"
+)
+
+func TestSyncClocks(t *testing.T) {
+	writeRetryDelay = 0
+
+	location, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Skipf("Time zone database not available: %s", err)
+	}
+	_, offset := time.Now().In(location).Zone()
+
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1}, Inverter{Name: "inverter2", UnitId: 2})
+	m.config.ClockSync = ClockSyncConfig{Enabled: true, MaximumDrift: 30, TimeZone: "Europe/Amsterdam"}
+	registers := m.profiles[ProfileSun2000].Registers
+
+	setClock := func(unitId uint8, clock time.Time, offset int) {
+		seconds := uint32(clock.Unix())
+		client.set(unitId, registers["system_time"].Address, uint16(seconds >> 16), uint16(seconds))
+		client.set(unitId, registers["time_zone"].Address, uint16(int16(offset)))
+	}
+
+	// inverter1 runs 2 minutes behind, inverter2 is within the maximum drift
+	setClock(1, time.Now().Add(-2 * time.Minute), offset / 60)
+	setClock(2, time.Now().Add(10 * time.Second), offset / 60)
+
+	clock, err := m.GetClock("inverter1")
+	if err != nil {
+		t.Fatalf("Failed to get clock: %s", err)
+	}
+
+	if clock.Drift > -119 * time.Second || clock.Drift < -121 * time.Second {
+		t.Fatalf("Expected a drift of -2 minutes, got %s", clock.Drift)
+	}
+
+	m.syncClocks()
+
+	clock, err = m.GetClock("inverter1")
+	if err != nil {
+		t.Fatalf("Failed to get clock: %s", err)
+	}
+
+	if clock.Drift.Abs() > 2 * time.Second {
+		t.Fatalf("Expected the clock to be corrected, got a drift of %s", clock.Drift)
+	}
+
+	for _, write := range client.writes {
+		if write.unitId != 1 {
+			t.Fatalf("Expected only the drifting inverter to be written, got unit id %d", write.unitId)
+		}
+	}
+
+	entries, _ := m.GetAuditEntries(AuditFilter{Caller: callerClockSync})
+	if len(entries) != 2 {
+		t.Fatalf("Expected the time zone and system time writes in the audit trail, got %d", len(entries))
+	}
+
+	// A wrong time zone is corrected even without drift
+	setClock(2, time.Now(), offset / 60 + 60)
+	m.syncClocks()
+
+	if int16(client.get(2, registers["time_zone"].Address)) != int16(offset / 60) {
+		t.Fatalf("Expected time zone offset %d, got %d", offset / 60, int16(client.get(2, registers["time_zone"].Address)))
+	}
+}
+
+func TestClockReadBack(t *testing.T) {
+	register := Register{Name: "system_time", Quantity: 2, Type: RegisterTypeTimestamp, Gain: 1}
+
+	tests := []struct {
+		name string
+		readBack []uint16
+		matches bool
+	}{
+		{name: "equal", readBack: []uint16{0, 1000}, matches: true},
+		{name: "ahead", readBack: []uint16{0, 1002}, matches: true},
+		{name: "behind", readBack: []uint16{0, 999}, matches: false},
+		{name: "too_far_ahead", readBack: []uint16{0, 1060}, matches: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if readBackMatches(register, test.readBack, []uint16{0, 1000}) != test.matches {
+				t.Fatalf("Expected match %t for %v", test.matches, test.readBack)
+			}
+		})
+	}
+
+	// The tolerance follows the type, other registers must read back exactly what was written
+	register.Type = RegisterTypeUint32
+	if readBackMatches(register, []uint16{0, 1002}, []uint16{0, 1000}) {
+		t.Fatalf("Expected a uint32 register which reads back ahead not to match")
+	}
+}
@@ -0,0 +1,270 @@
+package modbus
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"errors"
+
+	"gijs.eu/vonkje/metrics"
+
+	"github.com/sirupsen/logrus"
+	"github.com/simonvetter/modbus"
+)
+
+type ConnectionState uint8
+
+const (
+	ConnectionStateDown ConnectionState = iota
+	ConnectionStateDegraded
+	ConnectionStateConnected
+)
+
+var connectionStateNames = map[ConnectionState]string{
+	ConnectionStateDown: "down",
+	ConnectionStateDegraded: "degraded",
+	ConnectionStateConnected: "connected",
+}
+
+var (
+	ErrConnectionDown = fmt.Errorf("Connection is down")
+)
+
+// deviceErrors are exception responses. The device answered so the link itself is working.
+var deviceErrors = []error{
+	modbus.ErrIllegalFunction,
+	modbus.ErrIllegalDataAddress,
+	modbus.ErrIllegalDataValue,
+	modbus.ErrServerDeviceFailure,
+	modbus.ErrAcknowledge,
+	modbus.ErrServerDeviceBusy,
+	modbus.ErrMemoryParityError,
+	modbus.ErrGWPathUnavailable,
+	modbus.ErrGWTargetFailedToRespond,
+}
+
+type reconnectConfig struct {
+	failuresBeforeDown uint
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+type Connection struct {
+	config ConnectionConfig
+	client registerClient
+	reconnect reconnectConfig
+	logger *logrus.Logger
+	metrics *metrics.Store
+	queue *requestQueue
+	cache *registerCache
+	// readyAt is when the next request may be sent, only used while holding the queue
+	readyAt time.Time
+
+	lock sync.Mutex
+	state ConnectionState
+	failures uint
+	backoff time.Duration
+	nextAttempt time.Time
+}
+
+func (s ConnectionState) String() string {
+	return connectionStateNames[s]
+}
+
+func newConnection(config ConnectionConfig, client registerClient, reconnect reconnectConfig, store *metrics.Store, logger *logrus.Logger) *Connection {
+	if reconnect.failuresBeforeDown == 0 {
+		reconnect.failuresBeforeDown = 3
+	}
+
+	if reconnect.minBackoff == 0 {
+		reconnect.minBackoff = time.Second
+	}
+
+	if reconnect.maxBackoff < reconnect.minBackoff {
+		reconnect.maxBackoff = 5 * time.Minute
+	}
+
+	c := &Connection{
+		config: config,
+		client: client,
+		reconnect: reconnect,
+		logger: logger,
+		metrics: store,
+		queue: newRequestQueue(),
+		cache: newRegisterCache(),
+		state: ConnectionStateDown,
+		backoff: reconnect.minBackoff,
+	}
+	c.updateMetrics()
+
+	return c
+}
+
+// GetState returns the state of the connection and the amount of consecutive failed requests.
+func (c *Connection) GetState() (ConnectionState, uint) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.state, c.failures
+}
+
+// open opens the connection when it is down and the backoff has passed.
+func (c *Connection) open() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != ConnectionStateDown {
+		return nil
+	}
+
+	if time.Now().Before(c.nextAttempt) {
+		return ErrConnectionDown
+	}
+
+	err := c.client.Open()
+	if err != nil {
+		c.failures++
+		c.nextAttempt = time.Now().Add(c.backoff)
+		c.logger.WithError(err).WithFields(logrus.Fields{"connection": c.config.Name, "retryIn": c.backoff}).Warn("Failed to connect")
+
+		c.backoff *= 2
+		if c.backoff > c.reconnect.maxBackoff {
+			c.backoff = c.reconnect.maxBackoff
+		}
+
+		c.updateMetrics()
+		return fmt.Errorf("Failed to connect to %s: %w", c.config.Name, err)
+	}
+
+	c.logger.WithFields(logrus.Fields{"connection": c.config.Name}).Info("Connected")
+	c.state = ConnectionStateConnected
+	c.failures = 0
+	c.backoff = c.reconnect.minBackoff
+	// Huawei SDongles drop requests sent right after the connection is opened
+	c.readyAt = time.Now().Add(time.Duration(c.config.ConnectDelay) * time.Millisecond)
+	c.updateMetrics()
+
+	return nil
+}
+
+// execute runs fn as a single transaction with the unit id selected, opening the connection when needed.
+// Transactions are queued by priority so nothing else can change the unit id in the meantime, and are
+// spaced by the inter frame delay. The health of the connection is tracked by the result.
+func (c *Connection) execute(priority requestPriority, unitId uint8, fn func(client registerClient) error) error {
+	c.queue.acquire(priority)
+	defer c.queue.release()
+
+	err := c.open()
+	if err != nil {
+		return err
+	}
+
+	time.Sleep(time.Until(c.readyAt))
+
+	err = c.client.SetUnitId(unitId)
+	if err == nil {
+		err = fn(c.client)
+	}
+	c.readyAt = time.Now().Add(time.Duration(c.config.InterFrameDelay) * time.Millisecond)
+	c.record(err)
+
+	return err
+}
+
+// readRegisters reads quantity holding registers in as many requests as needed and returns the amount of
+// requests made.
+func (c *Connection) readRegisters(priority requestPriority, unitId uint8, address uint16, quantity uint16) ([]uint16, int, error) {
+	words := []uint16{}
+	requests := 0
+
+	for quantity > 0 {
+		chunk := quantity
+		if chunk > maxReadQuantity {
+			chunk = maxReadQuantity
+		}
+
+		err := c.execute(priority, unitId, func(client registerClient) error {
+			requests++
+			chunkWords, err := client.ReadRegisters(address, chunk, modbus.HOLDING_REGISTER)
+			words = append(words, chunkWords...)
+
+			return err
+		})
+		if err != nil {
+			return nil, requests, err
+		}
+
+		address += chunk
+		quantity -= chunk
+	}
+
+	return words, requests, nil
+}
+
+// record updates the state of the connection with the result of a request. The connection is closed
+// after too many consecutive failures so the next request reconnects.
+func (c *Connection) record(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err == nil {
+		c.state = ConnectionStateConnected
+		c.failures = 0
+		c.updateMetrics()
+		return
+	}
+
+	c.failures++
+	c.state = ConnectionStateDegraded
+
+	if !isDeviceError(err) && c.failures >= c.reconnect.failuresBeforeDown {
+		c.logger.WithError(err).WithFields(logrus.Fields{"connection": c.config.Name, "failures": c.failures}).Warn("Connection is down, reconnecting")
+
+		c.client.Close()
+		c.state = ConnectionStateDown
+		c.nextAttempt = time.Now()
+	}
+
+	c.updateMetrics()
+}
+
+func (c *Connection) close() error {
+	c.queue.acquire(priorityControl)
+	defer c.queue.release()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// A connection which is down was never opened or is closed already
+	if c.state == ConnectionStateDown {
+		return nil
+	}
+
+	c.state = ConnectionStateDown
+	c.updateMetrics()
+
+	return c.client.Close()
+}
+
+func (c *Connection) updateMetrics() {
+	for state, name := range connectionStateNames {
+		value := 0.0
+		if state == c.state {
+			value = 1
+		}
+
+		c.metrics.SetMetricValue("modbus", "connection_state", map[string]string{"connection": c.config.Name, "state": name}, value)
+	}
+
+	c.metrics.SetMetricValue("modbus", "connection_failures", map[string]string{"connection": c.config.Name}, float64(c.failures))
+}
+
+func isDeviceError(err error) bool {
+	for _, deviceErr := range deviceErrors {
+		if errors.Is(err, deviceErr) {
+			return true
+		}
+	}
+
+	return false
+}
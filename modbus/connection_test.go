@@ -0,0 +1,110 @@
+package modbus
+
+import (
+	"time"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/simonvetter/modbus"
+)
+
+func TestConnectionReconnect(t *testing.T) {
+	client := newFakeClient()
+	client.err = errors.New("connection refused")
+
+	connection := newConnection(ConnectionConfig{Name: "test"}, client, reconnectConfig{
+		failuresBeforeDown: 2,
+		minBackoff: time.Hour,
+		maxBackoff: time.Hour,
+	}, newTestStore(), logrus.New())
+
+	read := func(client registerClient) error {
+		_, err := client.ReadRegisters(100, 1, modbus.HOLDING_REGISTER)
+		return err
+	}
+
+	err := connection.execute(priorityPoll, 1, read)
+	if err == nil || errors.Is(err, ErrConnectionDown) {
+		t.Fatalf("Expected the first connection attempt to fail, got %v", err)
+	}
+
+	err = connection.execute(priorityPoll, 1, read)
+	if !errors.Is(err, ErrConnectionDown) {
+		t.Fatalf("Expected the connection to wait for the backoff, got %v", err)
+	}
+
+	client.err = nil
+	connection.nextAttempt = time.Now()
+
+	err = connection.execute(priorityPoll, 1, read)
+	if err != nil {
+		t.Fatalf("Expected the connection to reconnect, got %s", err)
+	}
+
+	state, failures := connection.GetState()
+	if state != ConnectionStateConnected || failures != 0 {
+		t.Fatalf("Expected connected without failures, got %s with %d failures", state, failures)
+	}
+
+	client.err = modbus.ErrRequestTimedOut
+	connection.execute(priorityPoll, 1, read)
+
+	state, _ = connection.GetState()
+	if state != ConnectionStateDegraded {
+		t.Fatalf("Expected degraded after a failed request, got %s", state)
+	}
+
+	connection.execute(priorityPoll, 1, read)
+
+	state, failures = connection.GetState()
+	if state != ConnectionStateDown || failures != 2 {
+		t.Fatalf("Expected down after 2 failed requests, got %s with %d failures", state, failures)
+	}
+}
+
+func TestConnectionDeviceErrorKeepsLink(t *testing.T) {
+	client := newFakeClient()
+	connection := newConnection(ConnectionConfig{Name: "test"}, client, reconnectConfig{failuresBeforeDown: 1}, newTestStore(), logrus.New())
+
+	for i := 0; i < 3; i++ {
+		connection.execute(priorityPoll, 1, func(client registerClient) error {
+			return modbus.ErrIllegalDataAddress
+		})
+	}
+
+	state, failures := connection.GetState()
+	if state != ConnectionStateDegraded || failures != 3 {
+		t.Fatalf("Expected degraded with 3 failures, got %s with %d failures", state, failures)
+	}
+}
+
+func TestConnectionDelays(t *testing.T) {
+	client := newFakeClient()
+	connection := newConnection(ConnectionConfig{Name: "test", ConnectDelay: 50, InterFrameDelay: 30}, client, reconnectConfig{}, newTestStore(), logrus.New())
+
+	read := func(client registerClient) error {
+		_, err := client.ReadRegisters(100, 1, modbus.HOLDING_REGISTER)
+		return err
+	}
+
+	start := time.Now()
+	err := connection.execute(priorityPoll, 1, read)
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+
+	if time.Since(start) < 50 * time.Millisecond {
+		t.Fatalf("Expected the first request to wait for the connect delay, took %s", time.Since(start))
+	}
+
+	start = time.Now()
+	err = connection.execute(priorityPoll, 1, read)
+	if err != nil {
+		t.Fatalf("Failed to read: %s", err)
+	}
+
+	if time.Since(start) < 30 * time.Millisecond {
+		t.Fatalf("Expected the second request to wait for the inter frame delay, took %s", time.Since(start))
+	}
+}
@@ -0,0 +1,91 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"encoding/binary"
+)
+
+// DecodeRegister decodes the words of register into a number without gain applied, or into text for
+// string registers. Multi word values are big endian with the high word first.
+func DecodeRegister(register Register, words []uint16) (float64, string, error) {
+	if len(words) != int(register.Quantity) || !validRegisterQuantity(register.Type, register.Quantity) {
+		return 0, "", fmt.Errorf("Register %s has %d words, which is invalid for type %s", register.Name, len(words), register.Type)
+	}
+
+	switch register.Type {
+	case RegisterTypeUint16, RegisterTypeEnum:
+		return float64(words[0]), "", nil
+	case RegisterTypeInt16:
+		return float64(int16(words[0])), "", nil
+	case RegisterTypeUint32, RegisterTypeTimestamp:
+		return float64(decodeUint32(words)), "", nil
+	case RegisterTypeInt32:
+		return float64(int32(decodeUint32(words))), "", nil
+	case RegisterTypeBitfield:
+		if len(words) == 1 {
+			return float64(words[0]), "", nil
+		}
+
+		return float64(decodeUint32(words)), "", nil
+	case RegisterTypeString:
+		return 1, decodeString(words), nil
+	}
+
+	return 0, "", fmt.Errorf("Register %s has unknown type %s", register.Name, register.Type)
+}
+
+// EncodeRegister encodes a number without gain applied into the words of register.
+func EncodeRegister(register Register, value float64) ([]uint16, error) {
+	raw := int64(math.Round(value))
+
+	switch register.Type {
+	case RegisterTypeUint16, RegisterTypeEnum:
+		if raw < 0 || raw > math.MaxUint16 {
+			return nil, fmt.Errorf("Value %d out of range for register %s of type %s", raw, register.Name, register.Type)
+		}
+
+		return []uint16{uint16(raw)}, nil
+	case RegisterTypeInt16:
+		if raw < math.MinInt16 || raw > math.MaxInt16 {
+			return nil, fmt.Errorf("Value %d out of range for register %s of type %s", raw, register.Name, register.Type)
+		}
+
+		return []uint16{uint16(int16(raw))}, nil
+	case RegisterTypeUint32, RegisterTypeTimestamp:
+		if raw < 0 || raw > math.MaxUint32 {
+			return nil, fmt.Errorf("Value %d out of range for register %s of type %s", raw, register.Name, register.Type)
+		}
+
+		return []uint16{uint16(raw >> 16), uint16(raw)}, nil
+	case RegisterTypeInt32:
+		if raw < math.MinInt32 || raw > math.MaxInt32 {
+			return nil, fmt.Errorf("Value %d out of range for register %s of type %s", raw, register.Name, register.Type)
+		}
+
+		return []uint16{uint16(uint32(raw) >> 16), uint16(uint32(raw))}, nil
+	case RegisterTypeBitfield:
+		if register.Quantity == 1 {
+			return EncodeRegister(Register{Name: register.Name, Type: RegisterTypeUint16, Quantity: 1}, value)
+		}
+
+		return EncodeRegister(Register{Name: register.Name, Type: RegisterTypeUint32, Quantity: 2}, value)
+	}
+
+	return nil, fmt.Errorf("Register %s of type %s can not be encoded", register.Name, register.Type)
+}
+
+func decodeUint32(words []uint16) uint32 {
+	return uint32(words[0]) << 16 | uint32(words[1])
+}
+
+// decodeString decodes ASCII text padded with NUL characters or spaces.
+func decodeString(words []uint16) string {
+	bytes := []byte{}
+	for _, word := range words {
+		bytes = binary.BigEndian.AppendUint16(bytes, word)
+	}
+
+	return strings.TrimSpace(strings.TrimRight(string(bytes), "\x00"))
+}
@@ -0,0 +1,112 @@
+package modbus
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDecodeRegister(t *testing.T) {
+	tests := []struct {
+		name string
+		registerType RegisterType
+		words []uint16
+		expected float64
+		text string
+	}{
+		{name: "uint16_zero", registerType: RegisterTypeUint16, words: []uint16{0x0000}, expected: 0},
+		{name: "uint16_max", registerType: RegisterTypeUint16, words: []uint16{0xffff}, expected: math.MaxUint16},
+		{name: "int16_zero", registerType: RegisterTypeInt16, words: []uint16{0x0000}, expected: 0},
+		{name: "int16_max", registerType: RegisterTypeInt16, words: []uint16{0x7fff}, expected: math.MaxInt16},
+		{name: "int16_min", registerType: RegisterTypeInt16, words: []uint16{0x8000}, expected: math.MinInt16},
+		{name: "int16_minus_one", registerType: RegisterTypeInt16, words: []uint16{0xffff}, expected: -1},
+		{name: "uint32_zero", registerType: RegisterTypeUint32, words: []uint16{0x0000, 0x0000}, expected: 0},
+		{name: "uint32_word_boundary", registerType: RegisterTypeUint32, words: []uint16{0x0001, 0x0000}, expected: 65536},
+		{name: "uint32_huawei_heuristic", registerType: RegisterTypeUint32, words: []uint16{0x0098, 0x9680}, expected: 10000000},
+		{name: "uint32_max", registerType: RegisterTypeUint32, words: []uint16{0xffff, 0xffff}, expected: math.MaxUint32},
+		{name: "int32_zero", registerType: RegisterTypeInt32, words: []uint16{0x0000, 0x0000}, expected: 0},
+		{name: "int32_max", registerType: RegisterTypeInt32, words: []uint16{0x7fff, 0xffff}, expected: math.MaxInt32},
+		{name: "int32_min", registerType: RegisterTypeInt32, words: []uint16{0x8000, 0x0000}, expected: math.MinInt32},
+		{name: "int32_minus_one", registerType: RegisterTypeInt32, words: []uint16{0xffff, 0xffff}, expected: -1},
+		{name: "int32_low_word_negative", registerType: RegisterTypeInt32, words: []uint16{0x0000, 0xffff}, expected: 65535},
+		{name: "int32_minus_ten_million", registerType: RegisterTypeInt32, words: []uint16{0xff67, 0x6980}, expected: -10000000},
+		{name: "enum", registerType: RegisterTypeEnum, words: []uint16{0x0200}, expected: 512},
+		{name: "bitfield16", registerType: RegisterTypeBitfield, words: []uint16{0x8001}, expected: 32769},
+		{name: "bitfield32", registerType: RegisterTypeBitfield, words: []uint16{0x8000, 0x0001}, expected: 2147483649},
+		{name: "timestamp_epoch", registerType: RegisterTypeTimestamp, words: []uint16{0x0000, 0x0000}, expected: 0},
+		{name: "timestamp_max", registerType: RegisterTypeTimestamp, words: []uint16{0xffff, 0xffff}, expected: math.MaxUint32},
+		{name: "string", registerType: RegisterTypeString, words: []uint16{0x5355, 0x4e32, 0x3030, 0x3000, 0x0000}, expected: 1, text: "SUN2000"},
+		{name: "string_spaces", registerType: RegisterTypeString, words: []uint16{0x4142, 0x2020}, expected: 1, text: "AB"},
+		{name: "string_empty", registerType: RegisterTypeString, words: []uint16{0x0000}, expected: 1, text: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			register := Register{Name: test.name, Type: test.registerType, Quantity: uint16(len(test.words))}
+
+			value, text, err := DecodeRegister(register, test.words)
+			if err != nil {
+				t.Fatalf("Failed to decode: %s", err)
+			}
+
+			if value != test.expected || text != test.text {
+				t.Fatalf("Expected %f %q, got %f %q", test.expected, test.text, value, text)
+			}
+
+			if test.registerType == RegisterTypeString {
+				return
+			}
+
+			words, err := EncodeRegister(register, value)
+			if err != nil {
+				t.Fatalf("Failed to encode: %s", err)
+			}
+
+			for i := range words {
+				if words[i] != test.words[i] {
+					t.Fatalf("Expected encoding %x, got %x", test.words, words)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeRegisterInvalidQuantity(t *testing.T) {
+	tests := []Register{
+		{Name: "int32", Type: RegisterTypeInt32, Quantity: 1},
+		{Name: "uint16", Type: RegisterTypeUint16, Quantity: 2},
+		{Name: "bitfield", Type: RegisterTypeBitfield, Quantity: 3},
+		{Name: "timestamp", Type: RegisterTypeTimestamp, Quantity: 1},
+	}
+
+	for _, register := range tests {
+		_, _, err := DecodeRegister(register, make([]uint16, register.Quantity))
+		if err == nil {
+			t.Fatalf("Expected an error decoding %s with %d words", register.Name, register.Quantity)
+		}
+	}
+}
+
+func TestEncodeRegisterOutOfRange(t *testing.T) {
+	tests := []struct {
+		registerType RegisterType
+		quantity uint16
+		value float64
+	}{
+		{registerType: RegisterTypeUint16, quantity: 1, value: -1},
+		{registerType: RegisterTypeUint16, quantity: 1, value: math.MaxUint16 + 1},
+		{registerType: RegisterTypeInt16, quantity: 1, value: math.MinInt16 - 1},
+		{registerType: RegisterTypeInt16, quantity: 1, value: math.MaxInt16 + 1},
+		{registerType: RegisterTypeUint32, quantity: 2, value: -1},
+		{registerType: RegisterTypeUint32, quantity: 2, value: math.MaxUint32 + 1},
+		{registerType: RegisterTypeInt32, quantity: 2, value: math.MinInt32 - 1},
+		{registerType: RegisterTypeInt32, quantity: 2, value: math.MaxInt32 + 1},
+		{registerType: RegisterTypeString, quantity: 5, value: 1},
+	}
+
+	for _, test := range tests {
+		_, err := EncodeRegister(Register{Name: "test", Type: test.registerType, Quantity: test.quantity}, test.value)
+		if err == nil {
+			t.Fatalf("Expected %f to be out of range for %s", test.value, test.registerType)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package modbus
+
+import (
+	"github.com/simonvetter/modbus"
+)
+
+type fakeWrite struct {
+	unitId uint8
+	address uint16
+	values []uint16
+}
+
+// fakeClient is an in-memory registerClient keeping holding registers per unit id.
+type fakeClient struct {
+	unitId uint8
+	registers map[uint8]map[uint16]uint16
+	writes []fakeWrite
+	reads int
+	err error
+	// illegal addresses are answered with an exception like registers a device does not define
+	illegal map[uint16]bool
+	// ignoreWrites is the amount of writes acknowledged without changing the register, like a device busy
+	// applying a previous setting
+	ignoreWrites int
+}
+
+func newFakeClient() *fakeClient {
+	return &fakeClient{
+		registers: make(map[uint8]map[uint16]uint16),
+	}
+}
+
+func (f *fakeClient) set(unitId uint8, address uint16, values ...uint16) {
+	if f.registers[unitId] == nil {
+		f.registers[unitId] = make(map[uint16]uint16)
+	}
+
+	for i, value := range values {
+		f.registers[unitId][address + uint16(i)] = value
+	}
+}
+
+func (f *fakeClient) get(unitId uint8, address uint16) uint16 {
+	return f.registers[unitId][address]
+}
+
+func (f *fakeClient) Open() error {
+	return f.err
+}
+
+func (f *fakeClient) Close() error {
+	return nil
+}
+
+func (f *fakeClient) SetUnitId(id uint8) error {
+	f.unitId = id
+	return nil
+}
+
+func (f *fakeClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	f.reads++
+
+	for i := uint16(0); i < quantity; i++ {
+		if f.illegal[addr + i] {
+			return nil, modbus.ErrIllegalDataAddress
+		}
+	}
+
+	values := make([]uint16, quantity)
+	for i := range values {
+		values[i] = f.get(f.unitId, addr + uint16(i))
+	}
+
+	return values, nil
+}
+
+func (f *fakeClient) WriteRegister(addr uint16, value uint16) error {
+	return f.WriteRegisters(addr, []uint16{value})
+}
+
+func (f *fakeClient) WriteRegisters(addr uint16, values []uint16) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	f.writes = append(f.writes, fakeWrite{unitId: f.unitId, address: addr, values: values})
+	if f.ignoreWrites > 0 {
+		f.ignoreWrites--
+		return nil
+	}
+
+	f.set(f.unitId, addr, values...)
+
+	return nil
+}
@@ -2,8 +2,13 @@ package modbus
 
 import (
 	"fmt"
+	"math"
 	"time"
+	"errors"
+	"strconv"
 	"context"
+	"sync"
+	"sync/atomic"
 
 	"gijs.eu/vonkje/metrics"
 
@@ -16,37 +21,139 @@ type Inverter struct {
 	UnitId uint8 `mapstructure:"unit-id"`
 	PowerMeter bool `mapstructure:"power-meter"`
 	Luna2000 bool `mapstructure:"luna2000"`
+	Profiles []string `mapstructure:"profiles"`
+	PVStrings uint `mapstructure:"pv-strings"`
+	BatteryUnits uint `mapstructure:"battery-units"`
 }
 
 type ConnectionConfig struct {
 	Name string `mapstructure:"name"`
 	IP string `mapstructure:"ip"`
 	Port uint `mapstructure:"port"`
+	Device string `mapstructure:"device"`
 	Protocol string `mapstructure:"protocol"`
 	Baudrate uint `mapstructure:"baudrate"`
 	DataBits uint `mapstructure:"data-bits"`
 	StopBits uint `mapstructure:"stop-bits"`
+	Parity string `mapstructure:"parity"`
 	Timeout uint `mapstructure:"timeout"`
+	InterFrameDelay uint `mapstructure:"inter-frame-delay"`
+	ConnectDelay uint `mapstructure:"connect-delay"`
+	Proxy ProxyConfig `mapstructure:"proxy"`
 	Inverters []Inverter `mapstructure:"inverters"`
 }
 
-type Connection struct {
-	config ConnectionConfig
-	client *modbus.ModbusClient
-}
-
 type Config struct {
 	Run bool `mapstructure:"run"`
 	ReadMetricsInterval uint `mapstructure:"read-metrics-interval"`
+	ProfilesDirectory string `mapstructure:"profiles-directory"`
+	FailuresBeforeDown uint `mapstructure:"failures-before-down"`
+	ReconnectBackoff uint `mapstructure:"reconnect-backoff"`
+	MaxReconnectBackoff uint `mapstructure:"max-reconnect-backoff"`
+	WriteRetries uint `mapstructure:"write-retries"`
+	AuditFile string `mapstructure:"audit-file"`
+	DryRun bool `mapstructure:"dry-run"`
+	FallbackWorkingMode string `mapstructure:"fallback-working-mode"`
+	FallbackExportLimitation FallbackExportLimitationConfig `mapstructure:"fallback-export-limitation"`
+	WatchdogIntervals uint `mapstructure:"watchdog-intervals"`
+	ClockSync ClockSyncConfig `mapstructure:"clock-sync"`
 	Connections []ConnectionConfig `mapstructure:"connections"`
 }
 
+var ErrInverterNotFound = fmt.Errorf("Inverter not found")
+
 type Modbus struct {
 	config Config
 	errChannel chan error
 	ctx context.Context
 	logger *logrus.Logger
 	connections map[string]*Connection
+	profiles map[string]*Profile
+	proxies []*proxy
+	polling atomic.Bool
+	dryRun atomic.Bool
+	stopping atomic.Bool
+	audit *auditTrail
+	metrics *metrics.Store
+
+	watchdogLock sync.Mutex
+	watchdog watchdogState
+
+	stateLock sync.Mutex
+	states map[string]*State
+	stateChanges []StateChange
+
+	sunSpecLock sync.Mutex
+	sunSpecProfiles map[string]*Profile
+}
+
+// GetProfiles returns the device profiles of the inverter. Without configured profiles the
+// sun2000 profile is used together with the luna2000 and power meter profiles when enabled.
+func (i Inverter) GetProfiles() []string {
+	if len(i.Profiles) > 0 {
+		return i.Profiles
+	}
+
+	profiles := []string{ProfileSun2000}
+	if i.Luna2000 {
+		profiles = append(profiles, ProfileLuna2000)
+	}
+
+	if i.PowerMeter {
+		profiles = append(profiles, ProfilePowerMeter)
+	}
+
+	return profiles
+}
+
+func (i Inverter) hasProfile(profile string) bool {
+	for _, name := range i.GetProfiles() {
+		if name == profile {
+			return true
+		}
+	}
+
+	return false
+}
+
+// registers returns the registers of profile which exist on the inverter. Registers of PV strings and
+// battery units above the configured amount are left out, by default 2 strings and 1 battery unit.
+func (i Inverter) registers(profile *Profile) map[string]Register {
+	pvStrings := i.PVStrings
+	if pvStrings == 0 {
+		pvStrings = 2
+	}
+
+	batteryUnits := i.BatteryUnits
+	if batteryUnits == 0 {
+		batteryUnits = 1
+	}
+
+	registers := make(map[string]Register)
+	for key, register := range profile.Registers {
+		if !fieldWithin(register.Fields, "string", pvStrings) || !fieldWithin(register.Fields, "battery", batteryUnits) {
+			continue
+		}
+
+		registers[key] = register
+	}
+
+	return registers
+}
+
+// fieldWithin reports whether the numbered field is at most maximum. Registers without the field always are.
+func fieldWithin(fields map[string]string, field string, maximum uint) bool {
+	value, ok := fields[field]
+	if !ok {
+		return true
+	}
+
+	number, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return true
+	}
+
+	return uint(number) <= maximum
 }
 
 func New(
@@ -54,25 +161,46 @@ func New(
 	errChannel chan error,
 	ctx context.Context,
 	logger *logrus.Logger,
+	store *metrics.Store,
 ) (*Modbus, error) {
+	profiles, err := LoadProfiles(config.ProfilesDirectory)
+	if err != nil {
+		return nil, err
+	}
+
 	m := &Modbus{
 		connections: make(map[string]*Connection),
+		profiles: profiles,
+		audit: newAuditTrail(config.AuditFile),
+		metrics: store,
 	}
 
 	for _, connectionConfig := range config.Connections {
-		client, err := modbus.NewClient(&modbus.ClientConfiguration{
-			URL: fmt.Sprintf("%s://%s:%d", connectionConfig.Protocol, connectionConfig.IP, connectionConfig.Port),
-			Speed: connectionConfig.Baudrate,
-			DataBits: connectionConfig.DataBits,
-			StopBits: connectionConfig.StopBits,
-			Parity: modbus.PARITY_NONE,
-			Timeout: time.Duration(connectionConfig.Timeout) * time.Second,
-		})
+		for _, inverter := range connectionConfig.Inverters {
+			for _, name := range inverter.GetProfiles() {
+				// SunSpec profiles are discovered and registered on the first poll
+				if name == ProfileSunSpec {
+					continue
+				}
+
+				profile, ok := profiles[name]
+				if !ok {
+					return nil, fmt.Errorf("Profile %s of inverter %s not found", name, inverter.Name)
+				}
+
+				err := profile.registerMetrics(store)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		clientConfig, err := connectionConfig.clientConfiguration()
 		if err != nil {
 			return nil, err
 		}
 
-		err = client.Open()
+		client, err := modbus.NewClient(clientConfig)
 		if err != nil {
 			return nil, err
 		}
@@ -82,10 +210,31 @@ func New(
 			return nil, err
 		}
 
-		logger.Infof("Connected to %s://%s:%d", connectionConfig.Protocol, connectionConfig.IP, connectionConfig.Port)
-		m.connections[fmt.Sprintf("%s:%d", connectionConfig.IP, connectionConfig.Port)] = &Connection{
-			config: connectionConfig,
-			client: client,
+		if _, ok := m.connections[connectionConfig.Name]; ok {
+			return nil, fmt.Errorf("Connection %s is configured more than once", connectionConfig.Name)
+		}
+
+		connection := newConnection(connectionConfig, client, reconnectConfig{
+			failuresBeforeDown: config.FailuresBeforeDown,
+			minBackoff: time.Duration(config.ReconnectBackoff) * time.Second,
+			maxBackoff: time.Duration(config.MaxReconnectBackoff) * time.Second,
+		}, store, logger)
+
+		// An unreachable gateway should not stop the service, the connection is retried while polling
+		err = connection.open()
+		if err != nil {
+			logger.WithError(err).Warn("Starting without connection")
+		}
+
+		m.connections[connectionConfig.Name] = connection
+
+		if connectionConfig.Proxy.Listen != "" {
+			proxy, err := newProxy(connection, profiles, config.ReadMetricsInterval, m.audit, &m.dryRun, logger)
+			if err != nil {
+				return nil, err
+			}
+
+			m.proxies = append(m.proxies, proxy)
 		}
 	}
 
@@ -93,17 +242,52 @@ func New(
 	m.errChannel = errChannel
 	m.ctx = ctx
 	m.logger = logger
+	m.SetDryRun(config.DryRun)
+
+	_, _, err = m.fallbackWorkingMode()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = m.fallbackExportLimitation()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = m.clockLocation()
+	if err != nil {
+		return nil, err
+	}
 
 	return m, nil
 }
 
+// Close returns the batteries to the safe state and closes the connections. Writes other than those of
+// the shutdown are refused from here on.
 func (m *Modbus) Close() {
+	m.stopping.Store(true)
+
+	err := m.SafeState(WriteOrigin{Caller: callerShutdown, Reason: "Vonkje is stopping"})
+	if err != nil {
+		m.logger.WithError(err).Error("Failed to return batteries to the safe state")
+	}
+
 	for _, connection := range m.connections {
-		connection.client.Close()
+		connection.close()
 	}
 }
 
 func (m *Modbus) Start() {
+	for _, proxy := range m.proxies {
+		err := proxy.start(m.ctx.Done())
+		if err != nil {
+			m.errChannel <- err
+		}
+	}
+
+	go m.startWatchdog()
+	go m.startClockSync()
+
 	if !m.config.Run {
 		m.logger.Warn("Modbus metrics collector is disabled")
 		return
@@ -127,53 +311,79 @@ func (m *Modbus) Start() {
 	}
 }
 
-func (m *Modbus) ChangeBatteryForceCharge(inverter string, battery string, state uint16, watts uint) error {
-	inverterConfig, err := m.getInverterConfig(inverter)
-	if err != nil {
-		return err
+// maxForcibleDuration is the longest period the inverter accepts for a forcible charge or discharge
+const maxForcibleDuration = 24 * time.Hour
+
+// ForceChargeLimit makes the inverter end a forcible charge or discharge by itself, after Duration or once
+// the battery reaches TargetSOC, so a command does not outlive Vonkje. Exactly one of them is set.
+type ForceChargeLimit struct {
+	Duration time.Duration
+	TargetSOC float64
+}
+
+// writes returns the registers to write for the limit. The duration is rounded up to whole minutes.
+func (l ForceChargeLimit) writes() ([]registerWrite, error) {
+	if (l.Duration == 0) == (l.TargetSOC == 0) {
+		return nil, fmt.Errorf("A forcible charge or discharge needs either a duration or a target SOC")
 	}
 
-	if !inverterConfig.Luna2000 {
-		return fmt.Errorf("Inverter %s does not have a luna2000 battery connected", inverter)
+	if l.TargetSOC != 0 {
+		if l.TargetSOC < 0 || l.TargetSOC > 100 {
+			return nil, fmt.Errorf("Target SOC %g is not a percentage", l.TargetSOC)
+		}
+
+		return []registerWrite{
+			{key: "forcible_charge_discharge_target_soc_battery_1", value: l.TargetSOC},
+			{key: "forcible_charge_discharge_setting_mode_battery_1", value: float64(MODBUS_STATE_BATTERY_FORCIBLE_SETTING_MODE_SOC)},
+		}, nil
 	}
 
-	connection, err := m.getConnection(inverter)
-	if err != nil {
-		return err
+	if l.Duration < 0 || l.Duration > maxForcibleDuration {
+		return nil, fmt.Errorf("Duration %s is not between 1 minute and %s", l.Duration, maxForcibleDuration)
 	}
 
-	err = connection.client.SetUnitId(inverterConfig.UnitId)
+	return []registerWrite{
+		{key: "forcible_charge_discharge_period_battery_1", value: math.Ceil(l.Duration.Minutes())},
+		{key: "forcible_charge_discharge_setting_mode_battery_1", value: float64(MODBUS_STATE_BATTERY_FORCIBLE_SETTING_MODE_DURATION)},
+	}, nil
+}
+
+// ChangeBatteryForceCharge sets the limit, the power and then the forcible charge or discharge mode of the
+// battery. The forcible registers control the battery of the inverter as a whole, so a command applies to
+// all its battery units and watts is the power of all of them together. The limit is ignored when stopping.
+// Every write is read back and recorded in the audit trail with origin.
+func (m *Modbus) ChangeBatteryForceCharge(origin WriteOrigin, inverter string, state uint16, watts uint, limit ForceChargeLimit) error {
+	inverterConfig, err := m.getBatteryInverter(inverter)
 	if err != nil {
 		return err
 	}
 
-	switch state {
-	case MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE:
-		err = connection.client.WriteUint32(luna2000Registers["forcible_charge_power_battery_1"].Address, uint32(watts))
+	writes := []registerWrite{}
+	if state != MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP {
+		writes, err = limit.writes()
 		if err != nil {
 			return err
 		}
+	}
+
+	switch state {
+	case MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE:
+		writes = append(writes, registerWrite{key: "forcible_charge_power_battery_1", value: float64(watts) / 1000})
 	case MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE:
-		err = connection.client.WriteUint32(luna2000Registers["maximum_discharge_power_battery"].Address, uint32(watts))
-		if err != nil {
-			return err
-		}
+		writes = append(writes, registerWrite{key: "forcible_discharge_power_battery_1", value: float64(watts) / 1000})
 	case MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP:
-		err = connection.client.WriteUint32(luna2000Registers["forcible_charge_power_battery_1"].Address, 0)
-		if err != nil {
-			return err
-		}
-
-		err = connection.client.WriteUint32(luna2000Registers["maximum_discharge_power_battery"].Address, 0)
-		if err != nil {
-			return err
-		}
+		// The maximum charge and discharge power are settings of the installation and are left alone
+		writes = append(writes, registerWrite{key: "forcible_charge_power_battery_1", value: 0}, registerWrite{key: "forcible_discharge_power_battery_1", value: 0})
 	}
 
-	err = connection.client.WriteRegister(luna2000Registers["forcible_charge_discharge_battery_1"].Address, state)
+	// The mode goes last so the battery never runs in a forcible mode with the previous power or limit
+	writes = append(writes, registerWrite{key: "forcible_charge_discharge_battery_1", value: float64(state)})
+
+	err = m.writeRegisters(origin, inverterConfig, ProfileLuna2000, writes)
 	if err != nil {
 		return err
 	}
+	m.recordCommand(state)
 
 	return nil
 }
@@ -187,7 +397,7 @@ func (m *Modbus) getInverterConfig(inverter string) (Inverter, error) {
 		}
 	}
 
-	return Inverter{}, fmt.Errorf("Inverter %s not found", inverter)
+	return Inverter{}, fmt.Errorf("%w: %s", ErrInverterNotFound, inverter)
 }
 
 func (m *Modbus) getConnection(inverter string) (*Connection, error) {
@@ -199,106 +409,142 @@ func (m *Modbus) getConnection(inverter string) (*Connection, error) {
 		}
 	}
 
-	return nil, fmt.Errorf("Inverter %s not found", inverter)
+	return nil, fmt.Errorf("%w: %s", ErrInverterNotFound, inverter)
 }
 
 func (m *Modbus) updateMetrics() {
+	if !m.polling.CompareAndSwap(false, true) {
+		m.logger.Warn("Previous modbus poll cycle is still running, skipping this one")
+		return
+	}
+	defer m.polling.Store(false)
+
 	for _, connection := range m.connections {
+		start := time.Now()
+		requests := 0
+
 		for _, inverter := range connection.config.Inverters {
-			err := m.updateMetricsRegisters(connection, inverter, sun2000Registers)
-			if err != nil {
-				m.errChannel <- err
-			}
+			for _, name := range inverter.GetProfiles() {
+				profile, count, err := m.getProfile(connection, inverter, name)
+				requests += count
+				if err == nil {
+					count, err = m.updateMetricsRegisters(connection, inverter, profile)
+					requests += count
+				}
 
-			if inverter.Luna2000 {
-				err := m.updateMetricsRegisters(connection, inverter, luna2000Registers)
-				if err != nil {
-					m.errChannel <- err
+				if errors.Is(err, ErrConnectionDown) {
+					// Failed connection attempts are already logged, retrying happens with a backoff
+					m.logger.WithFields(logrus.Fields{"connection": connection.config.Name}).Debug("Skipping poll of connection which is down")
+					break
 				}
-			}
 
-			if inverter.PowerMeter {
-				err := m.updateMetricsRegisters(connection, inverter, powerMeterRegisters)
 				if err != nil {
 					m.errChannel <- err
 				}
 			}
 		}
+
+		m.metrics.SetMetricValue("modbus", "poll_duration", map[string]string{"connection": connection.config.Name}, time.Since(start).Seconds())
+		m.metrics.SetMetricValue("modbus", "poll_requests", map[string]string{"connection": connection.config.Name}, float64(requests))
 	}
 }
 
-func (m *Modbus) updateMetricsRegisters(connection *Connection, inverter Inverter, registers map[string]Register) error {
-	err := connection.client.SetUnitId(inverter.UnitId)
+// getProfile returns the profile called name for the inverter and the amount of requests made. The
+// SunSpec profile is discovered on first use and discovery is retried every poll until it succeeds.
+func (m *Modbus) getProfile(connection *Connection, inverter Inverter, name string) (*Profile, int, error) {
+	if name != ProfileSunSpec {
+		return m.profiles[name], 0, nil
+	}
+
+	m.sunSpecLock.Lock()
+	defer m.sunSpecLock.Unlock()
+
+	if profile, ok := m.sunSpecProfiles[inverter.Name]; ok {
+		return profile, 0, nil
+	}
+
+	profile, requests, err := m.discoverSunSpec(connection, inverter)
 	if err != nil {
-		return err
+		return nil, requests, err
 	}
 
-	for _, register := range registers {
-		var result int
+	profiles := map[string]*Profile{ProfileSunSpec: profile}
+	profile.Metrics = make(map[string]string)
+	for name, builtin := range m.profiles {
+		profiles[name] = builtin
 
-		switch register.Type {
-		case RegisterTypeUint16:
-			var reg uint16
-			reg, err = connection.client.ReadRegister(register.Address, modbus.HOLDING_REGISTER)
-			if err != nil { 
-				return err
+		for metric, help := range builtin.Metrics {
+			profile.Metrics[metric] = help
+		}
+	}
+
+	err = validateProfileMetrics(profiles)
+	if err != nil {
+		return nil, requests, err
+	}
+	err = profile.registerMetrics(m.metrics)
+	if err != nil {
+		return nil, requests, err
+	}
+
+	if m.sunSpecProfiles == nil {
+		m.sunSpecProfiles = make(map[string]*Profile)
+	}
+	m.sunSpecProfiles[inverter.Name] = profile
+
+	return profile, requests, nil
+}
+
+// updateMetricsRegisters reads the registers of profile in blocks and returns the amount of read requests made.
+func (m *Modbus) updateMetricsRegisters(connection *Connection, inverter Inverter, profile *Profile) (int, error) {
+	requests := 0
+	for _, block := range buildRegisterBlocks(inverter.registers(profile), profile.MaxReadGap, profile.MaxReadQuantity) {
+		var values []uint16
+		err := connection.execute(priorityPoll, inverter.UnitId, func(client registerClient) error {
+			var err error
+
+			requests++
+			values, err = client.ReadRegisters(block.address, block.quantity, modbus.HOLDING_REGISTER)
+			return err
+		})
+		if err != nil {
+			return requests, err
+		}
+		connection.cache.store(inverter.UnitId, block.address, values, time.Now())
+
+		for _, entry := range block.registers {
+			register := entry.register
+			words := block.words(register, values)
+			if register.sunSpec && sunSpecNotImplemented(register, words) {
+				continue
 			}
 
-			result = int(reg)
-		case RegisterTypeUint32:
-			var reg uint32
-			reg, err = connection.client.ReadUint32(register.Address, modbus.HOLDING_REGISTER)
+			result, text, err := DecodeRegister(register, words)
 			if err != nil {
-				return err
+				return requests, err
 			}
 
-			if reg > 9999999 {
-				regBytes, err := connection.client.ReadBytes(register.Address, register.Quantity * 2, modbus.HOLDING_REGISTER)
-				if err != nil {
-					return err
-				}
-				
-				result = int(convertTooLargeNumber(regBytes))
-			} else {
-				result = int(reg)
-			}
-		case RegisterTypeInt16:
-			var res int16
-			reg, err := connection.client.ReadRegister(register.Address, modbus.HOLDING_REGISTER)
-			if err != nil {
-				return err
+			fields := map[string]string{"inverter": inverter.Name}
+			for k, v := range register.Fields {
+				fields[k] = v
 			}
 
-			res = int16(reg)
-			result = int(res)
-		case RegisterTypeInt32:
-			var res int32
-			reg, err := connection.client.ReadUint32(register.Address, modbus.HOLDING_REGISTER)
-			if err != nil {
-				return err
+			if register.Type == RegisterTypeString {
+				fields["value"] = text
 			}
 
-			if reg > 9999999 {
-				regBytes, err := connection.client.ReadBytes(register.Address, register.Quantity * 2, modbus.HOLDING_REGISTER)
-				if err != nil {
-					return err
-				}
-				
-				res = int32(convertTooLargeNumber(regBytes))
-			} else {
-				res = int32(reg)
+			value := result / register.Gain
+			if register.Invert {
+				value = -value
 			}
 
-			result = int(res)
-		}
+			m.metrics.SetMetricValue(register.Namespace, register.Name, fields, value)
 
-		fields := map[string]string{"inverter": inverter.Name}
-		for k, v := range register.Fields {
-			fields[k] = v
+			if register.States != nil {
+				m.updateState(inverter, entry.key, register, fields, uint32(result))
+			}
 		}
-
-		metrics.SetMetricValue(register.Namespace, register.Name, fields, float64(result) / register.Gain)
 	}
 
-	return nil
+	return requests, nil
 }
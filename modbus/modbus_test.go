@@ -0,0 +1,266 @@
+package modbus
+
+import (
+	"time"
+	"context"
+	"testing"
+
+	"gijs.eu/vonkje/metrics"
+
+	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var testOrigin = WriteOrigin{Caller: "test", Reason: "Testing"}
+var testLimit = ForceChargeLimit{Duration: 5 * time.Minute}
+
+// newTestStore returns a metrics store of its own so tests do not see each other's values.
+func newTestStore() *metrics.Store {
+	store, err := metrics.NewStore(metrics.Config{}, prometheus.NewRegistry())
+	if err != nil {
+		panic(err)
+	}
+
+	return store
+}
+
+func newTestModbus(client registerClient, inverters ...Inverter) *Modbus {
+	profiles, err := LoadProfiles("")
+	if err != nil {
+		panic(err)
+	}
+
+	store := newTestStore()
+	for _, profile := range profiles {
+		err = profile.registerMetrics(store)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return &Modbus{
+		profiles: profiles,
+		errChannel: make(chan error, 10),
+		ctx: context.Background(),
+		logger: logrus.New(),
+		audit: newAuditTrail(""),
+		metrics: store,
+		connections: map[string]*Connection{
+			"test": newConnection(ConnectionConfig{Name: "test", Inverters: inverters}, client, reconnectConfig{}, store, logrus.New()),
+		},
+	}
+}
+
+func TestUpdateMetricsRegisters(t *testing.T) {
+	tests := []struct {
+		name string
+		registerType RegisterType
+		quantity uint16
+		gain float64
+		raw []uint16
+		expected float64
+	}{
+		{name: "uint16", registerType: RegisterTypeUint16, quantity: 1, gain: 10, raw: []uint16{2305}, expected: 230.5},
+		{name: "uint16_max", registerType: RegisterTypeUint16, quantity: 1, gain: 1, raw: []uint16{0xffff}, expected: 65535},
+		{name: "int16_positive", registerType: RegisterTypeInt16, quantity: 1, gain: 100, raw: []uint16{150}, expected: 1.5},
+		{name: "int16_negative", registerType: RegisterTypeInt16, quantity: 1, gain: 1, raw: []uint16{0xfff6}, expected: -10},
+		{name: "uint32", registerType: RegisterTypeUint32, quantity: 2, gain: 100, raw: []uint16{0x0001, 0x0000}, expected: 655.36},
+		{name: "int32_positive", registerType: RegisterTypeInt32, quantity: 2, gain: 1000, raw: []uint16{0x0000, 0x1388}, expected: 5},
+		// A negative int32 decodes as two's complement
+		{name: "int32_negative", registerType: RegisterTypeInt32, quantity: 2, gain: 1, raw: []uint16{0xffff, 0xfff6}, expected: -10},
+		{name: "uint32_large", registerType: RegisterTypeUint32, quantity: 2, gain: 1, raw: []uint16{0xffff, 0xff00}, expected: 4294967040},
+		{name: "timestamp", registerType: RegisterTypeTimestamp, quantity: 2, gain: 1, raw: []uint16{0x6592, 0x1e00}, expected: 1704074752},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeClient()
+			client.set(3, 40000, test.raw...)
+
+			m := newTestModbus(client)
+			m.metrics.AddMetric("tests", "modbus_" + test.name, "A test testing register decoding", []string{"inverter"})
+			_, err := m.updateMetricsRegisters(m.connections["test"], Inverter{Name: "inverter1", UnitId: 3}, &Profile{
+				Registers: map[string]Register{
+					test.name: {Namespace: "tests", Name: "modbus_" + test.name, Fields: map[string]string{}, Address: 40000, Gain: test.gain, Quantity: test.quantity, Type: test.registerType},
+				},
+			})
+			if err != nil {
+				t.Fatalf("Failed to update metrics: %s", err)
+			}
+
+			values, err := m.metrics.GetMetricValues("tests", "modbus_" + test.name)
+			if err != nil {
+				t.Fatalf("Metric not found: %s", err)
+			}
+
+			if values[0].Fields["inverter"] != "inverter1" {
+				t.Fatalf("Incorrect inverter label %s", values[0].Fields["inverter"])
+			}
+
+			if values[0].Samples[0].Value != test.expected {
+				t.Fatalf("Expected %f, got %f", test.expected, values[0].Samples[0].Value)
+			}
+		})
+	}
+}
+
+func TestInverterRegisters(t *testing.T) {
+	profiles, err := LoadProfiles("")
+	if err != nil {
+		t.Fatalf("Failed to load profiles: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		inverter Inverter
+		profile string
+		expected []string
+		missing []string
+	}{
+		{name: "default_strings", inverter: Inverter{}, profile: ProfileSun2000, expected: []string{"pv_voltage_string_2", "active_power", "model"}, missing: []string{"pv_voltage_string_3"}},
+		{name: "all_strings", inverter: Inverter{PVStrings: 24}, profile: ProfileSun2000, expected: []string{"pv_voltage_string_24", "pv_current_string_24"}},
+		{name: "default_battery_units", inverter: Inverter{}, profile: ProfileLuna2000, expected: []string{"battery_capacity_battery_1", "charge_discharge_power"}, missing: []string{"battery_capacity_battery_2"}},
+		{name: "two_battery_units", inverter: Inverter{BatteryUnits: 2}, profile: ProfileLuna2000, expected: []string{"battery_capacity_battery_2", "battery_temperature_battery_2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registers := test.inverter.registers(profiles[test.profile])
+
+			for _, key := range test.expected {
+				if _, ok := registers[key]; !ok {
+					t.Fatalf("Expected register %s", key)
+				}
+			}
+
+			for _, key := range test.missing {
+				if _, ok := registers[key]; ok {
+					t.Fatalf("Did not expect register %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestChangeBatteryForceCharge(t *testing.T) {
+	m := newTestModbus(newFakeClient())
+	registers := m.profiles[ProfileLuna2000].Registers
+	chargePower := registers["forcible_charge_power_battery_1"].Address
+	dischargePower := registers["forcible_discharge_power_battery_1"].Address
+	maximumDischargePower := registers["maximum_discharge_power_battery"].Address
+	mode := registers["forcible_charge_discharge_battery_1"].Address
+
+	tests := []struct {
+		name string
+		state uint16
+		watts uint
+		expected map[uint16]uint16
+	}{
+		{name: "charge", state: MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, watts: 2500, expected: map[uint16]uint16{chargePower + 1: 2500, mode: 1}},
+		{name: "discharge", state: MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE, watts: 70000, expected: map[uint16]uint16{dischargePower: 1, dischargePower + 1: 4464, mode: 2}},
+		{name: "stop", state: MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP, watts: 1000, expected: map[uint16]uint16{chargePower + 1: 0, dischargePower + 1: 0, mode: 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeClient()
+			client.set(2, chargePower, 0, 1234)
+			client.set(2, dischargePower, 0, 1234)
+			client.set(2, maximumDischargePower, 0, 5000)
+
+			m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1}, Inverter{Name: "inverter2", UnitId: 2, Luna2000: true})
+			err := m.ChangeBatteryForceCharge(testOrigin, "inverter2", test.state, test.watts, testLimit)
+			if err != nil {
+				t.Fatalf("Failed to change force charge: %s", err)
+			}
+
+			for address, value := range test.expected {
+				if client.get(2, address) != value {
+					t.Fatalf("Expected %d at %d, got %d", value, address, client.get(2, address))
+				}
+			}
+
+			for _, write := range client.writes {
+				if write.unitId != 2 {
+					t.Fatalf("Write to %d went to unit id %d", write.address, write.unitId)
+				}
+			}
+
+			if client.get(2, maximumDischargePower + 1) != 5000 {
+				t.Fatalf("Expected the maximum discharge power to be left alone, got %d", client.get(2, maximumDischargePower + 1))
+			}
+
+			last := client.writes[len(client.writes) - 1]
+			if last.address != mode {
+				t.Fatalf("Expected the mode to be written last, got %d", last.address)
+			}
+		})
+	}
+}
+
+func TestForceChargeLimit(t *testing.T) {
+	tests := []struct {
+		name string
+		limit ForceChargeLimit
+		expected map[string]uint16
+		err bool
+	}{
+		{name: "duration", limit: ForceChargeLimit{Duration: 90 * time.Second}, expected: map[string]uint16{"forcible_charge_discharge_period_battery_1": 2, "forcible_charge_discharge_setting_mode_battery_1": 0}},
+		{name: "target_soc", limit: ForceChargeLimit{TargetSOC: 80}, expected: map[string]uint16{"forcible_charge_discharge_target_soc_battery_1": 800, "forcible_charge_discharge_setting_mode_battery_1": 1}},
+		{name: "none", limit: ForceChargeLimit{}, err: true},
+		{name: "both", limit: ForceChargeLimit{Duration: time.Minute, TargetSOC: 80}, err: true},
+		{name: "too_long", limit: ForceChargeLimit{Duration: 25 * time.Hour}, err: true},
+		{name: "soc_out_of_range", limit: ForceChargeLimit{TargetSOC: 101}, err: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeClient()
+			m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1, Luna2000: true})
+			registers := m.profiles[ProfileLuna2000].Registers
+			client.set(1, registers["forcible_charge_discharge_setting_mode_battery_1"].Address, 5)
+
+			err := m.ChangeBatteryForceCharge(testOrigin, "inverter1", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, 1000, test.limit)
+			if test.err {
+				if err == nil || len(client.writes) != 0 {
+					t.Fatalf("Expected the limit to be refused without writes, got %v", err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Failed to change force charge: %s", err)
+			}
+
+			for key, value := range test.expected {
+				if client.get(1, registers[key].Address) != value {
+					t.Fatalf("Expected %d in %s, got %d", value, key, client.get(1, registers[key].Address))
+				}
+			}
+
+			if client.writes[0].address != registers["forcible_charge_discharge_period_battery_1"].Address && client.writes[0].address != registers["forcible_charge_discharge_target_soc_battery_1"].Address {
+				t.Fatalf("Expected the limit to be written first, got %d", client.writes[0].address)
+			}
+		})
+	}
+}
+
+func TestChangeBatteryForceChargeWithoutBattery(t *testing.T) {
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1})
+
+	err := m.ChangeBatteryForceCharge(testOrigin, "inverter1", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, 1000, testLimit)
+	if err == nil {
+		t.Fatalf("Expected an error for an inverter without battery")
+	}
+
+	err = m.ChangeBatteryForceCharge(testOrigin, "inverter3", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, 1000, testLimit)
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown inverter")
+	}
+
+	if len(client.writes) != 0 {
+		t.Fatalf("Expected no writes, got %d", len(client.writes))
+	}
+}
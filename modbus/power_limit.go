@@ -0,0 +1,226 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// ActivePowerControlMode is the grid export limitation mode of the inverter (47415).
+type ActivePowerControlMode uint16
+
+const (
+	ActivePowerControlUnlimited ActivePowerControlMode = 0
+	ActivePowerControlDIScheduling ActivePowerControlMode = 1
+	ActivePowerControlZeroExport ActivePowerControlMode = 5
+	ActivePowerControlLimitedWatts ActivePowerControlMode = 6
+	ActivePowerControlLimitedPercentage ActivePowerControlMode = 7
+)
+
+// ExportLimitation is the grid export limitation of the inverter. MaximumPower is used in the power-limited
+// mode in watts and MaximumPercentage in the percentage-limited mode, relative to the rated power.
+type ExportLimitation struct {
+	Mode ActivePowerControlMode `json:"mode"`
+	MaximumPower int `json:"maximum_power"`
+	MaximumPercentage float64 `json:"maximum_percentage"`
+}
+
+// ActivePowerDerating is the maximum active power of the inverter in watts and as a percentage of its
+// rated power. The inverter uses the lowest of both.
+type ActivePowerDerating struct {
+	RatedPower uint `json:"rated_power"`
+	MaximumPower uint `json:"maximum_power"`
+	MaximumPercentage float64 `json:"maximum_percentage"`
+}
+
+// getSun2000Inverter returns the config of an inverter with the sun2000 profile.
+func (m *Modbus) getSun2000Inverter(inverter string) (Inverter, error) {
+	inverterConfig, err := m.getInverterConfig(inverter)
+	if err != nil {
+		return Inverter{}, err
+	}
+
+	if !inverterConfig.hasProfile(ProfileSun2000) {
+		return Inverter{}, fmt.Errorf("Inverter %s does not use the sun2000 profile", inverter)
+	}
+
+	return inverterConfig, nil
+}
+
+// GetInverters returns the names of the inverters with the sun2000 profile.
+func (m *Modbus) GetInverters() []string {
+	inverters := []string{}
+	for _, connection := range m.connections {
+		for _, inverter := range connection.config.Inverters {
+			if inverter.hasProfile(ProfileSun2000) {
+				inverters = append(inverters, inverter.Name)
+			}
+		}
+	}
+	sort.Strings(inverters)
+
+	return inverters
+}
+
+// GetRatedPower returns the rated power of the inverter in watts.
+func (m *Modbus) GetRatedPower(inverter string) (uint, error) {
+	inverterConfig, err := m.getSun2000Inverter(inverter)
+	if err != nil {
+		return 0, err
+	}
+
+	value, err := m.readRegister(inverterConfig, ProfileSun2000, "rated_power")
+	if err != nil {
+		return 0, err
+	}
+
+	return uint(math.Round(value * 1000)), nil
+}
+
+// GetActivePowerDerating returns the active power derating of the inverter.
+func (m *Modbus) GetActivePowerDerating(inverter string) (ActivePowerDerating, error) {
+	ratedPower, err := m.GetRatedPower(inverter)
+	if err != nil {
+		return ActivePowerDerating{}, err
+	}
+
+	inverterConfig, err := m.getSun2000Inverter(inverter)
+	if err != nil {
+		return ActivePowerDerating{}, err
+	}
+
+	maximumPower, err := m.readRegister(inverterConfig, ProfileSun2000, "active_power_fixed_derating")
+	if err != nil {
+		return ActivePowerDerating{}, err
+	}
+
+	percentage, err := m.readRegister(inverterConfig, ProfileSun2000, "active_power_percentage_derating")
+	if err != nil {
+		return ActivePowerDerating{}, err
+	}
+
+	return ActivePowerDerating{
+		RatedPower: ratedPower,
+		MaximumPower: uint(math.Round(maximumPower * 1000)),
+		MaximumPercentage: percentage,
+	}, nil
+}
+
+// SetActivePowerDerating limits the active power of the inverter to watts, which can not exceed the rated
+// power. The derating is lifted again by SafeState.
+func (m *Modbus) SetActivePowerDerating(origin WriteOrigin, inverter string, watts uint) error {
+	ratedPower, err := m.GetRatedPower(inverter)
+	if err != nil {
+		return err
+	}
+
+	if watts > ratedPower {
+		return fmt.Errorf("%w: derating of %d W exceeds the rated power of %d W", ErrInvalidSetting, watts, ratedPower)
+	}
+
+	inverterConfig, err := m.getSun2000Inverter(inverter)
+	if err != nil {
+		return err
+	}
+
+	// The register has a resolution of 100 W, round down so the limit is never exceeded
+	kiloWatts := math.Floor(float64(watts) / 100) / 10
+
+	return m.writeRegisters(origin, inverterConfig, ProfileSun2000, []registerWrite{{key: "active_power_fixed_derating", value: kiloWatts}})
+}
+
+// SetActivePowerPercentage limits the active power of the inverter to a percentage of its rated power.
+func (m *Modbus) SetActivePowerPercentage(origin WriteOrigin, inverter string, percentage float64) error {
+	if percentage < 0 || percentage > 100 {
+		return fmt.Errorf("%w: derating percentage %.1f is not between 0 and 100", ErrInvalidSetting, percentage)
+	}
+
+	inverterConfig, err := m.getSun2000Inverter(inverter)
+	if err != nil {
+		return err
+	}
+
+	return m.writeRegisters(origin, inverterConfig, ProfileSun2000, []registerWrite{{key: "active_power_percentage_derating", value: percentage}})
+}
+
+// ResetActivePowerDerating lifts the fixed and percentage derating of the inverter.
+func (m *Modbus) ResetActivePowerDerating(origin WriteOrigin, inverter string) error {
+	ratedPower, err := m.GetRatedPower(inverter)
+	if err != nil {
+		return err
+	}
+
+	err = m.SetActivePowerDerating(origin, inverter, ratedPower)
+	if err != nil {
+		return err
+	}
+
+	return m.SetActivePowerPercentage(origin, inverter, 100)
+}
+
+// GetExportLimitation returns the grid export limitation of the inverter.
+func (m *Modbus) GetExportLimitation(inverter string) (ExportLimitation, error) {
+	inverterConfig, err := m.getSun2000Inverter(inverter)
+	if err != nil {
+		return ExportLimitation{}, err
+	}
+
+	mode, err := m.readRegister(inverterConfig, ProfileSun2000, "active_power_control_mode")
+	if err != nil {
+		return ExportLimitation{}, err
+	}
+
+	maximumPower, err := m.readRegister(inverterConfig, ProfileSun2000, "maximum_feed_grid_power")
+	if err != nil {
+		return ExportLimitation{}, err
+	}
+
+	percentage, err := m.readRegister(inverterConfig, ProfileSun2000, "maximum_feed_grid_power_percentage")
+	if err != nil {
+		return ExportLimitation{}, err
+	}
+
+	return ExportLimitation{
+		Mode: ActivePowerControlMode(mode),
+		MaximumPower: int(math.Round(maximumPower * 1000)),
+		MaximumPercentage: percentage,
+	}, nil
+}
+
+// SetExportLimitation changes the grid export limitation of the inverter. The maximum of the mode is
+// written before the mode so the inverter never runs the new mode with an old maximum.
+func (m *Modbus) SetExportLimitation(origin WriteOrigin, inverter string, limitation ExportLimitation) error {
+	if _, ok := m.profiles[ProfileSun2000].Registers["active_power_control_mode"].States[uint32(limitation.Mode)]; !ok {
+		return fmt.Errorf("%w: unknown active power control mode %d", ErrInvalidSetting, limitation.Mode)
+	}
+
+	writes := []registerWrite{}
+	switch limitation.Mode {
+	case ActivePowerControlLimitedWatts:
+		if limitation.MaximumPower < 0 {
+			return fmt.Errorf("%w: maximum feed in power %d W is negative", ErrInvalidSetting, limitation.MaximumPower)
+		}
+
+		writes = append(writes, registerWrite{key: "maximum_feed_grid_power", value: float64(limitation.MaximumPower) / 1000})
+	case ActivePowerControlLimitedPercentage:
+		if limitation.MaximumPercentage < 0 || limitation.MaximumPercentage > 100 {
+			return fmt.Errorf("%w: maximum feed in percentage %.1f is not between 0 and 100", ErrInvalidSetting, limitation.MaximumPercentage)
+		}
+
+		writes = append(writes, registerWrite{key: "maximum_feed_grid_power_percentage", value: limitation.MaximumPercentage})
+	}
+	writes = append(writes, registerWrite{key: "active_power_control_mode", value: float64(limitation.Mode)})
+
+	inverterConfig, err := m.getSun2000Inverter(inverter)
+	if err != nil {
+		return err
+	}
+
+	return m.writeRegisters(origin, inverterConfig, ProfileSun2000, writes)
+}
+
+// derated returns whether the inverter is limited below its rated power. The fixed derating has a resolution
+// of 100 W, so a rated power which is not a multiple of that counts as not derated at the nearest step below.
+func (d ActivePowerDerating) derated() bool {
+	return d.MaximumPower < d.RatedPower / 100 * 100 || d.MaximumPercentage < 100
+}
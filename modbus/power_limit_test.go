@@ -0,0 +1,110 @@
+package modbus
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestActivePowerDerating(t *testing.T) {
+	writeRetryDelay = 0
+
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1})
+	registers := m.profiles[ProfileSun2000].Registers
+
+	// 10 kW rated power
+	client.set(1, registers["rated_power"].Address, 0, 10000)
+
+	err := m.SetActivePowerDerating(testOrigin, "inverter1", 4250)
+	if err != nil {
+		t.Fatalf("Failed to set derating: %s", err)
+	}
+
+	if client.get(1, registers["active_power_fixed_derating"].Address) != 42 {
+		t.Fatalf("Expected the derating to be rounded down to 4.2 kW, got %d", client.get(1, registers["active_power_fixed_derating"].Address))
+	}
+
+	err = m.SetActivePowerPercentage(testOrigin, "inverter1", 50)
+	if err != nil {
+		t.Fatalf("Failed to set derating percentage: %s", err)
+	}
+
+	derating, err := m.GetActivePowerDerating("inverter1")
+	if err != nil {
+		t.Fatalf("Failed to get derating: %s", err)
+	}
+
+	expected := ActivePowerDerating{RatedPower: 10000, MaximumPower: 4200, MaximumPercentage: 50}
+	if derating != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, derating)
+	}
+
+	err = m.SetActivePowerDerating(testOrigin, "inverter1", 12000)
+	if !errors.Is(err, ErrInvalidSetting) {
+		t.Fatalf("Expected a derating above the rated power to be refused, got %v", err)
+	}
+
+	err = m.SetActivePowerPercentage(testOrigin, "inverter1", 120)
+	if !errors.Is(err, ErrInvalidSetting) {
+		t.Fatalf("Expected a percentage above 100 to be refused, got %v", err)
+	}
+
+	// Closing lifts the derating
+	m.Close()
+
+	if client.get(1, registers["active_power_fixed_derating"].Address) != 100 || client.get(1, registers["active_power_percentage_derating"].Address) != 1000 {
+		t.Fatalf("Expected the derating to be lifted on close")
+	}
+}
+
+func TestExportLimitation(t *testing.T) {
+	writeRetryDelay = 0
+
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1})
+	registers := m.profiles[ProfileSun2000].Registers
+
+	limitation := ExportLimitation{Mode: ActivePowerControlLimitedWatts, MaximumPower: 2500}
+	err := m.SetExportLimitation(testOrigin, "inverter1", limitation)
+	if err != nil {
+		t.Fatalf("Failed to set export limitation: %s", err)
+	}
+
+	if len(client.writes) != 2 || client.writes[0].address != registers["maximum_feed_grid_power"].Address || client.writes[1].address != registers["active_power_control_mode"].Address {
+		t.Fatalf("Expected the maximum to be written before the mode, got %+v", client.writes)
+	}
+
+	read, err := m.GetExportLimitation("inverter1")
+	if err != nil {
+		t.Fatalf("Failed to get export limitation: %s", err)
+	}
+
+	if read != limitation {
+		t.Fatalf("Expected %+v, got %+v", limitation, read)
+	}
+
+	tests := []struct {
+		name string
+		limitation ExportLimitation
+	}{
+		{name: "unknown_mode", limitation: ExportLimitation{Mode: 3}},
+		{name: "negative_power", limitation: ExportLimitation{Mode: ActivePowerControlLimitedWatts, MaximumPower: -1}},
+		{name: "percentage", limitation: ExportLimitation{Mode: ActivePowerControlLimitedPercentage, MaximumPercentage: 101}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := m.SetExportLimitation(testOrigin, "inverter1", test.limitation)
+			if !errors.Is(err, ErrInvalidSetting) {
+				t.Fatalf("Expected an invalid setting, got %v", err)
+			}
+		})
+	}
+
+	// Closing reverts the export limitation to the fallback, unlimited by default
+	m.Close()
+
+	if client.get(1, registers["active_power_control_mode"].Address) != uint16(ActivePowerControlUnlimited) {
+		t.Fatalf("Expected the export limitation to be reverted on close")
+	}
+}
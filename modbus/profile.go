@@ -0,0 +1,282 @@
+package modbus
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"embed"
+	"bytes"
+	"strings"
+	"path/filepath"
+
+	"gijs.eu/vonkje/metrics"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	ProfileSun2000 = "sun2000"
+	ProfileLuna2000 = "luna2000"
+	ProfilePowerMeter = "power_meter"
+	// ProfileSunSpec is discovered from the SunSpec models of the device instead of loaded from a file
+	ProfileSunSpec = "sunspec"
+)
+
+//go:embed profiles/*.yaml
+var defaultProfiles embed.FS
+
+// Profile describes the registers of a device and the metrics they are exported as.
+type Profile struct {
+	Name string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	MaxReadGap uint16 `yaml:"max-read-gap"`
+	MaxReadQuantity uint16 `yaml:"max-read-quantity"`
+	Metrics map[string]string `yaml:"metrics"`
+	States map[string]map[uint32]string `yaml:"states"`
+	Registers map[string]Register `yaml:"registers"`
+}
+
+// LoadProfiles loads the built-in device profiles followed by the profiles in directory. A profile in
+// directory replaces the built-in profile with the same name.
+func LoadProfiles(directory string) (map[string]*Profile, error) {
+	profiles := make(map[string]*Profile)
+
+	entries, err := defaultProfiles.ReadDir("profiles")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		data, err := defaultProfiles.ReadFile("profiles/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		profile, err := parseProfile(data, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		profiles[profile.Name] = profile
+	}
+
+	if directory != "" {
+		files, err := filepath.Glob(filepath.Join(directory, "*.yaml"))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+
+			profile, err := parseProfile(data, file)
+			if err != nil {
+				return nil, err
+			}
+
+			profiles[profile.Name] = profile
+		}
+	}
+
+	err = validateProfileMetrics(profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	return profiles, nil
+}
+
+// parseProfile decodes and validates a profile. Unknown keys are rejected so typos do not go unnoticed.
+func parseProfile(data []byte, source string) (*Profile, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	profile := &Profile{}
+	err := decoder.Decode(profile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse profile %s: %w", source, err)
+	}
+
+	for key, register := range profile.Registers {
+		if register.Namespace == "" {
+			register.Namespace = profile.Namespace
+		}
+
+		if register.Fields == nil {
+			register.Fields = map[string]string{}
+		}
+
+		if register.Gain == 0 {
+			register.Gain = 1
+		}
+
+		if register.Quantity == 0 {
+			register.Quantity = registerTypeQuantities[register.Type]
+		}
+
+		if register.StateTable != "" {
+			register.States = profile.States[register.StateTable]
+		}
+
+		profile.Registers[key] = register
+	}
+
+	err = profile.validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid profile %s: %w", source, err)
+	}
+
+	return profile, nil
+}
+
+func (p *Profile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("Profile has no name")
+	}
+
+	if len(p.Registers) == 0 {
+		return fmt.Errorf("Profile %s has no registers", p.Name)
+	}
+
+	if p.MaxReadQuantity > maxReadQuantity {
+		return fmt.Errorf("Profile %s has a max-read-quantity above %d", p.Name, maxReadQuantity)
+	}
+
+	keys := []string{}
+	for key, register := range p.Registers {
+		keys = append(keys, key)
+
+		if register.Namespace == "" || register.Name == "" {
+			return fmt.Errorf("Register %s has no namespace or name", key)
+		}
+
+		if register.Namespace == p.Namespace {
+			if _, ok := p.Metrics[register.Name]; !ok {
+				return fmt.Errorf("Register %s uses metric %s which is not defined in metrics", key, register.Name)
+			}
+		}
+
+		if register.Gain < 0 {
+			return fmt.Errorf("Register %s has a negative gain", key)
+		}
+
+		if !validRegisterQuantity(register.Type, register.Quantity) {
+			return fmt.Errorf("Register %s has invalid quantity %d for type %s", key, register.Quantity, register.Type)
+		}
+
+		if uint32(register.Address) + uint32(register.Quantity) > 0x10000 {
+			return fmt.Errorf("Register %s exceeds the address space", key)
+		}
+
+		err := register.validateStates(p.States)
+		if err != nil {
+			return fmt.Errorf("Register %s %w", key, err)
+		}
+	}
+
+	// Sort by address so overlapping registers are next to each other
+	sort.Slice(keys, func(i, j int) bool {
+		return p.Registers[keys[i]].Address < p.Registers[keys[j]].Address
+	})
+
+	for i := 1; i < len(keys); i++ {
+		previous := p.Registers[keys[i - 1]]
+		if previous.Address + previous.Quantity > p.Registers[keys[i]].Address {
+			return fmt.Errorf("Register %s overlaps register %s", keys[i], keys[i - 1])
+		}
+	}
+
+	return nil
+}
+
+// validateProfileMetrics checks that every register exporting to the same metric uses the same fields.
+func validateProfileMetrics(profiles map[string]*Profile) error {
+	fields := make(map[string]string)
+	origins := make(map[string]string)
+
+	for _, profile := range profiles {
+		for key, register := range profile.Registers {
+			metric := register.Namespace + "_" + register.Name
+			registerFields := strings.Join(register.metricFields(), ",")
+
+			if existing, ok := fields[metric]; ok && existing != registerFields {
+				return fmt.Errorf("Register %s in profile %s has fields [%s] but %s has [%s] for metric %s", key, profile.Name, registerFields, origins[metric], existing, metric)
+			}
+
+			fields[metric] = registerFields
+			origins[metric] = fmt.Sprintf("%s in profile %s", key, profile.Name)
+		}
+	}
+
+	return nil
+}
+
+// metricFields returns the labels of the metric the register is exported as. The text of string
+// registers is exported in the value label.
+func (r Register) metricFields() []string {
+	fields := []string{}
+	for field := range r.Fields {
+		fields = append(fields, field)
+	}
+
+	if r.Type == RegisterTypeString {
+		fields = append(fields, "value")
+	}
+	sort.Strings(fields)
+
+	return append([]string{"inverter"}, fields...)
+}
+
+// validateStates checks that the state table of the register exists and fits the type of the register.
+func (r Register) validateStates(tables map[string]map[uint32]string) error {
+	if r.StateTable == "" {
+		return nil
+	}
+
+	table, ok := tables[r.StateTable]
+	if !ok {
+		return fmt.Errorf("uses state table %s which is not defined in states", r.StateTable)
+	}
+
+	switch r.Type {
+	case RegisterTypeEnum:
+		return nil
+	case RegisterTypeBitfield:
+		for bit := range table {
+			if bit >= uint32(r.Quantity) * 16 {
+				return fmt.Errorf("has state for bit %d which does not fit %d registers", bit, r.Quantity)
+			}
+		}
+
+		return nil
+	}
+
+	return fmt.Errorf("has states but is of type %s instead of enum or bitfield", r.Type)
+}
+
+// registerMetrics adds the metrics of the profile to store, metrics which already exist are kept.
+func (p *Profile) registerMetrics(store *metrics.Store) error {
+	for _, register := range p.Registers {
+		help := p.Metrics[register.Name]
+		if help == "" {
+			help = fmt.Sprintf("The %s", strings.ReplaceAll(register.Name, "_", " "))
+		}
+
+		err := store.AddMetric(register.Namespace, register.Name, help, register.metricFields())
+		if err != nil {
+			return err
+		}
+
+		if register.States != nil {
+			err = store.AddMetric(register.Namespace, register.stateMetric(), help + ", one series per state set to 1 when active", append(register.metricFields(), "state"))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
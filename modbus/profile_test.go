@@ -0,0 +1,87 @@
+package modbus
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadDefaultProfiles(t *testing.T) {
+	profiles, err := LoadProfiles("")
+	if err != nil {
+		t.Fatalf("Failed to load profiles: %s", err)
+	}
+
+	for _, name := range []string{ProfileSun2000, ProfileLuna2000, ProfilePowerMeter} {
+		if _, ok := profiles[name]; !ok {
+			t.Fatalf("Profile %s not found", name)
+		}
+	}
+
+	register := profiles[ProfileSun2000].Registers["grid_frequency"]
+	if register.Namespace != "sun2000" || register.Quantity != 1 || register.Fields == nil {
+		t.Fatalf("Incorrect defaults applied to grid_frequency: %+v", register)
+	}
+
+	status := profiles[ProfileSun2000].Registers["device_status"]
+	if status.States[0x0200] != "On-grid" || status.States[0xa000] != "Standby: no irradiation" {
+		t.Fatalf("Incorrect states resolved for device_status: %+v", status.States)
+	}
+}
+
+func TestParseProfileValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		profile string
+		err string
+	}{
+		{
+			name: "quantity",
+			profile: "name: test\nnamespace: test\nmetrics: {frequency: Frequency}\nregisters:\n  frequency: {name: frequency, address: 100, quantity: 100, type: uint16}\n",
+			err: "quantity 100",
+		},
+		{
+			name: "overlap",
+			profile: "name: test\nnamespace: test\nmetrics: {power: Power, status: Status}\nregisters:\n  power: {name: power, address: 100, type: int32}\n  status: {name: status, address: 101, type: uint16}\n",
+			err: "overlaps",
+		},
+		{
+			name: "type",
+			profile: "name: test\nnamespace: test\nmetrics: {power: Power}\nregisters:\n  power: {name: power, address: 100, type: int64}\n",
+			err: "Unknown register type",
+		},
+		{
+			name: "typo",
+			profile: "name: test\nnamespace: test\nmetrics: {power: Power}\nregisters:\n  power: {name: power, adress: 100, type: int32}\n",
+			err: "adress",
+		},
+		{
+			name: "metric",
+			profile: "name: test\nnamespace: test\nmetrics: {power: Power}\nregisters:\n  power: {name: powr, address: 100, type: int32}\n",
+			err: "not defined",
+		},
+		{
+			name: "state_table",
+			profile: "name: test\nnamespace: test\nmetrics: {status: Status}\nregisters:\n  status: {name: status, address: 100, type: enum, states: status}\n",
+			err: "state table status",
+		},
+		{
+			name: "state_type",
+			profile: "name: test\nnamespace: test\nmetrics: {status: Status}\nstates: {status: {0: Off}}\nregisters:\n  status: {name: status, address: 100, type: uint16, states: status}\n",
+			err: "instead of enum or bitfield",
+		},
+		{
+			name: "state_bit",
+			profile: "name: test\nnamespace: test\nmetrics: {alarm: Alarm}\nstates: {alarm: {16: Fault}}\nregisters:\n  alarm: {name: alarm, address: 100, quantity: 1, type: bitfield, states: alarm}\n",
+			err: "bit 16",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseProfile([]byte(test.profile), test.name)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
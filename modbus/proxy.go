@@ -0,0 +1,234 @@
+package modbus
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"strings"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+	"github.com/simonvetter/modbus"
+)
+
+type ProxyConfig struct {
+	Listen string `mapstructure:"listen"`
+	CacheMaxAge uint `mapstructure:"cache-max-age"`
+	WriteableRegisters []string `mapstructure:"writeable-registers"`
+}
+
+// proxy is a Modbus TCP server sharing a connection with other tools. Reads are answered from the
+// registers polled by Vonkje when they are recent enough and are passed through the request queue of
+// the connection otherwise. Writes are only passed through for whitelisted registers.
+type proxy struct {
+	connection *Connection
+	maxAge time.Duration
+	writeable map[uint8]map[uint16]bool
+	audit *auditTrail
+	dryRun *atomic.Bool
+	logger *logrus.Logger
+}
+
+func newProxy(connection *Connection, profiles map[string]*Profile, readMetricsInterval uint, audit *auditTrail, dryRun *atomic.Bool, logger *logrus.Logger) (*proxy, error) {
+	config := connection.config.Proxy
+
+	maxAge := time.Duration(config.CacheMaxAge) * time.Second
+	if maxAge == 0 {
+		maxAge = 2 * time.Duration(readMetricsInterval) * time.Second
+	}
+
+	p := &proxy{
+		connection: connection,
+		maxAge: maxAge,
+		writeable: make(map[uint8]map[uint16]bool),
+		audit: audit,
+		dryRun: dryRun,
+		logger: logger,
+	}
+
+	for _, name := range config.WriteableRegisters {
+		profileName, key, _ := strings.Cut(name, ".")
+
+		profile, ok := profiles[profileName]
+		if !ok {
+			return nil, fmt.Errorf("Proxy of connection %s allows writes to %s but profile %s does not exist", connection.config.Name, name, profileName)
+		}
+
+		register, ok := profile.Registers[key]
+		if !ok || !register.Writeable {
+			return nil, fmt.Errorf("Proxy of connection %s allows writes to %s which is not a writeable register", connection.config.Name, name)
+		}
+
+		for _, inverter := range connection.config.Inverters {
+			if !inverter.hasProfile(profileName) {
+				continue
+			}
+
+			if p.writeable[inverter.UnitId] == nil {
+				p.writeable[inverter.UnitId] = make(map[uint16]bool)
+			}
+
+			for i := uint16(0); i < register.Quantity; i++ {
+				p.writeable[inverter.UnitId][register.Address + i] = true
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// start serves the proxy until stop is closed.
+func (p *proxy) start(stop <-chan struct{}) error {
+	server, err := modbus.NewServer(&modbus.ServerConfiguration{
+		URL: fmt.Sprintf("tcp://%s", p.connection.config.Proxy.Listen),
+		Timeout: 5 * time.Minute,
+	}, p)
+	if err != nil {
+		return err
+	}
+
+	err = server.Start()
+	if err != nil {
+		return fmt.Errorf("Failed to start proxy of connection %s: %w", p.connection.config.Name, err)
+	}
+
+	p.logger.Infof("Modbus proxy of connection %s listening on tcp://%s", p.connection.config.Name, p.connection.config.Proxy.Listen)
+
+	go func() {
+		<-stop
+		server.Stop()
+	}()
+
+	return nil
+}
+
+func (p *proxy) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (p *proxy) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	return nil, modbus.ErrIllegalFunction
+}
+
+func (p *proxy) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	var values []uint16
+	err := p.connection.execute(priorityPoll, req.UnitId, func(client registerClient) error {
+		var err error
+
+		values, err = client.ReadRegisters(req.Addr, req.Quantity, modbus.INPUT_REGISTER)
+		return err
+	})
+
+	return values, proxyError(err)
+}
+
+func (p *proxy) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if req.IsWrite {
+		return nil, p.write(req)
+	}
+
+	values, ok := p.connection.cache.load(req.UnitId, req.Addr, req.Quantity, time.Now().Add(-p.maxAge))
+	if ok {
+		return values, nil
+	}
+
+	err := p.connection.execute(priorityPoll, req.UnitId, func(client registerClient) error {
+		var err error
+
+		values, err = client.ReadRegisters(req.Addr, req.Quantity, modbus.HOLDING_REGISTER)
+		return err
+	})
+	if err != nil {
+		return nil, proxyError(err)
+	}
+	p.connection.cache.store(req.UnitId, req.Addr, values, time.Now())
+
+	return values, nil
+}
+
+func (p *proxy) write(req *modbus.HoldingRegistersRequest) error {
+	logger := p.logger.WithFields(logrus.Fields{"connection": p.connection.config.Name, "client": req.ClientAddr, "unitId": req.UnitId, "address": req.Addr, "values": req.Args})
+
+	for i := uint16(0); i < req.Quantity; i++ {
+		if !p.writeable[req.UnitId][req.Addr + i] {
+			logger.Warn("Rejected proxy write to a register which is not whitelisted")
+			return modbus.ErrIllegalDataAddress
+		}
+	}
+
+	entry := AuditEntry{
+		Time: time.Now(),
+		UnitId: req.UnitId,
+		Address: req.Addr,
+		NewWords: req.Args,
+		Caller: "proxy",
+		Reason: fmt.Sprintf("Write from %s", req.ClientAddr),
+		Attempts: 1,
+	}
+
+	for _, inverter := range p.connection.config.Inverters {
+		if inverter.UnitId == req.UnitId {
+			entry.Inverter = inverter.Name
+		}
+	}
+
+	// The write is acknowledged so the client carries on like it would with a device
+	if p.dryRun.Load() {
+		entry.DryRun = true
+		entry.Attempts = 0
+		logger.Info("Dry run, not passing proxy write through")
+
+		err := p.audit.record(entry)
+		if err != nil {
+			logger.WithError(err).Error("Failed to record proxy write in the audit trail")
+		}
+
+		return nil
+	}
+
+	err := p.connection.execute(priorityControl, req.UnitId, func(client registerClient) error {
+		old, err := client.ReadRegisters(req.Addr, req.Quantity, modbus.HOLDING_REGISTER)
+		if err != nil {
+			return err
+		}
+		entry.OldWords = old
+
+		return writeWords(client, req.Addr, req.Args)
+	})
+	p.connection.cache.invalidate(req.UnitId, req.Addr, req.Quantity)
+
+	// The client is responsible for checking its own writes, so they are recorded without verification
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	auditErr := p.audit.record(entry)
+	if auditErr != nil {
+		logger.WithError(auditErr).Error("Failed to record proxy write in the audit trail")
+	}
+
+	if err != nil {
+		logger.WithError(err).Warn("Proxy write failed")
+		return proxyError(err)
+	}
+
+	logger.Info("Passed proxy write through")
+
+	return nil
+}
+
+// proxyError returns the exception to answer a failed request with. Exceptions of the device are passed
+// on as is, failures of the connection are reported as a gateway failure.
+func proxyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	for _, deviceErr := range deviceErrors {
+		if errors.Is(err, deviceErr) {
+			return deviceErr
+		}
+	}
+
+	return modbus.ErrGWTargetFailedToRespond
+}
@@ -0,0 +1,209 @@
+package modbus
+
+import (
+	"net"
+	"time"
+	"errors"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/simonvetter/modbus"
+)
+
+func newTestProxy(t *testing.T, client *fakeClient, config ProxyConfig) (*Modbus, *proxy) {
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1}, Inverter{Name: "inverter2", UnitId: 2, Luna2000: true})
+
+	connection := m.connections["test"]
+	connection.config.Proxy = config
+
+	p, err := newProxy(connection, m.profiles, 15, m.audit, &m.dryRun, logrus.New())
+	if err != nil {
+		t.Fatalf("Failed to create proxy: %s", err)
+	}
+
+	return m, p
+}
+
+func TestProxyRead(t *testing.T) {
+	client := newFakeClient()
+	m, p := newTestProxy(t, client, ProxyConfig{})
+
+	profile := m.profiles[ProfileSun2000]
+	address := profile.Registers["active_power"].Address
+	client.set(1, address, 0, 1500)
+
+	_, err := m.updateMetricsRegisters(m.connections["test"], Inverter{Name: "inverter1", UnitId: 1}, profile)
+	if err != nil {
+		t.Fatalf("Failed to update metrics: %s", err)
+	}
+
+	reads := client.reads
+	values, err := p.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: address, Quantity: 2})
+	if err != nil || values[1] != 1500 {
+		t.Fatalf("Expected the polled value, got %v: %v", values, err)
+	}
+
+	if client.reads != reads {
+		t.Fatalf("Expected the read to be answered from the cache")
+	}
+
+	// Addresses which are not polled are read from the bus
+	client.set(1, 30100, 42)
+	values, err = p.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 30100, Quantity: 1})
+	if err != nil || values[0] != 42 {
+		t.Fatalf("Expected the value from the bus, got %v: %v", values, err)
+	}
+
+	if client.reads != reads + 1 {
+		t.Fatalf("Expected the read to be passed through")
+	}
+
+	// Cached values older than the maximum age are read again
+	p.maxAge = 0
+	client.set(1, address, 0, 1600)
+	values, err = p.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: address, Quantity: 2})
+	if err != nil || values[1] != 1600 {
+		t.Fatalf("Expected the value from the bus, got %v: %v", values, err)
+	}
+
+	client.err = errors.New("connection reset")
+	_, err = p.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 30200, Quantity: 1})
+	if err != modbus.ErrGWTargetFailedToRespond {
+		t.Fatalf("Expected a gateway error, got %v", err)
+	}
+}
+
+func TestProxyWrite(t *testing.T) {
+	client := newFakeClient()
+	m, p := newTestProxy(t, client, ProxyConfig{WriteableRegisters: []string{"luna2000.forcible_charge_power_battery_1"}})
+	address := m.profiles[ProfileLuna2000].Registers["forcible_charge_power_battery_1"].Address
+	mode := m.profiles[ProfileLuna2000].Registers["forcible_charge_discharge_battery_1"].Address
+
+	tests := []struct {
+		name string
+		unitId uint8
+		address uint16
+		values []uint16
+		err error
+	}{
+		{name: "whitelisted", unitId: 2, address: address, values: []uint16{0, 2500}},
+		{name: "not_whitelisted", unitId: 2, address: mode, values: []uint16{1}, err: modbus.ErrIllegalDataAddress},
+		{name: "without_battery", unitId: 1, address: address, values: []uint16{0, 2500}, err: modbus.ErrIllegalDataAddress},
+		{name: "partially_whitelisted", unitId: 2, address: address, values: []uint16{0, 2500, 0}, err: modbus.ErrIllegalDataAddress},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client.writes = nil
+
+			_, err := p.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: test.unitId, Addr: test.address, Quantity: uint16(len(test.values)), IsWrite: true, Args: test.values})
+			if err != test.err {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+
+			if test.err != nil && len(client.writes) != 0 {
+				t.Fatalf("Expected no writes, got %+v", client.writes)
+			}
+
+			if test.err == nil && client.get(test.unitId, test.address + 1) != 2500 {
+				t.Fatalf("Expected the write to be passed through")
+			}
+		})
+	}
+}
+
+func TestProxyReadAfterWrite(t *testing.T) {
+	client := newFakeClient()
+	m, p := newTestProxy(t, client, ProxyConfig{})
+	p.maxAge = time.Hour
+
+	inverter := Inverter{Name: "inverter2", UnitId: 2, Luna2000: true}
+	register := m.profiles[ProfileLuna2000].Registers["forcible_charge_power_battery_1"]
+	client.set(2, register.Address, 0, 1000)
+
+	_, err := m.updateMetricsRegisters(m.connections["test"], inverter, m.profiles[ProfileLuna2000])
+	if err != nil {
+		t.Fatalf("Failed to update metrics: %s", err)
+	}
+
+	err = m.writeRegisters(testOrigin, inverter, ProfileLuna2000, []registerWrite{{key: "forcible_charge_power_battery_1", value: 2.5}})
+	if err != nil {
+		t.Fatalf("Failed to write: %s", err)
+	}
+
+	// The written value is served from the cache without reading the bus
+	reads := client.reads
+	values, err := p.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 2, Addr: register.Address, Quantity: 2})
+	if err != nil || values[1] != 2500 {
+		t.Fatalf("Expected the written value, got %v: %v", values, err)
+	}
+
+	if client.reads != reads {
+		t.Fatalf("Expected the read to be answered from the cache")
+	}
+
+	// A failed write leaves the register unknown, so it is read from the bus again
+	client.ignoreWrites = 10
+	err = m.writeRegisters(testOrigin, inverter, ProfileLuna2000, []registerWrite{{key: "forcible_charge_power_battery_1", value: 3}})
+	if err == nil {
+		t.Fatalf("Expected the unconfirmed write to fail")
+	}
+
+	reads = client.reads
+	values, err = p.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 2, Addr: register.Address, Quantity: 2})
+	if err != nil || values[1] != 2500 || client.reads != reads + 1 {
+		t.Fatalf("Expected the register to be read from the bus, got %v: %v", values, err)
+	}
+}
+
+func TestProxyWriteableRegisterValidation(t *testing.T) {
+	m := newTestModbus(newFakeClient())
+
+	for _, name := range []string{"luna2000.running_status_battery_1", "luna2000.unknown", "unknown.register"} {
+		connection := m.connections["test"]
+		connection.config.Proxy = ProxyConfig{WriteableRegisters: []string{name}}
+
+		_, err := newProxy(connection, m.profiles, 15, m.audit, &m.dryRun, logrus.New())
+		if err == nil {
+			t.Fatalf("Expected writes to %s to be rejected", name)
+		}
+	}
+}
+
+func TestProxyTCP(t *testing.T) {
+	client := newFakeClient()
+	client.set(1, 32080, 0, 1234)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %s", err)
+	}
+	listen := listener.Addr().String()
+	listener.Close()
+
+	_, p := newTestProxy(t, client, ProxyConfig{Listen: listen})
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	err = p.start(stop)
+	if err != nil {
+		t.Fatalf("Failed to start proxy: %s", err)
+	}
+
+	tcpClient, err := modbus.NewClient(&modbus.ClientConfiguration{URL: "tcp://" + listen, Timeout: time.Second})
+	if err != nil {
+		t.Fatalf("Failed to create client: %s", err)
+	}
+
+	err = tcpClient.Open()
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer tcpClient.Close()
+
+	value, err := tcpClient.ReadUint32(32080, modbus.HOLDING_REGISTER)
+	if err != nil || value != 1234 {
+		t.Fatalf("Expected 1234, got %d: %v", value, err)
+	}
+}
@@ -0,0 +1,55 @@
+package modbus
+
+import (
+	"sync"
+)
+
+type requestPriority uint8
+
+const (
+	priorityPoll requestPriority = iota
+	priorityControl
+)
+
+// requestQueue gives one request at a time access to a connection. Waiting control requests go before
+// waiting poll requests so writes are not delayed by a long poll cycle.
+type requestQueue struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	busy bool
+	waitingControl int
+}
+
+func newRequestQueue() *requestQueue {
+	q := &requestQueue{}
+	q.cond = sync.NewCond(&q.lock)
+
+	return q
+}
+
+func (q *requestQueue) acquire(priority requestPriority) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if priority == priorityControl {
+		q.waitingControl++
+		for q.busy {
+			q.cond.Wait()
+		}
+		q.waitingControl--
+	} else {
+		for q.busy || q.waitingControl > 0 {
+			q.cond.Wait()
+		}
+	}
+
+	q.busy = true
+}
+
+func (q *requestQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.busy = false
+	q.cond.Broadcast()
+}
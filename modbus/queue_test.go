@@ -0,0 +1,69 @@
+package modbus
+
+import (
+	"sync"
+	"time"
+	"testing"
+)
+
+func TestRequestQueuePriority(t *testing.T) {
+	queue := newRequestQueue()
+	queue.acquire(priorityPoll)
+
+	order := make(chan requestPriority, 2)
+	wg := sync.WaitGroup{}
+
+	for _, priority := range []requestPriority{priorityPoll, priorityControl} {
+		wg.Add(1)
+		go func(priority requestPriority) {
+			defer wg.Done()
+
+			queue.acquire(priority)
+			order <- priority
+			queue.release()
+		}(priority)
+
+		// Make sure the poll request is waiting before the control request
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	queue.release()
+	wg.Wait()
+
+	if <-order != priorityControl {
+		t.Fatalf("Expected the control request to go before the waiting poll request")
+	}
+}
+
+func TestConcurrentWritesUseTheirUnitId(t *testing.T) {
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1, Luna2000: true}, Inverter{Name: "inverter2", UnitId: 2, Luna2000: true})
+
+	wg := sync.WaitGroup{}
+	for _, inverter := range []string{"inverter1", "inverter2"} {
+		wg.Add(1)
+		go func(inverter string) {
+			defer wg.Done()
+
+			watts := uint(1000)
+			if inverter == "inverter2" {
+				watts = 2000
+			}
+
+			for i := 0; i < 50; i++ {
+				err := m.ChangeBatteryForceCharge(testOrigin, inverter, MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, watts, testLimit)
+				if err != nil {
+					t.Errorf("Failed to change force charge: %s", err)
+					return
+				}
+			}
+		}(inverter)
+	}
+	wg.Wait()
+
+	for _, write := range client.writes {
+		if len(write.values) == 2 && write.values[1] != uint16(write.unitId) * 1000 {
+			t.Fatalf("Write of %d went to unit id %d", write.values[1], write.unitId)
+		}
+	}
+}
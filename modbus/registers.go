@@ -1,17 +1,30 @@
 package modbus
 
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
 type RegisterType uint8
 
 type Register struct {
-	Namespace 	string
-	Name 		string
-	Fields 		map[string]string
-	Address 	uint16
-	Unit   		string
-	Gain   		float64
-	Quantity 	uint16
-	Type   		RegisterType
-	Writeable 	bool
+	Namespace 	string `yaml:"namespace"`
+	Name 		string `yaml:"name"`
+	Fields 		map[string]string `yaml:"fields"`
+	Address 	uint16 `yaml:"address"`
+	Unit   		string `yaml:"unit"`
+	Gain   		float64 `yaml:"gain"`
+	Quantity 	uint16 `yaml:"quantity"`
+	Type   		RegisterType `yaml:"type"`
+	Writeable 	bool `yaml:"writeable"`
+	Invert 		bool `yaml:"invert"`
+	StateTable 	string `yaml:"states"`
+	// States are the labels of enum values or of the bits of a bitfield, resolved from StateTable
+	States 		map[uint32]string `yaml:"-"`
+	// sunSpec registers are skipped when they hold the value for a point which is not implemented
+	sunSpec 	bool
 }
 
 const (
@@ -19,72 +32,93 @@ const (
 	RegisterTypeUint32
 	RegisterTypeInt16
 	RegisterTypeInt32
+	RegisterTypeString
+	RegisterTypeBitfield
+	RegisterTypeEnum
+	RegisterTypeTimestamp
 )
 
+var registerTypeNames = map[RegisterType]string{
+	RegisterTypeUint16: "uint16",
+	RegisterTypeUint32: "uint32",
+	RegisterTypeInt16: "int16",
+	RegisterTypeInt32: "int32",
+	RegisterTypeString: "string",
+	RegisterTypeBitfield: "bitfield",
+	RegisterTypeEnum: "enum",
+	RegisterTypeTimestamp: "timestamp",
+}
+
+// registerTypeQuantities is the default amount of 16 bit registers a value of a type occupies.
+// Strings have no default as their length differs per register.
+var registerTypeQuantities = map[RegisterType]uint16{
+	RegisterTypeUint16: 1,
+	RegisterTypeUint32: 2,
+	RegisterTypeInt16: 1,
+	RegisterTypeInt32: 2,
+	RegisterTypeBitfield: 1,
+	RegisterTypeEnum: 1,
+	RegisterTypeTimestamp: 2,
+}
+
 const (
 	MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP uint16 = iota
 	MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE
 	MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE
 )
 
-var (
-	sun2000Registers = map[string]Register{
-		"pv_voltage_string_1": 		Register{Namespace: "sun2000",	Name: "pv_voltage",				Fields: map[string]string{"string": "1"},	Address: 32016, 	Unit: "V", 		Gain: 10, 		Quantity: 1, 	Type: RegisterTypeInt16, 	Writeable: false},
-		"pv_current_string_1": 		Register{Namespace: "sun2000",	Name: "pv_current",				Fields: map[string]string{"string": "1"},	Address: 32017, 	Unit: "A", 		Gain: 100, 		Quantity: 1, 	Type: RegisterTypeInt16, 	Writeable: false},
-		"pv_voltage_string_2": 		Register{Namespace: "sun2000",	Name: "pv_voltage",				Fields: map[string]string{"string": "2"},	Address: 32018, 	Unit: "V", 		Gain: 10, 		Quantity: 1, 	Type: RegisterTypeInt16, 	Writeable: false},
-		"pv_current_string_2": 		Register{Namespace: "sun2000",	Name: "pv_current",				Fields: map[string]string{"string": "2"},	Address: 32019, 	Unit: "A",		Gain: 100,		Quantity: 1, 	Type: RegisterTypeInt16,	Writeable: false},
-		"device_status": 			Register{Namespace: "sun2000",	Name: "device_status",			Fields: map[string]string{},				Address: 32089,		Unit: "",		Gain: 1,		Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"input_power": 				Register{Namespace: "sun2000",	Name: "input_power",			Fields: map[string]string{},				Address: 32064,		Unit: "kW",		Gain: 1000,		Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_voltage_phase_a": 	Register{Namespace: "sun2000",	Name: "phase_voltage",			Fields: map[string]string{"phase": "A"},	Address: 32069,		Unit: "V",		Gain: 10, 		Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"phase_voltage_phase_b": 	Register{Namespace: "sun2000",	Name: "phase_voltage",			Fields: map[string]string{"phase": "B"},	Address: 32070,		Unit: "V",		Gain: 10, 		Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"phase_voltage_phase_c": 	Register{Namespace: "sun2000",	Name: "phase_voltage",			Fields: map[string]string{"phase": "C"},	Address: 32071,		Unit: "V",		Gain: 10, 		Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"phase_current_phase_a": 	Register{Namespace: "sun2000",	Name: "phase_current",			Fields: map[string]string{"phase": "A"},	Address: 32072,		Unit: "A",		Gain: 1000, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_current_phase_b": 	Register{Namespace: "sun2000",	Name: "phase_current",			Fields: map[string]string{"phase": "B"},	Address: 32074,		Unit: "A",		Gain: 1000, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_current_phase_c": 	Register{Namespace: "sun2000",	Name: "phase_current",			Fields: map[string]string{"phase": "C"},	Address: 32076,		Unit: "A",		Gain: 1000, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"active_power": 			Register{Namespace: "sun2000",	Name: "active_power",			Fields: map[string]string{},				Address: 32080,		Unit: "kW",		Gain: 1000, 	Quantity: 2,	Type: RegisterTypeInt32, 	Writeable: false},
-		"reactive_power": 			Register{Namespace: "sun2000",	Name: "reactive_power",			Fields: map[string]string{},				Address: 32082,		Unit: "kVar",	Gain: 1000,		Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"power_factor": 			Register{Namespace: "sun2000",	Name: "power_factor",			Fields: map[string]string{},				Address: 32084, 	Unit: "",		Gain: 1000,		Quantity: 1,	Type: RegisterTypeInt16,	Writeable: false},
-		"grid_frequency": 			Register{Namespace: "sun2000",	Name: "grid_frequency",			Fields: map[string]string{},				Address: 32085, 	Unit: "Hz",		Gain: 100,		Quantity: 100,	Type: RegisterTypeUint16,	Writeable: false},
-		"inverter_efficiency": 		Register{Namespace: "sun2000",	Name: "inverter_efficiency",	Fields: map[string]string{},				Address: 32086, 	Unit: "%",		Gain: 100,		Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"cabinet_temperature": 		Register{Namespace: "sun2000",	Name: "cabinet_temperature",	Fields: map[string]string{},				Address: 32087, 	Unit: "°C",		Gain: 10,		Quantity: 1,	Type: RegisterTypeInt16,	Writeable: false},
-		"isulation_resistance": 	Register{Namespace: "sun2000",	Name: "isulation_resistance",	Fields: map[string]string{},				Address: 32088, 	Unit: "MΩ",		Gain: 1000,		Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},	
+const (
+	MODBUS_STATE_BATTERY_FORCIBLE_SETTING_MODE_DURATION uint16 = iota
+	MODBUS_STATE_BATTERY_FORCIBLE_SETTING_MODE_SOC
+)
+
+// validRegisterQuantity returns whether a value of the type can occupy quantity registers. Timestamps
+// are seconds since the epoch as used by Huawei, bitfields are 16 or 32 bits wide.
+func validRegisterQuantity(t RegisterType, quantity uint16) bool {
+	switch t {
+	case RegisterTypeString:
+		return quantity > 0
+	case RegisterTypeBitfield:
+		return quantity == 1 || quantity == 2
 	}
 
-	luna2000Registers = map[string]Register{
-		"charge_discharge_power":				Register{Namespace: "luna2000",	Name: "charge_discharge_power",		Fields: map[string]string{},				Address: 37765,	Unit: "W",		Gain: 1,	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"running_status_battery_1": 			Register{Namespace: "luna2000",	Name: "running_status",				Fields: map[string]string{"battery": "1"},	Address: 37000, Unit: "",		Gain: 1,	Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"charging_status_battery_1": 			Register{Namespace: "luna2000",	Name: "charging_status",			Fields: map[string]string{"battery": "1"},	Address: 37001,	Unit: "W",		Gain: 1,	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"bus_voltage_battery_1": 				Register{Namespace: "luna2000",	Name: "bus_voltage",				Fields: map[string]string{"battery": "1"},	Address: 37003,	Unit: "V",		Gain: 10,	Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"battery_capacity_battery_1": 			Register{Namespace: "luna2000",	Name: "battery_capacity",			Fields: map[string]string{"battery": "1"},	Address: 37004,	Unit: "%",		Gain: 10,	Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"total_charge_battery_1": 				Register{Namespace: "luna2000",	Name: "total_charge",				Fields: map[string]string{"battery": "1"},	Address: 37066,	Unit: "kWh",	Gain: 100,	Quantity: 2,	Type: RegisterTypeUint32,	Writeable: false},
-		"total_discharge_battery_1": 			Register{Namespace: "luna2000",	Name: "total_discharge",			Fields: map[string]string{"battery": "1"},	Address: 37068,	Unit: "kWh",	Gain: 100,	Quantity: 2,	Type: RegisterTypeUint32,	Writeable: false},
-		"forcible_charge_discharge_battery_1": 	Register{Namespace: "luna2000",	Name: "forcible_charge_discharge",	Fields: map[string]string{"battery": "1"},	Address: 47100,	Unit: "",		Gain: 1,	Quantity: 1,	Type: RegisterTypeUint16,	Writeable: true},
-		"forcible_charge_power_battery_1": 		Register{Namespace: "luna2000",	Name: "forcible_charge_power",		Fields: map[string]string{"battery": "1"},	Address: 47247,	Unit: "kW",		Gain: 1000,	Quantity: 2,	Type: RegisterTypeUint32,	Writeable: true},
-		"forcible_discharge_power_battery_1": 	Register{Namespace: "luna2000",	Name: "forcible_discharge_power",	Fields: map[string]string{"battery": "1"},	Address: 47249,	Unit: "kW",		Gain: 1000,	Quantity: 2,	Type: RegisterTypeUint32,	Writeable: true},
-		"maximum_charge_power_battery":			Register{Namespace: "luna2000",	Name: "maximum_charge_power",		Fields: map[string]string{"battery": "1"},	Address: 47075,	Unit: "W",		Gain: 1,	Quantity: 2,	Type: RegisterTypeUint32,	Writeable: true},
-		"maximum_discharge_power_battery":		Register{Namespace: "luna2000",	Name: "maximum_discharge_power",	Fields: map[string]string{"battery": "1"},	Address: 47077,	Unit: "W",		Gain: 1,	Quantity: 2,	Type: RegisterTypeUint32,	Writeable: true},
+	return quantity == registerTypeQuantities[t]
+}
+
+func (t RegisterType) String() string {
+	if name, ok := registerTypeNames[t]; ok {
+		return name
 	}
 
-	powerMeterRegisters = map[string]Register{
-		"status": 						Register{Namespace: "power_meter",	Name: "status",							Fields: map[string]string{},				Address: 37100,	Unit: "",		Gain: 1,	Quantity: 1,	Type: RegisterTypeUint16,	Writeable: false},
-		"phase_voltage_phase_a": 		Register{Namespace: "power_meter",	Name: "phase_voltage",					Fields: map[string]string{"phase": "A"},	Address: 37101,	Unit: "V",		Gain: 10, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_voltage_phase_b": 		Register{Namespace: "power_meter",	Name: "phase_voltage",					Fields: map[string]string{"phase": "B"},	Address: 37103,	Unit: "V",		Gain: 10, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_voltage_phase_c": 		Register{Namespace: "power_meter",	Name: "phase_voltage",					Fields: map[string]string{"phase": "C"},	Address: 37105,	Unit: "V",		Gain: 10, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_current_phase_a": 		Register{Namespace: "power_meter",	Name: "phase_current",					Fields: map[string]string{"phase": "A"},	Address: 37107,	Unit: "A",		Gain: 100, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_current_phase_b": 		Register{Namespace: "power_meter",	Name: "phase_current",					Fields: map[string]string{"phase": "B"},	Address: 37109,	Unit: "A",		Gain: 100, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_current_phase_c": 		Register{Namespace: "power_meter",	Name: "phase_current",					Fields: map[string]string{"phase": "C"},	Address: 37111,	Unit: "A",		Gain: 100, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"active_power": 				Register{Namespace: "power_meter",	Name: "active_power",					Fields: map[string]string{},				Address: 37113, Unit: "W",		Gain: 1, 	Quantity: 2, 	Type: RegisterTypeInt32, 	Writeable: false},
-		"reactive_power": 				Register{Namespace: "power_meter",	Name: "reactive_power",					Fields: map[string]string{},				Address: 37115, Unit: "Var",	Gain: 1, 	Quantity: 2, 	Type: RegisterTypeInt32,	Writeable: false},
-		"power_factor": 				Register{Namespace: "power_meter",	Name: "power_factor",					Fields: map[string]string{},				Address: 37117, Unit: "",		Gain: 1000,	Quantity: 1,	Type: RegisterTypeInt16, 	Writeable: false},
-		"frequency": 					Register{Namespace: "power_meter",	Name: "frequency",						Fields: map[string]string{},				Address: 37118,	Unit: "Hz",		Gain: 100,	Quantity: 1,	Type: RegisterTypeInt16,	Writeable: false},
-		"positive_active_electricity": 	Register{Namespace: "power_meter",	Name: "positive_active_electricity",	Fields: map[string]string{},				Address: 37119,	Unit: "kWh",	Gain: 100, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"reverse_active_power": 		Register{Namespace: "power_meter",	Name: "reverse_active_power",			Fields: map[string]string{},				Address: 37121, Unit: "kWh", 	Gain: 100,	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"accumulated_reactive_power": 	Register{Namespace: "power_meter",	Name: "accumulated_reactive_power",		Fields: map[string]string{},				Address: 37123,	Unit: "kVarh",	Gain: 100,	Quantity: 2,	Type: RegisterTypeInt32, 	Writeable: false},
-		"line_voltage_line_ab": 		Register{Namespace: "power_meter",	Name: "line_voltage",					Fields: map[string]string{"line": "AB"},	Address: 37126,	Unit: "V", 		Gain: 10, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"line_voltage_line_bc": 		Register{Namespace: "power_meter",	Name: "line_voltage",					Fields: map[string]string{"line": "BC"},	Address: 37128,	Unit: "V", 		Gain: 10, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"line_voltage_line_ca": 		Register{Namespace: "power_meter",	Name: "line_voltage",					Fields: map[string]string{"line": "CA"},	Address: 37130,	Unit: "V", 		Gain: 10, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_active_power_phase_a": 	Register{Namespace: "power_meter",	Name: "phase_active_power",				Fields: map[string]string{"phase": "A"},	Address: 37132,	Unit: "W", 		Gain: 1, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_active_power_phase_b": 	Register{Namespace: "power_meter",	Name: "phase_active_power",				Fields: map[string]string{"phase": "B"},	Address: 37134,	Unit: "W", 		Gain: 1, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
-		"phase_active_power_phase_c": 	Register{Namespace: "power_meter",	Name: "phase_active_power",				Fields: map[string]string{"phase": "C"},	Address: 37136,	Unit: "W", 		Gain: 1, 	Quantity: 2,	Type: RegisterTypeInt32,	Writeable: false},
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+func (t *RegisterType) UnmarshalYAML(value *yaml.Node) error {
+	registerType, err := parseRegisterType(value.Value)
+	if err != nil {
+		return fmt.Errorf("%w on line %d", err, value.Line)
 	}
-)
+
+	*t = registerType
+	return nil
+}
+
+func parseRegisterType(name string) (RegisterType, error) {
+	for registerType, typeName := range registerTypeNames {
+		if typeName == name {
+			return registerType, nil
+		}
+	}
+
+	return 0, fmt.Errorf("Unknown register type %s", name)
+}
+
+// registerTypeList returns the names of all register types.
+func registerTypeList() string {
+	names := []string{}
+	for registerType := RegisterTypeUint16; registerType <= RegisterTypeTimestamp; registerType++ {
+		names = append(names, registerType.String())
+	}
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,254 @@
+package modbus
+
+import (
+	"fmt"
+	"time"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	callerShutdown = "shutdown"
+	callerWatchdog = "watchdog"
+)
+
+var ErrShuttingDown = fmt.Errorf("Modbus is shutting down, refusing to write")
+
+// watchdogState tracks the last forcible battery command so the watchdog can revert it when the control
+// loop stops sending commands.
+type watchdogState struct {
+	lastCommand time.Time
+	active bool
+}
+
+// fallbackWorkingMode returns the working mode value configured to fall back to, or false when the working
+// mode is left alone. The mode is either the label of a working mode state or its number.
+func (m *Modbus) fallbackWorkingMode() (uint16, bool, error) {
+	if m.config.FallbackWorkingMode == "" {
+		return 0, false, nil
+	}
+
+	register := m.profiles[ProfileLuna2000].Registers["working_mode"]
+	for value, label := range register.States {
+		if strings.EqualFold(label, m.config.FallbackWorkingMode) {
+			return uint16(value), true, nil
+		}
+	}
+
+	value, err := strconv.ParseUint(m.config.FallbackWorkingMode, 10, 16)
+	if err != nil {
+		return 0, false, fmt.Errorf("Unknown fallback working mode %q", m.config.FallbackWorkingMode)
+	}
+
+	return uint16(value), true, nil
+}
+
+// FallbackExportLimitationConfig is the grid export limitation SafeState reverts the inverters to. The mode
+// is a label of the active_power_control_mode states of the sun2000 profile or its number, unlimited when
+// empty. The maximum power in watts and percentage apply to the power-limited modes.
+type FallbackExportLimitationConfig struct {
+	Mode string `mapstructure:"mode"`
+	MaximumPower int `mapstructure:"maximum-power"`
+	MaximumPercentage float64 `mapstructure:"maximum-percentage"`
+}
+
+// fallbackExportLimitation returns the export limitation configured to fall back to.
+func (m *Modbus) fallbackExportLimitation() (ExportLimitation, error) {
+	config := m.config.FallbackExportLimitation
+	limitation := ExportLimitation{
+		Mode: ActivePowerControlUnlimited,
+		MaximumPower: config.MaximumPower,
+		MaximumPercentage: config.MaximumPercentage,
+	}
+
+	if config.MaximumPower < 0 || config.MaximumPercentage < 0 || config.MaximumPercentage > 100 {
+		return ExportLimitation{}, fmt.Errorf("%w: fallback export limitation maximum out of range", ErrInvalidSetting)
+	}
+
+	if config.Mode == "" {
+		return limitation, nil
+	}
+
+	register := m.profiles[ProfileSun2000].Registers["active_power_control_mode"]
+	for value, label := range register.States {
+		if strings.EqualFold(label, config.Mode) {
+			limitation.Mode = ActivePowerControlMode(value)
+			return limitation, nil
+		}
+	}
+
+	value, err := strconv.ParseUint(config.Mode, 10, 16)
+	if err != nil {
+		return ExportLimitation{}, fmt.Errorf("Unknown fallback export limitation mode %q", config.Mode)
+	}
+
+	if _, ok := register.States[uint32(value)]; !ok {
+		return ExportLimitation{}, fmt.Errorf("Unknown fallback export limitation mode %q", config.Mode)
+	}
+
+	limitation.Mode = ActivePowerControlMode(value)
+
+	return limitation, nil
+}
+
+// exportLimitationDiffers returns whether the inverter runs another export limitation than expected, the
+// maximum only matters in the mode using it.
+func exportLimitationDiffers(current ExportLimitation, expected ExportLimitation) bool {
+	if current.Mode != expected.Mode {
+		return true
+	}
+
+	switch expected.Mode {
+	case ActivePowerControlLimitedWatts:
+		return current.MaximumPower != expected.MaximumPower
+	case ActivePowerControlLimitedPercentage:
+		return current.MaximumPercentage != expected.MaximumPercentage
+	}
+
+	return false
+}
+
+// revertPowerLimit lifts the active power derating and reverts the export limitation to the fallback when
+// the registers of the inverter show otherwise. The registers are read instead of remembering what was
+// written, so limits set before a restart or by hand are reverted as well.
+func (m *Modbus) revertPowerLimit(origin WriteOrigin, inverter string, fallback ExportLimitation) error {
+	derating, err := m.GetActivePowerDerating(inverter)
+	if err != nil {
+		return err
+	}
+
+	if derating.derated() {
+		err = m.ResetActivePowerDerating(origin, inverter)
+		if err != nil {
+			return err
+		}
+	}
+
+	limitation, err := m.GetExportLimitation(inverter)
+	if err != nil {
+		return err
+	}
+
+	if exportLimitationDiffers(limitation, fallback) {
+		return m.SetExportLimitation(origin, inverter, fallback)
+	}
+
+	return nil
+}
+
+// SafeState lifts the active power derating, reverts the export limitation to the fallback, stops the
+// forcible charge or discharge of every battery and sets the fallback working mode when one is configured.
+// All inverters are attempted even when one of them fails.
+func (m *Modbus) SafeState(origin WriteOrigin) error {
+	exportLimitation, err := m.fallbackExportLimitation()
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, connection := range m.connections {
+		for _, inverter := range connection.config.Inverters {
+			if !inverter.hasProfile(ProfileSun2000) {
+				continue
+			}
+
+			err := m.revertPowerLimit(origin, inverter.Name, exportLimitation)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	errs = append(errs, m.stopBatteries(origin))
+
+	return errors.Join(errs...)
+}
+
+// stopBatteries stops the forcible charge or discharge of every battery and sets the fallback working mode
+// when one is configured. Power limits are left alone, the watchdog only reverts the battery commands it
+// guards. All inverters are attempted even when one of them fails.
+func (m *Modbus) stopBatteries(origin WriteOrigin) error {
+	workingMode, setWorkingMode, err := m.fallbackWorkingMode()
+	if err != nil {
+		return err
+	}
+
+	errs := []error{}
+	for _, connection := range m.connections {
+		for _, inverter := range connection.config.Inverters {
+			if !inverter.hasProfile(ProfileLuna2000) {
+				continue
+			}
+
+			err := m.ChangeBatteryForceCharge(origin, inverter.Name, MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP, 0, ForceChargeLimit{})
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+
+			if setWorkingMode {
+				err = m.writeRegisters(origin, inverter, ProfileLuna2000, []registerWrite{{key: "working_mode", value: float64(workingMode)}})
+				if err != nil {
+					errs = append(errs, err)
+				}
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// recordCommand arms the watchdog after a forcible command and disarms it when the battery is stopped.
+func (m *Modbus) recordCommand(state uint16) {
+	m.watchdogLock.Lock()
+	defer m.watchdogLock.Unlock()
+
+	m.watchdog.lastCommand = time.Now()
+	m.watchdog.active = state != MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP
+}
+
+// startWatchdog stops the batteries when no command was sent for the configured amount
+// of intervals while a forcible command is active.
+func (m *Modbus) startWatchdog() {
+	interval := time.Duration(m.config.ReadMetricsInterval) * time.Second
+	if m.config.WatchdogIntervals == 0 || interval == 0 {
+		return
+	}
+
+	m.logger.WithFields(logrus.Fields{"intervals": m.config.WatchdogIntervals}).Info("Starting battery command watchdog")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.checkWatchdog(now)
+		}
+	}
+}
+
+func (m *Modbus) checkWatchdog(now time.Time) {
+	timeout := time.Duration(m.config.WatchdogIntervals * m.config.ReadMetricsInterval) * time.Second
+
+	m.watchdogLock.Lock()
+	expired := m.watchdog.active && now.Sub(m.watchdog.lastCommand) > timeout
+	lastCommand := m.watchdog.lastCommand
+	m.watchdogLock.Unlock()
+
+	if !expired {
+		return
+	}
+
+	m.logger.WithFields(logrus.Fields{"lastCommand": lastCommand}).Warn("No battery command within the watchdog timeout, reverting batteries")
+
+	err := m.stopBatteries(WriteOrigin{Caller: callerWatchdog, Reason: fmt.Sprintf("No battery command since %s", lastCommand.Format(time.RFC3339))})
+	if err != nil {
+		m.errChannel <- err
+	}
+}
@@ -0,0 +1,199 @@
+package modbus
+
+import (
+	"time"
+	"errors"
+	"testing"
+)
+
+func TestCloseRevertsBatteries(t *testing.T) {
+	writeRetryDelay = 0
+
+	tests := []struct {
+		name string
+		fallback string
+		workingMode uint16
+	}{
+		{name: "stop", fallback: "", workingMode: 1},
+		{name: "label", fallback: "maximise self consumption", workingMode: 2},
+		{name: "number", fallback: "5", workingMode: 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeClient()
+			m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1}, Inverter{Name: "inverter2", UnitId: 2, Luna2000: true})
+			m.config.FallbackWorkingMode = test.fallback
+
+			registers := m.profiles[ProfileLuna2000].Registers
+			client.set(2, registers["working_mode"].Address, 1)
+			setNotDerated(m, client, 1)
+			setNotDerated(m, client, 2)
+
+			err := m.ChangeBatteryForceCharge(testOrigin, "inverter2", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE, 2000, testLimit)
+			if err != nil {
+				t.Fatalf("Failed to change force charge: %s", err)
+			}
+
+			m.Close()
+
+			if client.get(2, registers["forcible_charge_discharge_battery_1"].Address) != MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP {
+				t.Fatalf("Expected the battery to be stopped")
+			}
+
+			if client.get(2, registers["working_mode"].Address) != test.workingMode {
+				t.Fatalf("Expected working mode %d, got %d", test.workingMode, client.get(2, registers["working_mode"].Address))
+			}
+
+			for _, write := range client.writes {
+				if write.unitId != 2 {
+					t.Fatalf("Expected only the inverter with a battery to be written, got unit id %d", write.unitId)
+				}
+			}
+
+			err = m.ChangeBatteryForceCharge(testOrigin, "inverter2", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, 2000, testLimit)
+			if !errors.Is(err, ErrShuttingDown) {
+				t.Fatalf("Expected writes after closing to be refused, got %v", err)
+			}
+		})
+	}
+}
+
+// setNotDerated sets the registers of a 10 kW inverter running at its rated power without export limitation.
+func setNotDerated(m *Modbus, client *fakeClient, unitId uint8) {
+	registers := m.profiles[ProfileSun2000].Registers
+	client.set(unitId, registers["rated_power"].Address, 0, 10000)
+	client.set(unitId, registers["active_power_fixed_derating"].Address, 100)
+	client.set(unitId, registers["active_power_percentage_derating"].Address, 1000)
+}
+
+func TestSafeStateRevertsPowerLimit(t *testing.T) {
+	writeRetryDelay = 0
+
+	tests := []struct {
+		name string
+		fallback FallbackExportLimitationConfig
+		expected ExportLimitation
+	}{
+		{name: "unlimited", expected: ExportLimitation{Mode: ActivePowerControlUnlimited}},
+		{name: "label", fallback: FallbackExportLimitationConfig{Mode: "zero power grid connection"}, expected: ExportLimitation{Mode: ActivePowerControlZeroExport}},
+		{name: "watts", fallback: FallbackExportLimitationConfig{Mode: "6", MaximumPower: 2500}, expected: ExportLimitation{Mode: ActivePowerControlLimitedWatts, MaximumPower: 2500}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := newFakeClient()
+			m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1})
+			m.config.FallbackExportLimitation = test.fallback
+			registers := m.profiles[ProfileSun2000].Registers
+
+			// Limits left by an earlier run, this Modbus did not write them
+			setNotDerated(m, client, 1)
+			client.set(1, registers["active_power_percentage_derating"].Address, 500)
+			client.set(1, registers["active_power_control_mode"].Address, uint16(ActivePowerControlLimitedWatts))
+			client.set(1, registers["maximum_feed_grid_power"].Address, 0, 1000)
+
+			err := m.SafeState(testOrigin)
+			if err != nil {
+				t.Fatalf("Failed to enter the safe state: %s", err)
+			}
+
+			derating, err := m.GetActivePowerDerating("inverter1")
+			if err != nil || derating.derated() {
+				t.Fatalf("Expected the derating to be lifted, got %+v, %v", derating, err)
+			}
+
+			limitation, err := m.GetExportLimitation("inverter1")
+			if err != nil || exportLimitationDiffers(limitation, test.expected) {
+				t.Fatalf("Expected export limitation %+v, got %+v, %v", test.expected, limitation, err)
+			}
+
+			// Registers already in the safe state are not written again
+			writes := len(client.writes)
+			err = m.SafeState(testOrigin)
+			if err != nil || len(client.writes) != writes {
+				t.Fatalf("Expected no writes in the safe state, got %d, %v", len(client.writes) - writes, err)
+			}
+		})
+	}
+}
+
+func TestFallbackExportLimitationValidation(t *testing.T) {
+	tests := []struct {
+		name string
+		fallback FallbackExportLimitationConfig
+	}{
+		{name: "label", fallback: FallbackExportLimitationConfig{Mode: "unknown"}},
+		{name: "number", fallback: FallbackExportLimitationConfig{Mode: "3"}},
+		{name: "percentage", fallback: FallbackExportLimitationConfig{Mode: "7", MaximumPercentage: 120}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := newTestModbus(newFakeClient())
+			m.config.FallbackExportLimitation = test.fallback
+
+			_, err := m.fallbackExportLimitation()
+			if err == nil {
+				t.Fatalf("Expected an error for %+v", test.fallback)
+			}
+		})
+	}
+}
+
+func TestFallbackWorkingModeValidation(t *testing.T) {
+	m := newTestModbus(newFakeClient())
+	m.config.FallbackWorkingMode = "unknown"
+
+	_, _, err := m.fallbackWorkingMode()
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown working mode")
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	writeRetryDelay = 0
+
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1, Luna2000: true})
+	m.config.ReadMetricsInterval = 10
+	m.config.WatchdogIntervals = 3
+	mode := m.profiles[ProfileLuna2000].Registers["forcible_charge_discharge_battery_1"].Address
+
+	// Curtailment of the export limit, which the watchdog does not guard
+	registers := m.profiles[ProfileSun2000].Registers
+	setNotDerated(m, client, 1)
+	client.set(1, registers["active_power_percentage_derating"].Address, 500)
+	client.set(1, registers["active_power_control_mode"].Address, uint16(ActivePowerControlZeroExport))
+
+	err := m.ChangeBatteryForceCharge(testOrigin, "inverter1", MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, 2000, testLimit)
+	if err != nil {
+		t.Fatalf("Failed to change force charge: %s", err)
+	}
+
+	m.checkWatchdog(time.Now().Add(20 * time.Second))
+	if client.get(1, mode) != MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE {
+		t.Fatalf("Expected the battery to keep charging within the timeout")
+	}
+
+	m.checkWatchdog(time.Now().Add(time.Minute))
+	if client.get(1, mode) != MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP {
+		t.Fatalf("Expected the watchdog to stop the battery")
+	}
+
+	if client.get(1, registers["active_power_percentage_derating"].Address) != 500 || client.get(1, registers["active_power_control_mode"].Address) != uint16(ActivePowerControlZeroExport) {
+		t.Fatalf("Expected the watchdog to leave the power limits alone")
+	}
+
+	entries, _ := m.GetAuditEntries(AuditFilter{Caller: callerWatchdog})
+	if len(entries) == 0 {
+		t.Fatalf("Expected the watchdog writes in the audit trail")
+	}
+
+	// A stopped battery does not need reverting again
+	writes := len(client.writes)
+	m.checkWatchdog(time.Now().Add(time.Hour))
+	if len(client.writes) != writes {
+		t.Fatalf("Expected the watchdog to be disarmed after reverting")
+	}
+}
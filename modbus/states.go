@@ -0,0 +1,192 @@
+package modbus
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxStateChanges is the amount of state changes kept for the API.
+const maxStateChanges = 100
+
+// State is the decoded value of an enum or bitfield register of an inverter.
+type State struct {
+	Inverter string `json:"inverter"`
+	Namespace string `json:"namespace"`
+	Register string `json:"register"`
+	Fields map[string]string `json:"fields"`
+	Value uint32 `json:"value"`
+	Text string `json:"text"`
+	Active []string `json:"active"`
+	Since time.Time `json:"since"`
+}
+
+// StateChange is emitted when the decoded value of a register changes.
+type StateChange struct {
+	Inverter string `json:"inverter"`
+	Namespace string `json:"namespace"`
+	Register string `json:"register"`
+	Fields map[string]string `json:"fields"`
+	From string `json:"from"`
+	To string `json:"to"`
+	Time time.Time `json:"time"`
+}
+
+// stateMetric returns the name of the one-hot metric of a register with states.
+func (r Register) stateMetric() string {
+	return r.Name + "_state"
+}
+
+// activeStates returns the labels of value. An enum has a single label, a bitfield has a label for every
+// set bit. Values without a label are named after their number so they still show up.
+func (r Register) activeStates(value uint32) []string {
+	if r.Type == RegisterTypeEnum {
+		if label, ok := r.States[value]; ok {
+			return []string{label}
+		}
+
+		return []string{fmt.Sprintf("Unknown (0x%04X)", value)}
+	}
+
+	active := []string{}
+	for bit := uint32(0); bit < uint32(r.Quantity) * 16; bit++ {
+		if value & (1 << bit) == 0 {
+			continue
+		}
+
+		if label, ok := r.States[bit]; ok {
+			active = append(active, label)
+		} else {
+			active = append(active, fmt.Sprintf("Bit %d", bit))
+		}
+	}
+
+	return active
+}
+
+// stateText returns the active states as a single human readable text.
+func stateText(active []string) string {
+	if len(active) == 0 {
+		return "None"
+	}
+
+	return strings.Join(active, ", ")
+}
+
+// updateState sets the one-hot state metric of the register and records a state change when the value
+// differs from the previous read.
+func (m *Modbus) updateState(inverter Inverter, key string, register Register, fields map[string]string, value uint32) {
+	active := register.activeStates(value)
+
+	labels := make(map[string]bool)
+	for _, label := range register.States {
+		labels[label] = false
+	}
+
+	for _, label := range active {
+		labels[label] = true
+	}
+
+	for label, isActive := range labels {
+		stateFields := map[string]string{"state": label}
+		for k, v := range fields {
+			stateFields[k] = v
+		}
+
+		metricValue := 0.0
+		if isActive {
+			metricValue = 1
+		}
+
+		m.metrics.SetMetricValue(register.Namespace, register.stateMetric(), stateFields, metricValue)
+	}
+
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	if m.states == nil {
+		m.states = make(map[string]*State)
+	}
+
+	id := fmt.Sprintf("%s/%s/%s", inverter.Name, register.Namespace, key)
+	previous, ok := m.states[id]
+	if ok && previous.Value == value {
+		return
+	}
+
+	now := time.Now()
+	state := &State{
+		Inverter: inverter.Name,
+		Namespace: register.Namespace,
+		Register: key,
+		Fields: register.Fields,
+		Value: value,
+		Text: stateText(active),
+		Active: active,
+		Since: now,
+	}
+	m.states[id] = state
+
+	// The first read is not a change
+	if !ok {
+		return
+	}
+
+	change := StateChange{
+		Inverter: inverter.Name,
+		Namespace: register.Namespace,
+		Register: key,
+		Fields: register.Fields,
+		From: previous.Text,
+		To: state.Text,
+		Time: now,
+	}
+
+	m.stateChanges = append(m.stateChanges, change)
+	if len(m.stateChanges) > maxStateChanges {
+		m.stateChanges = m.stateChanges[len(m.stateChanges) - maxStateChanges:]
+	}
+
+	logger := m.logger.WithFields(logrus.Fields{"inverter": inverter.Name, "register": key, "from": change.From, "to": change.To})
+	if register.Type == RegisterTypeBitfield && value != 0 {
+		logger.Warn("State changed")
+	} else {
+		logger.Info("State changed")
+	}
+}
+
+// GetStates returns the current decoded states of all inverters.
+func (m *Modbus) GetStates() []State {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	states := []State{}
+	for _, state := range m.states {
+		states = append(states, *state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Inverter != states[j].Inverter {
+			return states[i].Inverter < states[j].Inverter
+		}
+
+		if states[i].Namespace != states[j].Namespace {
+			return states[i].Namespace < states[j].Namespace
+		}
+
+		return states[i].Register < states[j].Register
+	})
+
+	return states
+}
+
+// GetStateChanges returns the most recent state changes, oldest first.
+func (m *Modbus) GetStateChanges() []StateChange {
+	m.stateLock.Lock()
+	defer m.stateLock.Unlock()
+
+	return append([]StateChange{}, m.stateChanges...)
+}
@@ -0,0 +1,94 @@
+package modbus
+
+import (
+	"testing"
+
+)
+
+func TestActiveStates(t *testing.T) {
+	enum := Register{Type: RegisterTypeEnum, Quantity: 1, States: map[uint32]string{0x0200: "On-grid"}}
+	bitfield := Register{Type: RegisterTypeBitfield, Quantity: 1, States: map[uint32]string{2: "String reverse connection"}}
+
+	tests := []struct {
+		name string
+		register Register
+		value uint32
+		expected string
+	}{
+		{name: "enum", register: enum, value: 0x0200, expected: "On-grid"},
+		{name: "enum_unknown", register: enum, value: 0x0abc, expected: "Unknown (0x0ABC)"},
+		{name: "bitfield_none", register: bitfield, value: 0, expected: "None"},
+		{name: "bitfield", register: bitfield, value: 0x0004, expected: "String reverse connection"},
+		{name: "bitfield_unknown", register: bitfield, value: 0x8004, expected: "String reverse connection, Bit 15"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text := stateText(test.register.activeStates(test.value))
+			if text != test.expected {
+				t.Fatalf("Expected %q, got %q", test.expected, text)
+			}
+		})
+	}
+}
+
+func TestUpdateMetricsRegistersStates(t *testing.T) {
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1})
+
+	profile := m.profiles[ProfileSun2000]
+	profile.registerMetrics(m.metrics)
+
+	alarm := profile.Registers["alarm_1"].Address
+	status := profile.Registers["device_status"].Address
+
+	client.set(1, status, 0x0000)
+	_, err := m.updateMetricsRegisters(m.connections["test"], Inverter{Name: "inverter1", UnitId: 1}, profile)
+	if err != nil {
+		t.Fatalf("Failed to update metrics: %s", err)
+	}
+
+	if len(m.GetStateChanges()) != 0 {
+		t.Fatalf("Expected no state changes after the first read, got %+v", m.GetStateChanges())
+	}
+
+	client.set(1, status, 0x0200)
+	client.set(1, alarm, 0x0004)
+	_, err = m.updateMetricsRegisters(m.connections["test"], Inverter{Name: "inverter1", UnitId: 1}, profile)
+	if err != nil {
+		t.Fatalf("Failed to update metrics: %s", err)
+	}
+
+	changes := map[string]StateChange{}
+	for _, change := range m.GetStateChanges() {
+		changes[change.Register] = change
+	}
+
+	if changes["device_status"].From != "Standby: initializing" || changes["device_status"].To != "On-grid" {
+		t.Fatalf("Incorrect device status change %+v", changes["device_status"])
+	}
+
+	if changes["alarm_1"].From != "None" || changes["alarm_1"].To != "String reverse connection" {
+		t.Fatalf("Incorrect alarm change %+v", changes["alarm_1"])
+	}
+
+	for _, test := range []struct {
+		metric string
+		state string
+		expected float64
+	}{
+		{metric: "device_status_state", state: "On-grid", expected: 1},
+		{metric: "device_status_state", state: "Standby: initializing", expected: 0},
+		{metric: "alarm_state", state: "String reverse connection", expected: 1},
+		{metric: "alarm_state", state: "Grid loss", expected: 0},
+	} {
+		value, err := m.metrics.GetMetricValueAverage("sun2000", test.metric, map[string]string{"inverter": "inverter1", "state": test.state}, 1)
+		if err != nil {
+			t.Fatalf("Metric %s with state %s not found: %s", test.metric, test.state, err)
+		}
+
+		if value != test.expected {
+			t.Fatalf("Expected %s %s to be %f, got %f", test.metric, test.state, test.expected, value)
+		}
+	}
+}
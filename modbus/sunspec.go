@@ -0,0 +1,394 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	sunSpecEndModel = 0xffff
+	// maxSunSpecModels stops walking a model list which is not terminated
+	maxSunSpecModels = 64
+	sunSpecNotImplementedScaleFactor = -0x8000
+)
+
+// sunSpecBaseAddresses are the addresses the SunSpec marker is searched at, in order.
+var sunSpecBaseAddresses = []uint16{40000, 50000, 0}
+
+// sunSpecMarker is "SunS" in two registers.
+var sunSpecMarker = []uint16{0x5375, 0x6e53}
+
+type sunSpecModel struct {
+	id uint16
+	address uint16
+	data []uint16
+}
+
+// sunSpecPoint maps a point of a SunSpec model to a register exported as one of the existing metrics.
+type sunSpecPoint struct {
+	key string
+	offset uint16
+	registerType RegisterType
+	quantity uint16
+	// scaleFactor is the offset of the scale factor register of the point, -1 when it has none
+	scaleFactor int
+	namespace string
+	name string
+	fields map[string]string
+	// unitGain converts the SunSpec unit to the unit of the metric, 1000 for W to kW
+	unitGain float64
+	invert bool
+	states string
+}
+
+var sunSpecStates = map[string]map[uint32]string{
+	"inverter_status": {
+		1: "Off",
+		2: "Sleeping",
+		3: "Starting",
+		4: "MPPT",
+		5: "Throttled",
+		6: "Shutting down",
+		7: "Fault",
+		8: "Standby",
+	},
+	"inverter_events": {
+		0: "Ground fault",
+		1: "DC overvoltage",
+		2: "AC disconnect open",
+		3: "DC disconnect open",
+		4: "Grid disconnect",
+		5: "Cabinet open",
+		6: "Manual shutdown",
+		7: "Overtemperature",
+		8: "Overfrequency",
+		9: "Underfrequency",
+		10: "AC overvoltage",
+		11: "AC undervoltage",
+		12: "Blown string fuse",
+		13: "Undertemperature",
+		14: "Memory loss",
+		15: "Hardware test failure",
+	},
+	"battery_state": {
+		1: "Disconnected",
+		2: "Initializing",
+		3: "Connected",
+		4: "Standby",
+		5: "SoC protection",
+		6: "Suspending",
+		99: "Fault",
+	},
+}
+
+// sunSpecInverterPoints are the points of the integer inverter models 101 to 103.
+var sunSpecInverterPoints = []sunSpecPoint{
+	{key: "phase_current_phase_a", offset: 1, registerType: RegisterTypeUint16, scaleFactor: 4, namespace: "sun2000", name: "phase_current", fields: map[string]string{"phase": "A"}},
+	{key: "phase_current_phase_b", offset: 2, registerType: RegisterTypeUint16, scaleFactor: 4, namespace: "sun2000", name: "phase_current", fields: map[string]string{"phase": "B"}},
+	{key: "phase_current_phase_c", offset: 3, registerType: RegisterTypeUint16, scaleFactor: 4, namespace: "sun2000", name: "phase_current", fields: map[string]string{"phase": "C"}},
+	{key: "phase_voltage_phase_a", offset: 8, registerType: RegisterTypeUint16, scaleFactor: 11, namespace: "sun2000", name: "phase_voltage", fields: map[string]string{"phase": "A"}},
+	{key: "phase_voltage_phase_b", offset: 9, registerType: RegisterTypeUint16, scaleFactor: 11, namespace: "sun2000", name: "phase_voltage", fields: map[string]string{"phase": "B"}},
+	{key: "phase_voltage_phase_c", offset: 10, registerType: RegisterTypeUint16, scaleFactor: 11, namespace: "sun2000", name: "phase_voltage", fields: map[string]string{"phase": "C"}},
+	{key: "active_power", offset: 12, registerType: RegisterTypeInt16, scaleFactor: 13, namespace: "sun2000", name: "active_power", unitGain: 1000},
+	{key: "grid_frequency", offset: 14, registerType: RegisterTypeUint16, scaleFactor: 15, namespace: "sun2000", name: "grid_frequency"},
+	{key: "reactive_power", offset: 18, registerType: RegisterTypeInt16, scaleFactor: 19, namespace: "sun2000", name: "reactive_power", unitGain: 1000},
+	{key: "power_factor", offset: 20, registerType: RegisterTypeInt16, scaleFactor: 21, namespace: "sun2000", name: "power_factor", unitGain: 100},
+	{key: "accumulated_yield", offset: 22, registerType: RegisterTypeUint32, scaleFactor: 24, namespace: "sun2000", name: "accumulated_yield", unitGain: 1000},
+	{key: "input_power", offset: 29, registerType: RegisterTypeInt16, scaleFactor: 30, namespace: "sun2000", name: "input_power", unitGain: 1000},
+	{key: "cabinet_temperature", offset: 31, registerType: RegisterTypeInt16, scaleFactor: 35, namespace: "sun2000", name: "cabinet_temperature"},
+	{key: "device_status", offset: 36, registerType: RegisterTypeEnum, scaleFactor: -1, namespace: "sun2000", name: "device_status", states: "inverter_status"},
+	{key: "alarm_1", offset: 38, registerType: RegisterTypeBitfield, quantity: 2, scaleFactor: -1, namespace: "sun2000", name: "alarm", fields: map[string]string{"alarm": "1"}, states: "inverter_events"},
+}
+
+// sunSpecInverterDCPoints are the DC points of the inverter models, used when there is no MPPT model.
+var sunSpecInverterDCPoints = []sunSpecPoint{
+	{key: "pv_current_string_1", offset: 25, registerType: RegisterTypeUint16, scaleFactor: 26, namespace: "sun2000", name: "pv_current", fields: map[string]string{"string": "1"}},
+	{key: "pv_voltage_string_1", offset: 27, registerType: RegisterTypeUint16, scaleFactor: 28, namespace: "sun2000", name: "pv_voltage", fields: map[string]string{"string": "1"}},
+}
+
+// sunSpecMeterPoints are the points of the meter models 201 to 204. SunSpec meters report imported power
+// as positive, the power meter metrics use exported power as positive.
+var sunSpecMeterPoints = []sunSpecPoint{
+	{key: "phase_current_phase_a", offset: 1, registerType: RegisterTypeInt16, scaleFactor: 4, namespace: "power_meter", name: "phase_current", fields: map[string]string{"phase": "A"}},
+	{key: "phase_current_phase_b", offset: 2, registerType: RegisterTypeInt16, scaleFactor: 4, namespace: "power_meter", name: "phase_current", fields: map[string]string{"phase": "B"}},
+	{key: "phase_current_phase_c", offset: 3, registerType: RegisterTypeInt16, scaleFactor: 4, namespace: "power_meter", name: "phase_current", fields: map[string]string{"phase": "C"}},
+	{key: "phase_voltage_phase_a", offset: 6, registerType: RegisterTypeInt16, scaleFactor: 13, namespace: "power_meter", name: "phase_voltage", fields: map[string]string{"phase": "A"}},
+	{key: "phase_voltage_phase_b", offset: 7, registerType: RegisterTypeInt16, scaleFactor: 13, namespace: "power_meter", name: "phase_voltage", fields: map[string]string{"phase": "B"}},
+	{key: "phase_voltage_phase_c", offset: 8, registerType: RegisterTypeInt16, scaleFactor: 13, namespace: "power_meter", name: "phase_voltage", fields: map[string]string{"phase": "C"}},
+	{key: "line_voltage_line_ab", offset: 10, registerType: RegisterTypeInt16, scaleFactor: 13, namespace: "power_meter", name: "line_voltage", fields: map[string]string{"line": "AB"}},
+	{key: "line_voltage_line_bc", offset: 11, registerType: RegisterTypeInt16, scaleFactor: 13, namespace: "power_meter", name: "line_voltage", fields: map[string]string{"line": "BC"}},
+	{key: "line_voltage_line_ca", offset: 12, registerType: RegisterTypeInt16, scaleFactor: 13, namespace: "power_meter", name: "line_voltage", fields: map[string]string{"line": "CA"}},
+	{key: "frequency", offset: 14, registerType: RegisterTypeInt16, scaleFactor: 15, namespace: "power_meter", name: "frequency"},
+	{key: "active_power", offset: 16, registerType: RegisterTypeInt16, scaleFactor: 20, namespace: "power_meter", name: "active_power", invert: true},
+	{key: "phase_active_power_phase_a", offset: 17, registerType: RegisterTypeInt16, scaleFactor: 20, namespace: "power_meter", name: "phase_active_power", fields: map[string]string{"phase": "A"}, invert: true},
+	{key: "phase_active_power_phase_b", offset: 18, registerType: RegisterTypeInt16, scaleFactor: 20, namespace: "power_meter", name: "phase_active_power", fields: map[string]string{"phase": "B"}, invert: true},
+	{key: "phase_active_power_phase_c", offset: 19, registerType: RegisterTypeInt16, scaleFactor: 20, namespace: "power_meter", name: "phase_active_power", fields: map[string]string{"phase": "C"}, invert: true},
+	{key: "reactive_power", offset: 26, registerType: RegisterTypeInt16, scaleFactor: 30, namespace: "power_meter", name: "reactive_power", invert: true},
+	{key: "power_factor", offset: 31, registerType: RegisterTypeInt16, scaleFactor: 35, namespace: "power_meter", name: "power_factor", unitGain: 100},
+	{key: "positive_active_electricity", offset: 36, registerType: RegisterTypeUint32, scaleFactor: 52, namespace: "power_meter", name: "positive_active_electricity", unitGain: 1000},
+	{key: "reverse_active_power", offset: 44, registerType: RegisterTypeUint32, scaleFactor: 52, namespace: "power_meter", name: "reverse_active_power", unitGain: 1000},
+}
+
+// sunSpecBatteryPoints are the points of the battery model 802. SunSpec batteries report discharging as
+// positive power, the battery metrics use charging as positive.
+var sunSpecBatteryPoints = []sunSpecPoint{
+	{key: "battery_capacity_battery_1", offset: 9, registerType: RegisterTypeUint16, scaleFactor: 54, namespace: "luna2000", name: "battery_capacity", fields: map[string]string{"battery": "1"}},
+	{key: "running_status_battery_1", offset: 20, registerType: RegisterTypeEnum, scaleFactor: -1, namespace: "luna2000", name: "running_status", fields: map[string]string{"battery": "1"}, states: "battery_state"},
+	{key: "bus_voltage_battery_1", offset: 32, registerType: RegisterTypeUint16, scaleFactor: 57, namespace: "luna2000", name: "bus_voltage", fields: map[string]string{"battery": "1"}},
+	{key: "charge_discharge_power", offset: 45, registerType: RegisterTypeInt16, scaleFactor: 61, namespace: "luna2000", name: "charge_discharge_power", invert: true},
+}
+
+// sunSpecCommonPoints returns the points of the common model 1 exported for the main device type.
+func sunSpecCommonPoints(namespace string) []sunSpecPoint {
+	switch namespace {
+	case "sun2000":
+		return []sunSpecPoint{
+			{key: "model", offset: 16, registerType: RegisterTypeString, quantity: 16, scaleFactor: -1, namespace: namespace, name: "model"},
+			{key: "firmware_version", offset: 40, registerType: RegisterTypeString, quantity: 8, scaleFactor: -1, namespace: namespace, name: "firmware_version"},
+			{key: "serial_number", offset: 48, registerType: RegisterTypeString, quantity: 16, scaleFactor: -1, namespace: namespace, name: "serial_number"},
+		}
+	case "luna2000":
+		return []sunSpecPoint{
+			{key: "serial_number_battery_1", offset: 48, registerType: RegisterTypeString, quantity: 16, scaleFactor: -1, namespace: namespace, name: "serial_number", fields: map[string]string{"battery": "1"}},
+		}
+	}
+
+	return nil
+}
+
+// sunSpecMPPTPoints returns the points of every module of the MPPT model 160, exported as PV strings.
+func sunSpecMPPTPoints(data []uint16) []sunSpecPoint {
+	if len(data) < 8 {
+		return nil
+	}
+
+	points := []sunSpecPoint{}
+	for module := uint16(0); module < data[6]; module++ {
+		offset := 8 + module * 20
+		fields := map[string]string{"string": fmt.Sprint(module + 1)}
+
+		points = append(points,
+			sunSpecPoint{key: fmt.Sprintf("pv_current_string_%d", module + 1), offset: offset + 9, registerType: RegisterTypeUint16, scaleFactor: 0, namespace: "sun2000", name: "pv_current", fields: fields},
+			sunSpecPoint{key: fmt.Sprintf("pv_voltage_string_%d", module + 1), offset: offset + 10, registerType: RegisterTypeUint16, scaleFactor: 1, namespace: "sun2000", name: "pv_voltage", fields: fields},
+		)
+	}
+
+	return points
+}
+
+// discoverSunSpec finds the SunSpec models of an inverter and returns a profile reading the supported
+// points into the existing metrics. Scale factors are read once during discovery.
+func (m *Modbus) discoverSunSpec(connection *Connection, inverter Inverter) (*Profile, int, error) {
+	requests := 0
+
+	var base *uint16
+	for _, address := range sunSpecBaseAddresses {
+		values, count, err := connection.readRegisters(priorityPoll, inverter.UnitId, address, 2)
+		requests += count
+		if err != nil {
+			if isDeviceError(err) {
+				continue
+			}
+
+			return nil, requests, err
+		}
+
+		if values[0] == sunSpecMarker[0] && values[1] == sunSpecMarker[1] {
+			base = &address
+			break
+		}
+	}
+
+	if base == nil {
+		return nil, requests, fmt.Errorf("No SunSpec marker found on inverter %s", inverter.Name)
+	}
+
+	models := []sunSpecModel{}
+	address := *base + 2
+	for i := 0; i < maxSunSpecModels; i++ {
+		header, count, err := connection.readRegisters(priorityPoll, inverter.UnitId, address, 2)
+		requests += count
+		if err != nil {
+			return nil, requests, err
+		}
+
+		id, length := header[0], header[1]
+		if id == sunSpecEndModel {
+			break
+		}
+
+		if sunSpecSupportedModel(id) {
+			data, count, err := connection.readRegisters(priorityPoll, inverter.UnitId, address + 2, length)
+			requests += count
+			if err != nil {
+				return nil, requests, err
+			}
+
+			models = append(models, sunSpecModel{id: id, address: address, data: data})
+		}
+
+		if uint32(address) + 2 + uint32(length) > math.MaxUint16 {
+			break
+		}
+		address += 2 + length
+	}
+
+	profile, err := buildSunSpecProfile(models)
+	if err != nil {
+		return nil, requests, fmt.Errorf("Invalid SunSpec models on inverter %s: %w", inverter.Name, err)
+	}
+
+	ids := []uint16{}
+	for _, model := range models {
+		ids = append(ids, model.id)
+	}
+	m.logger.WithFields(logrus.Fields{"inverter": inverter.Name, "base": *base, "models": ids}).Info("Discovered SunSpec models")
+
+	return profile, requests, nil
+}
+
+func sunSpecSupportedModel(id uint16) bool {
+	switch {
+	case id == 1, id >= 101 && id <= 103, id == 160, id >= 201 && id <= 204, id == 802:
+		return true
+	}
+
+	return false
+}
+
+// buildSunSpecProfile maps the points of the models into a profile. Only the first model of every
+// device type is used so two models never export the same metric.
+func buildSunSpecProfile(models []sunSpecModel) (*Profile, error) {
+	hasMPPT := false
+	namespace := ""
+	for _, model := range models {
+		switch {
+		case model.id == 160:
+			hasMPPT = true
+		case model.id >= 101 && model.id <= 103:
+			namespace = "sun2000"
+		case model.id == 802 && namespace == "":
+			namespace = "luna2000"
+		}
+	}
+
+	profile := &Profile{
+		Name: ProfileSunSpec,
+		Namespace: ProfileSunSpec,
+		MaxReadGap: 8,
+		States: sunSpecStates,
+		Registers: make(map[string]Register),
+	}
+
+	seen := make(map[string]bool)
+	for _, model := range models {
+		var group string
+		var points []sunSpecPoint
+
+		switch {
+		case model.id == 1:
+			group, points = "common", sunSpecCommonPoints(namespace)
+		case model.id >= 101 && model.id <= 103:
+			group, points = "inverter", sunSpecInverterPoints
+			if !hasMPPT {
+				points = append(append([]sunSpecPoint{}, points...), sunSpecInverterDCPoints...)
+			}
+		case model.id == 160:
+			group, points = "mppt", sunSpecMPPTPoints(model.data)
+		case model.id >= 201 && model.id <= 204:
+			group, points = "meter", sunSpecMeterPoints
+		case model.id == 802:
+			group, points = "battery", sunSpecBatteryPoints
+		}
+
+		if seen[group] {
+			continue
+		}
+		seen[group] = true
+
+		for _, point := range points {
+			register, ok := point.register(model)
+			if !ok {
+				continue
+			}
+
+			profile.Registers[fmt.Sprintf("%d_%s", model.id, point.key)] = register
+		}
+	}
+
+	if len(profile.Registers) == 0 {
+		return nil, fmt.Errorf("No supported points found")
+	}
+
+	return profile, profile.validate()
+}
+
+// register returns the register of the point in model. Points outside the model or with a scale factor
+// which is not implemented are skipped.
+func (p sunSpecPoint) register(model sunSpecModel) (Register, bool) {
+	quantity := p.quantity
+	if quantity == 0 {
+		quantity = registerTypeQuantities[p.registerType]
+	}
+
+	if int(p.offset) + int(quantity) > len(model.data) || p.scaleFactor >= len(model.data) {
+		return Register{}, false
+	}
+
+	unitGain := p.unitGain
+	if unitGain == 0 {
+		unitGain = 1
+	}
+
+	gain := unitGain
+	if p.scaleFactor >= 0 {
+		scaleFactor := int16(model.data[p.scaleFactor])
+		if scaleFactor == sunSpecNotImplementedScaleFactor {
+			return Register{}, false
+		}
+
+		gain = unitGain * math.Pow(10, -float64(scaleFactor))
+	}
+
+	fields := p.fields
+	if fields == nil {
+		fields = map[string]string{}
+	}
+
+	return Register{
+		Namespace: p.namespace,
+		Name: p.name,
+		Fields: fields,
+		Address: model.address + 2 + p.offset,
+		Gain: gain,
+		Quantity: quantity,
+		Type: p.registerType,
+		StateTable: p.states,
+		States: sunSpecStates[p.states],
+		Invert: p.invert,
+		sunSpec: true,
+	}, true
+}
+
+// sunSpecNotImplemented reports whether words hold the value SunSpec uses for a point the device does
+// not implement.
+func sunSpecNotImplemented(register Register, words []uint16) bool {
+	switch register.Type {
+	case RegisterTypeUint16, RegisterTypeEnum:
+		return words[0] == 0xffff
+	case RegisterTypeInt16:
+		return words[0] == 0x8000
+	case RegisterTypeBitfield:
+		if register.Quantity == 1 {
+			return words[0] == 0xffff
+		}
+
+		return words[0] == 0xffff && words[1] == 0xffff
+	case RegisterTypeInt32:
+		return words[0] == 0x8000 && words[1] == 0
+	}
+
+	return false
+}
@@ -0,0 +1,146 @@
+package modbus
+
+import (
+	"testing"
+
+	"github.com/simonvetter/modbus"
+)
+
+// setSunSpecModels writes the SunSpec marker at 40000 followed by the models and the end model.
+func setSunSpecModels(client *fakeClient, unitId uint8, models map[uint16][]uint16, order ...uint16) map[uint16]uint16 {
+	client.set(unitId, 40000, sunSpecMarker...)
+
+	addresses := make(map[uint16]uint16)
+	address := uint16(40002)
+	for _, id := range order {
+		data := models[id]
+		addresses[id] = address
+
+		client.set(unitId, address, id, uint16(len(data)))
+		client.set(unitId, address + 2, data...)
+		address += 2 + uint16(len(data))
+	}
+	client.set(unitId, address, sunSpecEndModel, 0)
+
+	return addresses
+}
+
+func TestSunSpecDiscovery(t *testing.T) {
+	client := newFakeClient()
+
+	common := make([]uint16, 66)
+	copy(common[16:], []uint16{0x5465, 0x7374}) // "Test"
+
+	inverter := make([]uint16, 50)
+	for i := range inverter {
+		inverter[i] = 0xffff
+	}
+	inverter[8] = 2301 // Phase voltage A
+	inverter[11] = 0xffff // Voltage scale factor -1
+	inverter[12] = 450 // Active power
+	inverter[13] = 1 // Power scale factor 1
+	inverter[14] = 5000 // Frequency
+	inverter[15] = 0xfffe // Frequency scale factor -2
+	inverter[36] = 4 // MPPT
+	inverter[38], inverter[39] = 0, 0
+
+	mppt := make([]uint16, 8 + 2 * 20)
+	mppt[0] = 0xfffe // Current scale factor -2
+	mppt[1] = 0xffff // Voltage scale factor -1
+	mppt[6] = 2
+	mppt[8 + 9], mppt[8 + 10] = 512, 3805
+	mppt[28 + 9], mppt[28 + 10] = 0xffff, 3790
+
+	meter := make([]uint16, 105)
+	meter[16] = 1200 // Imported power
+	meter[20] = 0 // Power scale factor
+
+	battery := make([]uint16, 64)
+	battery[9] = 815 // SoC
+	battery[54] = 0xffff // SoC scale factor -1
+	battery[45] = 150 // Discharge power
+	battery[61] = 1
+
+	// Other tests export metrics for inverter1 as well
+	m := newTestModbus(client, Inverter{Name: "sunspec1", UnitId: 1, Profiles: []string{ProfileSunSpec}})
+	setSunSpecModels(client, 1, map[uint16][]uint16{1: common, 103: inverter, 160: mppt, 203: meter, 802: battery, 64100: make([]uint16, 10)}, 1, 103, 64100, 160, 203, 802)
+
+	connection := m.connections["test"]
+	profile, _, err := m.getProfile(connection, connection.config.Inverters[0], ProfileSunSpec)
+	if err != nil {
+		t.Fatalf("Failed to discover SunSpec models: %s", err)
+	}
+
+	if _, ok := profile.Registers["103_pv_voltage_string_1"]; ok {
+		t.Fatalf("Expected the PV strings of the MPPT model instead of the inverter model")
+	}
+
+	_, err = m.updateMetricsRegisters(connection, connection.config.Inverters[0], profile)
+	if err != nil {
+		t.Fatalf("Failed to update metrics: %s", err)
+	}
+
+	tests := []struct {
+		namespace string
+		name string
+		fields map[string]string
+		expected float64
+	}{
+		{namespace: "sun2000", name: "active_power", expected: 4.5},
+		{namespace: "sun2000", name: "grid_frequency", expected: 50},
+		{namespace: "sun2000", name: "phase_voltage", fields: map[string]string{"phase": "A"}, expected: 230.1},
+		{namespace: "sun2000", name: "pv_voltage", fields: map[string]string{"string": "2"}, expected: 379},
+		{namespace: "sun2000", name: "pv_current", fields: map[string]string{"string": "1"}, expected: 5.12},
+		{namespace: "sun2000", name: "device_status_state", fields: map[string]string{"state": "MPPT"}, expected: 1},
+		{namespace: "sun2000", name: "model", fields: map[string]string{"value": "Test"}, expected: 1},
+		{namespace: "power_meter", name: "active_power", expected: -1200},
+		{namespace: "luna2000", name: "battery_capacity", fields: map[string]string{"battery": "1"}, expected: 81.5},
+		{namespace: "luna2000", name: "charge_discharge_power", expected: -1500},
+	}
+
+	for _, test := range tests {
+		fields := map[string]string{"inverter": "sunspec1"}
+		for k, v := range test.fields {
+			fields[k] = v
+		}
+
+		value, err := m.metrics.GetMetricValueAverage(test.namespace, test.name, fields, 1)
+		if err != nil {
+			t.Fatalf("Metric %s_%s %v not found: %s", test.namespace, test.name, test.fields, err)
+		}
+
+		if value != test.expected {
+			t.Fatalf("Expected %s_%s %v to be %f, got %f", test.namespace, test.name, test.fields, test.expected, value)
+		}
+	}
+
+	// Points which are not implemented are not exported
+	_, err = m.metrics.GetMetricValueAverage("sun2000", "pv_current", map[string]string{"inverter": "sunspec1", "string": "2"}, 1)
+	if err == nil {
+		t.Fatalf("Expected the current of string 2 which is not implemented to be skipped")
+	}
+
+	// The discovered profile is reused
+	reads := client.reads
+	_, requests, err := m.getProfile(connection, connection.config.Inverters[0], ProfileSunSpec)
+	if err != nil || requests != 0 || client.reads != reads {
+		t.Fatalf("Expected the discovered profile to be reused")
+	}
+}
+
+func TestSunSpecDiscoveryWithoutMarker(t *testing.T) {
+	client := newFakeClient()
+	m := newTestModbus(client, Inverter{Name: "inverter1", UnitId: 1, Profiles: []string{ProfileSunSpec}})
+
+	connection := m.connections["test"]
+	_, _, err := m.getProfile(connection, connection.config.Inverters[0], ProfileSunSpec)
+	if err == nil {
+		t.Fatalf("Expected discovery without SunSpec marker to fail")
+	}
+
+	client.err = modbus.ErrIllegalDataAddress
+	_, _, err = m.getProfile(connection, connection.config.Inverters[0], ProfileSunSpec)
+	if err == nil {
+		t.Fatalf("Expected discovery of a device refusing the SunSpec addresses to fail")
+	}
+}
@@ -0,0 +1,71 @@
+package modbus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	ProtocolRTU = "rtu"
+	ProtocolRTUOverTCP = "rtuovertcp"
+	ProtocolTCP = "tcp"
+)
+
+var parities = map[string]uint{
+	"": modbus.PARITY_NONE,
+	"none": modbus.PARITY_NONE,
+	"even": modbus.PARITY_EVEN,
+	"odd": modbus.PARITY_ODD,
+}
+
+// url returns the address of the connection, a serial device for rtu and a host and port otherwise.
+func (c ConnectionConfig) url() (string, error) {
+	switch c.Protocol {
+	case ProtocolRTU:
+		if c.Device == "" {
+			return "", fmt.Errorf("Connection %s uses rtu but has no serial device", c.Name)
+		}
+
+		return fmt.Sprintf("rtu://%s", c.Device), nil
+	case ProtocolRTUOverTCP, ProtocolTCP:
+		if c.IP == "" || c.Port == 0 {
+			return "", fmt.Errorf("Connection %s uses %s but has no ip and port", c.Name, c.Protocol)
+		}
+
+		return fmt.Sprintf("%s://%s:%d", c.Protocol, c.IP, c.Port), nil
+	}
+
+	return "", fmt.Errorf("Connection %s has unknown protocol %q", c.Name, c.Protocol)
+}
+
+// clientConfiguration validates the connection and returns the configuration of its modbus client.
+func (c ConnectionConfig) clientConfiguration() (*modbus.ClientConfiguration, error) {
+	url, err := c.url()
+	if err != nil {
+		return nil, err
+	}
+
+	parity, ok := parities[c.Parity]
+	if !ok {
+		return nil, fmt.Errorf("Connection %s has unknown parity %q, use none, even or odd", c.Name, c.Parity)
+	}
+
+	for _, inverter := range c.Inverters {
+		// Unit id 0 is the broadcast address on a serial bus, devices never answer it. Huawei inverters
+		// reached directly over Modbus TCP do use it for themselves.
+		if inverter.UnitId == 0 && c.Protocol != ProtocolTCP {
+			return nil, fmt.Errorf("Inverter %s uses unit id 0 which only works with the tcp protocol", inverter.Name)
+		}
+	}
+
+	return &modbus.ClientConfiguration{
+		URL: url,
+		Speed: c.Baudrate,
+		DataBits: c.DataBits,
+		StopBits: c.StopBits,
+		Parity: parity,
+		Timeout: time.Duration(c.Timeout) * time.Second,
+	}, nil
+}
@@ -0,0 +1,47 @@
+package modbus
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/simonvetter/modbus"
+)
+
+func TestClientConfiguration(t *testing.T) {
+	tests := []struct {
+		name string
+		config ConnectionConfig
+		url string
+		parity uint
+		err string
+	}{
+		{name: "rtu", config: ConnectionConfig{Protocol: "rtu", Device: "/dev/ttyUSB0", Parity: "even"}, url: "rtu:///dev/ttyUSB0", parity: modbus.PARITY_EVEN},
+		{name: "rtu_without_device", config: ConnectionConfig{Protocol: "rtu", IP: "127.0.0.1", Port: 502}, err: "no serial device"},
+		{name: "rtuovertcp", config: ConnectionConfig{Protocol: "rtuovertcp", IP: "127.0.0.1", Port: 520}, url: "rtuovertcp://127.0.0.1:520", parity: modbus.PARITY_NONE},
+		{name: "tcp_unit_id_0", config: ConnectionConfig{Protocol: "tcp", IP: "192.168.8.1", Port: 6607, Inverters: []Inverter{{Name: "inverter1", UnitId: 0}}}, url: "tcp://192.168.8.1:6607", parity: modbus.PARITY_NONE},
+		{name: "rtu_unit_id_0", config: ConnectionConfig{Protocol: "rtu", Device: "/dev/ttyUSB0", Inverters: []Inverter{{Name: "inverter1", UnitId: 0}}}, err: "unit id 0"},
+		{name: "parity", config: ConnectionConfig{Protocol: "rtu", Device: "/dev/ttyUSB0", Parity: "mark"}, err: "unknown parity"},
+		{name: "protocol", config: ConnectionConfig{Protocol: "udp", IP: "127.0.0.1", Port: 502}, err: "unknown protocol"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := test.config.clientConfiguration()
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q, got %v", test.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err)
+			}
+
+			if config.URL != test.url || config.Parity != test.parity {
+				t.Fatalf("Expected %s with parity %d, got %s with parity %d", test.url, test.parity, config.URL, config.Parity)
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/simonvetter/modbus"
+)
+
+// writeRetryDelay is the time given to a device to apply a write before it is attempted again.
+var writeRetryDelay = 200 * time.Millisecond
+
+// timestampWriteTolerance is how far a clock may run between writing a timestamp and reading it back
+const timestampWriteTolerance = 5 * time.Second
+
+// registerWrite is a value for a register of a profile, in the unit of the register after applying the gain.
+type registerWrite struct {
+	key string
+	value float64
+}
+
+// writeRegisters writes the registers of a profile of the inverter in order and stops at the first write
+// which fails.
+func (m *Modbus) writeRegisters(origin WriteOrigin, inverter Inverter, profileName string, writes []registerWrite) error {
+	profile, ok := m.profiles[profileName]
+	if !ok {
+		return fmt.Errorf("Profile %s not found", profileName)
+	}
+
+	connection, err := m.getConnection(inverter.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, write := range writes {
+		register, ok := profile.Registers[write.key]
+		if !ok || !register.Writeable {
+			return fmt.Errorf("Register %s of profile %s is not writeable", write.key, profileName)
+		}
+
+		words, err := EncodeRegister(register, write.value * register.Gain)
+		if err != nil {
+			return err
+		}
+
+		err = m.writeRegister(origin, connection, inverter, write.key, register, words)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeRegister writes words to the register and reads them back, retrying until the device returns what
+// was written. The old value, the outcome and the origin of the write are recorded in the audit trail.
+func (m *Modbus) writeRegister(origin WriteOrigin, connection *Connection, inverter Inverter, key string, register Register, words []uint16) error {
+	return m.writeVerified(origin, connection, inverter, key, register.Address, &register, words)
+}
+
+// writeRawRegisters writes words to the holding registers at address as they are, for tables which are not
+// a single value like the time of use periods. They are verified and audited like a register, without values.
+func (m *Modbus) writeRawRegisters(origin WriteOrigin, inverter Inverter, key string, address uint16, words []uint16) error {
+	connection, err := m.getConnection(inverter.Name)
+	if err != nil {
+		return err
+	}
+
+	return m.writeVerified(origin, connection, inverter, key, address, nil, words)
+}
+
+// writeVerified writes words at address, reads them back and records the write in the audit trail. The
+// register decodes the values for the audit trail and decides when a read back matches, without it the
+// words have to read back exactly.
+func (m *Modbus) writeVerified(origin WriteOrigin, connection *Connection, inverter Inverter, key string, address uint16, register *Register, words []uint16) error {
+	if m.stopping.Load() && origin.Caller != callerShutdown {
+		return ErrShuttingDown
+	}
+
+	entry := AuditEntry{
+		Time: time.Now(),
+		Inverter: inverter.Name,
+		UnitId: inverter.UnitId,
+		Register: key,
+		Address: address,
+		NewWords: words,
+		Caller: origin.Caller,
+		Reason: origin.Reason,
+	}
+
+	if register != nil {
+		entry.NewValue = decodeValue(*register, words)
+	}
+
+	if m.dryRun.Load() {
+		return m.recordDryRun(entry)
+	}
+
+	quantity := uint16(len(words))
+
+	retries := int(m.config.WriteRetries)
+	if retries == 0 {
+		retries = 3
+	}
+
+	var verified []uint16
+	err := connection.execute(priorityControl, inverter.UnitId, func(client registerClient) error {
+		old, err := client.ReadRegisters(address, quantity, modbus.HOLDING_REGISTER)
+		if err != nil {
+			return err
+		}
+		entry.OldWords = old
+		if register != nil {
+			entry.OldValue = decodeValue(*register, old)
+		}
+
+		for attempt := 1; attempt <= retries; attempt++ {
+			entry.Attempts = attempt
+			if attempt > 1 {
+				time.Sleep(writeRetryDelay)
+			}
+
+			err = writeWords(client, address, words)
+			if err != nil {
+				continue
+			}
+
+			var readBack []uint16
+			readBack, err = client.ReadRegisters(address, quantity, modbus.HOLDING_REGISTER)
+			if err != nil {
+				continue
+			}
+
+			if (register == nil && equalWords(readBack, words)) || (register != nil && readBackMatches(*register, readBack, words)) {
+				entry.Verified = true
+				verified = readBack
+				return nil
+			}
+
+			err = fmt.Errorf("Register %s of inverter %s reads back %v instead of %v", key, inverter.Name, readBack, words)
+		}
+
+		return err
+	})
+
+	// The proxy answers reads from the cache, so it must not keep serving the value from before the write.
+	// When the write failed the register may or may not have changed, so it is read again on the next request.
+	if err == nil {
+		connection.cache.store(inverter.UnitId, address, verified, time.Now())
+	} else {
+		connection.cache.invalidate(inverter.UnitId, address, quantity)
+	}
+
+	logger := m.logger.WithFields(logrus.Fields{"inverter": inverter.Name, "register": key, "old": entry.OldWords, "new": words, "caller": origin.Caller, "attempts": entry.Attempts})
+	if err != nil {
+		entry.Error = err.Error()
+		logger.WithError(err).Warn("Failed to write register")
+	} else {
+		logger.Debug("Wrote register")
+	}
+
+	auditErr := m.audit.record(entry)
+	if auditErr != nil {
+		m.logger.WithError(auditErr).Error("Failed to record write in the audit trail")
+	}
+
+	return err
+}
+
+// recordDryRun records the write of entry in the audit trail and the dry_run_command metric without
+// touching the device.
+func (m *Modbus) recordDryRun(entry AuditEntry) error {
+	entry.DryRun = true
+
+	m.logger.WithFields(logrus.Fields{"inverter": entry.Inverter, "register": entry.Register, "new": entry.NewWords, "caller": entry.Caller, "reason": entry.Reason}).Info("Dry run, not writing register")
+
+	if entry.NewValue != nil {
+		m.metrics.SetMetricValue("modbus", "dry_run_command", map[string]string{"inverter": entry.Inverter, "register": entry.Register, "caller": entry.Caller}, *entry.NewValue)
+	}
+
+	err := m.audit.record(entry)
+	if err != nil {
+		m.logger.WithError(err).Error("Failed to record write in the audit trail")
+	}
+
+	return nil
+}
+
+// SetDryRun enables or disables dry-run mode. In dry-run mode writes are logged and recorded in the audit
+// trail instead of being sent to the inverters.
+func (m *Modbus) SetDryRun(enabled bool) {
+	if m.dryRun.Swap(enabled) != enabled {
+		m.logger.WithFields(logrus.Fields{"enabled": enabled}).Warn("Changed dry-run mode")
+	}
+
+	value := 0.0
+	if enabled {
+		value = 1
+	}
+	m.metrics.SetMetricValue("modbus", "dry_run", map[string]string{}, value)
+}
+
+// DryRun reports whether dry-run mode is enabled.
+func (m *Modbus) DryRun() bool {
+	return m.dryRun.Load()
+}
+
+// readRegister returns the value of a register of a profile of the inverter with the gain applied.
+func (m *Modbus) readRegister(inverter Inverter, profileName string, key string) (float64, error) {
+	register, ok := m.profiles[profileName].Registers[key]
+	if !ok {
+		return 0, fmt.Errorf("Register %s not found in profile %s", key, profileName)
+	}
+
+	connection, err := m.getConnection(inverter.Name)
+	if err != nil {
+		return 0, err
+	}
+
+	// Settings are read ahead of waiting poll requests as they are about to be changed
+	words, _, err := connection.readRegisters(priorityControl, inverter.UnitId, register.Address, register.Quantity)
+	if err != nil {
+		return 0, err
+	}
+
+	value := decodeValue(register, words)
+	if value == nil {
+		return 0, fmt.Errorf("Register %s of profile %s is not a number", key, profileName)
+	}
+
+	return *value, nil
+}
+
+// GetAuditEntries returns the writes in the audit trail matching filter, newest first.
+func (m *Modbus) GetAuditEntries(filter AuditFilter) ([]AuditEntry, error) {
+	return m.audit.query(filter)
+}
+
+func writeWords(client registerClient, address uint16, words []uint16) error {
+	if len(words) == 1 {
+		return client.WriteRegister(address, words[0])
+	}
+
+	return client.WriteRegisters(address, words)
+}
+
+// readBackMatches reports whether the words read back confirm the write. A timestamp is a clock which keeps
+// running after it is written, so it may be slightly ahead.
+func readBackMatches(register Register, readBack []uint16, words []uint16) bool {
+	if register.Type != RegisterTypeTimestamp {
+		return equalWords(readBack, words)
+	}
+
+	written := decodeValue(register, words)
+	read := decodeValue(register, readBack)
+	if written == nil || read == nil {
+		return false
+	}
+
+	ahead := *read - *written
+
+	return ahead >= 0 && ahead <= math.Floor(timestampWriteTolerance.Seconds())
+}
+
+func equalWords(a []uint16, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decodeValue returns the value of words with the gain applied, or nil when they can not be decoded.
+func decodeValue(register Register, words []uint16) *float64 {
+	value, _, err := DecodeRegister(register, words)
+	if err != nil || register.Type == RegisterTypeString {
+		return nil
+	}
+
+	value /= register.Gain
+
+	return &value
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 	"bytes"
+	"context"
 	"errors"
 	"net/url"
 	"strconv"
@@ -71,6 +72,11 @@ func (g *VictoriaMetrics) SendMetrics(requests []VictoriaMetricsRequest) error {
 
 // QueryTimeRange queries Victoria Metrics for metrics in a time range
 func (g *VictoriaMetrics) QueryTimeRange(promql string, startTime time.Time, endTime time.Time, step string) (VictoriaMetricsQueryResponse, error) {
+	return g.QueryTimeRangeContext(context.Background(), promql, startTime, endTime, step)
+}
+
+// QueryTimeRangeContext queries Victoria Metrics for metrics in a time range, giving up when ctx is done
+func (g *VictoriaMetrics) QueryTimeRangeContext(ctx context.Context, promql string, startTime time.Time, endTime time.Time, step string) (VictoriaMetricsQueryResponse, error) {
 	// Check if the start time is before the end time
 	if startTime.After(endTime) {
 		return VictoriaMetricsQueryResponse{}, errors.New("Start time must be before end time")
@@ -86,7 +92,7 @@ func (g *VictoriaMetrics) QueryTimeRange(promql string, startTime time.Time, end
 	url := g.Config.URL + "/api/v1/query_range?" + params.Encode()
 
 	// Create the request to Victoria Metrics
-	request, err := http.NewRequest("GET", url, nil)
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return VictoriaMetricsQueryResponse{}, err
 	}
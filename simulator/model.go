@@ -0,0 +1,347 @@
+package simulator
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"gijs.eu/vonkje/modbus"
+)
+
+type ModelConfig struct {
+	PVPeakPower float64 `mapstructure:"pv-peak-power"`
+	PVStrings int `mapstructure:"pv-strings"`
+	Sunrise float64 `mapstructure:"sunrise"`
+	Sunset float64 `mapstructure:"sunset"`
+	LoadProfile []float64 `mapstructure:"load-profile"`
+	BatteryCapacity float64 `mapstructure:"battery-capacity"`
+	BatterySoc float64 `mapstructure:"battery-soc"`
+	BatteryMaxPower float64 `mapstructure:"battery-max-power"`
+}
+
+const (
+	gridVoltage = 230
+	gridFrequency = 50
+	stringVoltage = 380
+	busVoltage = 450
+	deviceStatusOnGrid = 0x0200
+	batteryStatusRunning = 2
+	batteryTemperature = 25
+	deviceModel = "SUN2000-5KTL-M1"
+)
+
+// houseLoad returns the load of the house in watts. The load profile contains one entry per hour of the day.
+func (c ModelConfig) houseLoad(now time.Time) float64 {
+	if len(c.LoadProfile) == 0 {
+		return 0
+	}
+
+	return c.LoadProfile[now.Hour() % len(c.LoadProfile)]
+}
+
+// pvPower returns the solar production in watts following a sine curve between sunrise and sunset.
+func (c ModelConfig) pvPower(now time.Time) float64 {
+	hour := float64(now.Hour()) + float64(now.Minute()) / 60 + float64(now.Second()) / 3600
+	if hour <= c.Sunrise || hour >= c.Sunset {
+		return 0
+	}
+
+	return c.PVPeakPower * math.Sin(math.Pi * (hour - c.Sunrise) / (c.Sunset - c.Sunrise))
+}
+
+type device struct {
+	inverter modbus.Inverter
+	model ModelConfig
+	registers map[string]modbus.Register
+	memory map[uint16]uint16
+	writeable map[uint16]bool
+	battery bool
+	powerMeter bool
+
+	soc float64
+	batteryPower float64
+	totalCharge float64
+	totalDischarge float64
+	totalExport float64
+	totalImport float64
+	totalYield float64
+	dailyYield float64
+	forcibleStart time.Time
+	clockOffset time.Duration
+}
+
+func newDevice(inverter modbus.Inverter, model ModelConfig, profiles map[string]*modbus.Profile) (*device, error) {
+	d := &device{
+		inverter: inverter,
+		model: model,
+		registers: make(map[string]modbus.Register),
+		memory: make(map[uint16]uint16),
+		writeable: make(map[uint16]bool),
+		soc: model.BatterySoc,
+	}
+
+	for _, name := range inverter.GetProfiles() {
+		profile, ok := profiles[name]
+		if !ok {
+			return nil, fmt.Errorf("Profile %s of inverter %s not found", name, inverter.Name)
+		}
+
+		d.battery = d.battery || name == modbus.ProfileLuna2000
+		d.powerMeter = d.powerMeter || name == modbus.ProfilePowerMeter
+
+		for key, register := range profile.Registers {
+			d.registers[fmt.Sprintf("%s_%s", name, key)] = register
+
+			if register.Writeable {
+				for i := uint16(0); i < register.Quantity; i++ {
+					d.writeable[register.Address + i] = true
+				}
+			}
+		}
+	}
+
+	d.setString("sun2000_model", deviceModel)
+	d.setString("sun2000_serial_number", fmt.Sprintf("SIM%08d", inverter.UnitId))
+	d.setString("sun2000_firmware_version", "V100R001C00")
+	d.set("sun2000_number_of_pv_strings", float64(model.PVStrings))
+	d.set("sun2000_rated_power", model.PVPeakPower / 1000)
+
+	_, offset := time.Now().Zone()
+	d.set("sun2000_time_zone", float64(offset / 60))
+
+	if d.battery {
+		d.setString("luna2000_serial_number_battery_1", fmt.Sprintf("SIMBAT%04d", inverter.UnitId))
+	}
+
+	return d, nil
+}
+
+// step simulates the inverter and battery and returns the active power of the inverter in watts.
+func (d *device) step(now time.Time, elapsed time.Duration, load float64) float64 {
+	pv := d.model.pvPower(now)
+
+	if d.battery {
+		d.expireForcible(now)
+		d.batteryPower = d.targetBatteryPower(pv - load)
+
+		hours := elapsed.Hours()
+		if d.model.BatteryCapacity > 0 {
+			d.soc += d.batteryPower * hours / d.model.BatteryCapacity * 100
+			d.soc = math.Max(0, math.Min(100, d.soc))
+		}
+
+		if d.batteryPower > 0 {
+			d.totalCharge += d.batteryPower * hours / 1000
+		} else {
+			d.totalDischarge += -d.batteryPower * hours / 1000
+		}
+
+		d.set("luna2000_charge_discharge_power", d.batteryPower)
+		d.set("luna2000_running_status_battery_1", batteryStatusRunning)
+		d.set("luna2000_charging_status_battery_1", d.batteryPower)
+		d.set("luna2000_bus_voltage_battery_1", busVoltage)
+		d.set("luna2000_battery_capacity_battery_1", d.soc)
+		d.set("luna2000_total_charge_battery_1", d.totalCharge)
+		d.set("luna2000_total_discharge_battery_1", d.totalDischarge)
+		d.set("luna2000_battery_temperature_battery_1", batteryTemperature)
+	}
+
+	activePower := pv - d.batteryPower
+
+	if now.YearDay() != now.Add(-elapsed).YearDay() {
+		d.dailyYield = 0
+	}
+	d.totalYield += pv * elapsed.Hours() / 1000
+	d.dailyYield += pv * elapsed.Hours() / 1000
+	strings := d.model.PVStrings
+	if strings <= 0 {
+		strings = 1
+	}
+
+	for i := 1; i <= strings; i++ {
+		voltage := 0.0
+		if pv > 0 {
+			voltage = stringVoltage
+		}
+
+		d.set(fmt.Sprintf("sun2000_pv_voltage_string_%d", i), voltage)
+		d.set(fmt.Sprintf("sun2000_pv_current_string_%d", i), pv / float64(strings) / stringVoltage)
+	}
+
+	for _, phase := range []string{"a", "b", "c"} {
+		d.set("sun2000_phase_voltage_phase_" + phase, gridVoltage)
+		d.set("sun2000_phase_current_phase_" + phase, math.Abs(activePower) / 3 / gridVoltage)
+	}
+
+	d.set("sun2000_device_status", deviceStatusOnGrid)
+	d.set("sun2000_input_power", pv / 1000)
+	d.set("sun2000_active_power", activePower / 1000)
+	d.set("sun2000_reactive_power", 0)
+	d.set("sun2000_power_factor", 1)
+	d.set("sun2000_grid_frequency", gridFrequency)
+	d.set("sun2000_inverter_efficiency", 98.5)
+	d.set("sun2000_cabinet_temperature", 35)
+	d.set("sun2000_isulation_resistance", 3)
+	d.set("sun2000_accumulated_yield", d.totalYield)
+	d.set("sun2000_daily_yield", d.dailyYield)
+	d.set("sun2000_system_time", float64(now.Add(d.clockOffset).Unix()))
+
+	return activePower
+}
+
+// write stores values written by a client. Writing the forcible charge or discharge command starts its
+// period like on the inverter and writing the system time sets the clock.
+func (d *device) write(now time.Time, address uint16, values []uint16) {
+	for i, value := range values {
+		d.memory[address + uint16(i)] = value
+	}
+
+	command := d.registers["luna2000_forcible_charge_discharge_battery_1"].Address
+	if command >= address && command < address + uint16(len(values)) {
+		d.forcibleStart = now
+	}
+
+	clock := d.registers["sun2000_system_time"].Address
+	if clock >= address && clock < address + uint16(len(values)) {
+		d.clockOffset = time.Unix(int64(d.get("sun2000_system_time")), 0).Sub(now)
+	}
+}
+
+// expireForcible stops a forcible charge or discharge once its period has passed or the battery reached
+// its target SOC, depending on the setting mode.
+func (d *device) expireForcible(now time.Time) {
+	state := d.get("luna2000_forcible_charge_discharge_battery_1")
+	if state == float64(modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP) {
+		return
+	}
+
+	expired := false
+	switch d.get("luna2000_forcible_charge_discharge_setting_mode_battery_1") {
+	case float64(modbus.MODBUS_STATE_BATTERY_FORCIBLE_SETTING_MODE_DURATION):
+		period := time.Duration(d.get("luna2000_forcible_charge_discharge_period_battery_1")) * time.Minute
+		expired = period > 0 && now.Sub(d.forcibleStart) >= period
+	case float64(modbus.MODBUS_STATE_BATTERY_FORCIBLE_SETTING_MODE_SOC):
+		target := d.get("luna2000_forcible_charge_discharge_target_soc_battery_1")
+		charging := state == float64(modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE)
+		expired = (charging && d.soc >= target) || (!charging && d.soc <= target)
+	}
+
+	if expired {
+		d.set("luna2000_forcible_charge_discharge_battery_1", float64(modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP))
+	}
+}
+
+// targetBatteryPower returns the battery power in watts, positive when charging. Without a forcible
+// charge or discharge command the battery maximises self consumption using the surplus.
+func (d *device) targetBatteryPower(surplus float64) float64 {
+	var power float64
+
+	switch d.get("luna2000_forcible_charge_discharge_battery_1") {
+	case float64(modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE):
+		power = d.raw("luna2000_forcible_charge_power_battery_1")
+	case float64(modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_DISCHARGE):
+		power = -d.raw("luna2000_forcible_discharge_power_battery_1")
+	default:
+		power = surplus
+	}
+
+	if d.model.BatteryMaxPower > 0 {
+		power = math.Max(-d.model.BatteryMaxPower, math.Min(d.model.BatteryMaxPower, power))
+	}
+
+	if (power > 0 && d.soc >= 100) || (power < 0 && d.soc <= 0) {
+		return 0
+	}
+
+	return power
+}
+
+// updatePowerMeter sets the power meter registers. A positive grid power means power is exported.
+func (d *device) updatePowerMeter(elapsed time.Duration, gridPower float64) {
+	if gridPower > 0 {
+		d.totalExport += gridPower * elapsed.Hours() / 1000
+	} else {
+		d.totalImport += -gridPower * elapsed.Hours() / 1000
+	}
+
+	for _, phase := range []string{"a", "b", "c"} {
+		d.set("power_meter_phase_voltage_phase_" + phase, gridVoltage)
+		d.set("power_meter_phase_current_phase_" + phase, math.Abs(gridPower) / 3 / gridVoltage)
+		d.set("power_meter_phase_active_power_phase_" + phase, gridPower / 3)
+	}
+
+	for _, line := range []string{"ab", "bc", "ca"} {
+		d.set("power_meter_line_voltage_line_" + line, gridVoltage * math.Sqrt(3))
+	}
+
+	d.set("power_meter_status", 1)
+	d.set("power_meter_active_power", gridPower)
+	d.set("power_meter_reactive_power", 0)
+	d.set("power_meter_power_factor", 1)
+	d.set("power_meter_frequency", gridFrequency)
+	d.set("power_meter_positive_active_electricity", d.totalExport)
+	d.set("power_meter_reverse_active_power", d.totalImport)
+	d.set("power_meter_accumulated_reactive_power", 0)
+}
+
+// set encodes value with the gain and type of the register and stores it in memory.
+func (d *device) set(key string, value float64) {
+	register, ok := d.registers[key]
+	if !ok {
+		return
+	}
+
+	words, err := modbus.EncodeRegister(register, value * register.Gain)
+	if err != nil {
+		return
+	}
+
+	for i, word := range words {
+		d.memory[register.Address + uint16(i)] = word
+	}
+}
+
+// setString stores text in a string register, padded with NUL characters.
+func (d *device) setString(key string, text string) {
+	register, ok := d.registers[key]
+	if !ok {
+		return
+	}
+
+	bytes := make([]byte, register.Quantity * 2)
+	copy(bytes, text)
+
+	for i := uint16(0); i < register.Quantity; i++ {
+		d.memory[register.Address + i] = uint16(bytes[i * 2]) << 8 | uint16(bytes[i * 2 + 1])
+	}
+}
+
+// raw returns the unscaled value of a register as stored in memory.
+func (d *device) raw(key string) float64 {
+	register, ok := d.registers[key]
+	if !ok {
+		return 0
+	}
+
+	words := make([]uint16, register.Quantity)
+	for i := range words {
+		words[i] = d.memory[register.Address + uint16(i)]
+	}
+
+	value, _, err := modbus.DecodeRegister(register, words)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
+// get returns the value of a register as stored in memory with the gain applied.
+func (d *device) get(key string) float64 {
+	register, ok := d.registers[key]
+	if !ok {
+		return 0
+	}
+
+	return d.raw(key) / register.Gain
+}
@@ -0,0 +1,183 @@
+package simulator
+
+import (
+	"io"
+	"net"
+	"errors"
+	"encoding/binary"
+
+	modbusLib "github.com/simonvetter/modbus"
+)
+
+const (
+	functionReadHoldingRegisters uint8 = 0x03
+	functionReadInputRegisters uint8 = 0x04
+	functionWriteSingleRegister uint8 = 0x06
+	functionWriteMultipleRegisters uint8 = 0x10
+)
+
+// serveRTUOverTCP accepts connections and answers RTU framed requests. The modbus library only
+// offers a TCP server, RTU over TCP is what serial gateways like the Moxa speak.
+func (s *Simulator) serveRTUOverTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.errChannel <- err
+			}
+
+			return
+		}
+
+		go s.handleRTUConnection(conn)
+	}
+}
+
+func (s *Simulator) handleRTUConnection(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		request, err := readRTUFrame(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.logger.WithError(err).Debug("Simulator closing rtu over tcp connection")
+			}
+
+			return
+		}
+
+		response := s.handleRTUFrame(request)
+		if response == nil {
+			continue
+		}
+
+		_, err = conn.Write(response)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readRTUFrame reads a single request frame and validates its crc.
+func readRTUFrame(reader io.Reader) ([]byte, error) {
+	frame := make([]byte, 8)
+	_, err := io.ReadFull(reader, frame[:2])
+	if err != nil {
+		return nil, err
+	}
+
+	switch frame[1] {
+	case functionReadHoldingRegisters, functionReadInputRegisters, functionWriteSingleRegister:
+		_, err = io.ReadFull(reader, frame[2:8])
+	case functionWriteMultipleRegisters:
+		_, err = io.ReadFull(reader, frame[2:7])
+		if err == nil {
+			frame = append(frame[:7], make([]byte, int(frame[6]) + 2)...)
+			_, err = io.ReadFull(reader, frame[7:])
+		}
+	default:
+		return nil, modbusLib.ErrIllegalFunction
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if crc16(frame[:len(frame) - 2]) != binary.LittleEndian.Uint16(frame[len(frame) - 2:]) {
+		return nil, modbusLib.ErrBadCRC
+	}
+
+	return frame[:len(frame) - 2], nil
+}
+
+// handleRTUFrame executes a request without crc and returns the response including crc. No response is
+// returned for unknown unit ids as nothing would answer on a real bus.
+func (s *Simulator) handleRTUFrame(request []byte) []byte {
+	unitId := request[0]
+	function := request[1]
+	address := binary.BigEndian.Uint16(request[2:4])
+
+	s.lock.Lock()
+	_, ok := s.devices[unitId]
+	s.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	req := &modbusLib.HoldingRegistersRequest{
+		UnitId: unitId,
+		Addr: address,
+	}
+
+	switch function {
+	case functionReadHoldingRegisters, functionReadInputRegisters:
+		req.Quantity = binary.BigEndian.Uint16(request[4:6])
+	case functionWriteSingleRegister:
+		req.IsWrite = true
+		req.Quantity = 1
+		req.Args = []uint16{binary.BigEndian.Uint16(request[4:6])}
+	case functionWriteMultipleRegisters:
+		req.IsWrite = true
+		req.Quantity = binary.BigEndian.Uint16(request[4:6])
+		for i := 0; i < int(request[6]) / 2; i++ {
+			req.Args = append(req.Args, binary.BigEndian.Uint16(request[7 + i * 2:]))
+		}
+	}
+
+	var values []uint16
+	var err error
+	if function == functionReadInputRegisters {
+		values, err = s.HandleInputRegisters(&modbusLib.InputRegistersRequest{UnitId: unitId, Addr: address, Quantity: req.Quantity})
+	} else {
+		values, err = s.HandleHoldingRegisters(req)
+	}
+
+	var response []byte
+	switch {
+	case err != nil:
+		response = []byte{unitId, function | 0x80, exceptionCode(err)}
+	case function == functionReadHoldingRegisters || function == functionReadInputRegisters:
+		response = []byte{unitId, function, uint8(len(values) * 2)}
+		for _, value := range values {
+			response = binary.BigEndian.AppendUint16(response, value)
+		}
+	case function == functionWriteSingleRegister:
+		response = append([]byte{}, request[:6]...)
+	case function == functionWriteMultipleRegisters:
+		response = append([]byte{}, request[:6]...)
+	}
+
+	return binary.LittleEndian.AppendUint16(response, crc16(response))
+}
+
+func exceptionCode(err error) uint8 {
+	switch err {
+	case modbusLib.ErrIllegalFunction:
+		return 0x01
+	case modbusLib.ErrIllegalDataAddress:
+		return 0x02
+	case modbusLib.ErrIllegalDataValue:
+		return 0x03
+	case modbusLib.ErrGWTargetFailedToRespond:
+		return 0x0b
+	}
+
+	return 0x04
+}
+
+// crc16 calculates the modbus rtu crc of data.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xffff)
+
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc & 1 == 1 {
+				crc = crc >> 1 ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
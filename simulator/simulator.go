@@ -0,0 +1,188 @@
+package simulator
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"context"
+
+	"gijs.eu/vonkje/modbus"
+
+	"github.com/sirupsen/logrus"
+	modbusLib "github.com/simonvetter/modbus"
+)
+
+type Config struct {
+	TCPListen string `mapstructure:"tcp-listen"`
+	RTUOverTCPListen string `mapstructure:"rtu-over-tcp-listen"`
+	TickInterval uint `mapstructure:"tick-interval"`
+	ProfilesDirectory string `mapstructure:"profiles-directory"`
+	Model ModelConfig `mapstructure:"model"`
+	Inverters []modbus.Inverter `mapstructure:"inverters"`
+}
+
+type Simulator struct {
+	config Config
+	errChannel chan error
+	ctx context.Context
+	logger *logrus.Logger
+	lock sync.Mutex
+	devices map[uint8]*device
+	now func() time.Time
+}
+
+func New(
+	config Config,
+	errChannel chan error,
+	ctx context.Context,
+	logger *logrus.Logger,
+) (*Simulator, error) {
+	profiles, err := modbus.LoadProfiles(config.ProfilesDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Simulator{
+		config: config,
+		errChannel: errChannel,
+		ctx: ctx,
+		logger: logger,
+		devices: make(map[uint8]*device),
+		now: time.Now,
+	}
+
+	for _, inverter := range config.Inverters {
+		if _, ok := s.devices[inverter.UnitId]; ok {
+			return nil, fmt.Errorf("Unit id %d is used by more than one simulated inverter", inverter.UnitId)
+		}
+
+		d, err := newDevice(inverter, config.Model, profiles)
+		if err != nil {
+			return nil, err
+		}
+
+		s.devices[inverter.UnitId] = d
+	}
+
+	s.step(0)
+
+	return s, nil
+}
+
+func (s *Simulator) Start() {
+	s.logger.Info("Starting modbus simulator")
+
+	if s.config.TCPListen != "" {
+		server, err := modbusLib.NewServer(&modbusLib.ServerConfiguration{
+			URL: fmt.Sprintf("tcp://%s", s.config.TCPListen),
+		}, s)
+		if err != nil {
+			s.errChannel <- err
+			return
+		}
+
+		err = server.Start()
+		if err != nil {
+			s.errChannel <- err
+			return
+		}
+		defer server.Stop()
+
+		s.logger.Infof("Simulator listening on tcp://%s", s.config.TCPListen)
+	}
+
+	if s.config.RTUOverTCPListen != "" {
+		listener, err := net.Listen("tcp", s.config.RTUOverTCPListen)
+		if err != nil {
+			s.errChannel <- err
+			return
+		}
+		defer listener.Close()
+
+		go s.serveRTUOverTCP(listener)
+
+		s.logger.Infof("Simulator listening on rtuovertcp://%s", s.config.RTUOverTCPListen)
+	}
+
+	interval := time.Duration(s.config.TickInterval) * time.Second
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.logger.Info("Stopping modbus simulator")
+			return
+		case <-ticker.C:
+			s.step(interval)
+		}
+	}
+}
+
+// step advances the physical model of every simulated device by elapsed and refreshes the registers.
+func (s *Simulator) step(elapsed time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	load := s.config.Model.houseLoad(now)
+
+	var totalActivePower float64
+	for _, d := range s.devices {
+		totalActivePower += d.step(now, elapsed, load / float64(len(s.devices)))
+	}
+
+	for _, d := range s.devices {
+		if d.powerMeter {
+			d.updatePowerMeter(elapsed, totalActivePower - load)
+		}
+	}
+}
+
+func (s *Simulator) HandleCoils(req *modbusLib.CoilsRequest) ([]bool, error) {
+	return nil, modbusLib.ErrIllegalFunction
+}
+
+func (s *Simulator) HandleDiscreteInputs(req *modbusLib.DiscreteInputsRequest) ([]bool, error) {
+	return nil, modbusLib.ErrIllegalFunction
+}
+
+func (s *Simulator) HandleInputRegisters(req *modbusLib.InputRegistersRequest) ([]uint16, error) {
+	return nil, modbusLib.ErrIllegalFunction
+}
+
+func (s *Simulator) HandleHoldingRegisters(req *modbusLib.HoldingRegistersRequest) ([]uint16, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	d, ok := s.devices[req.UnitId]
+	if !ok {
+		return nil, modbusLib.ErrGWTargetFailedToRespond
+	}
+
+	if req.IsWrite {
+		for i := range req.Args {
+			if !d.writeable[req.Addr + uint16(i)] {
+				return nil, modbusLib.ErrIllegalDataAddress
+			}
+		}
+
+		d.write(s.now(), req.Addr, req.Args)
+
+		s.logger.WithFields(logrus.Fields{"unitId": req.UnitId, "address": req.Addr, "values": req.Args}).Debug("Simulator received write")
+
+		return nil, nil
+	}
+
+	values := make([]uint16, req.Quantity)
+	for i := range values {
+		values[i] = d.memory[req.Addr + uint16(i)]
+	}
+
+	return values, nil
+}
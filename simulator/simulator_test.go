@@ -0,0 +1,182 @@
+package simulator
+
+import (
+	"net"
+	"time"
+	"context"
+	"testing"
+
+	"gijs.eu/vonkje/modbus"
+	"gijs.eu/vonkje/metrics"
+
+	"github.com/sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	modbusLib "github.com/simonvetter/modbus"
+)
+
+func newTestSimulator(t *testing.T, ctx context.Context) *Simulator {
+	s, err := New(Config{
+		Model: ModelConfig{
+			PVPeakPower: 5000,
+			PVStrings: 2,
+			Sunrise: 6,
+			Sunset: 20,
+			LoadProfile: []float64{500},
+			BatteryCapacity: 10000,
+			BatterySoc: 50,
+			BatteryMaxPower: 5000,
+		},
+		Inverters: []modbus.Inverter{
+			{Name: "inverter1", UnitId: 1, Luna2000: true, PowerMeter: true},
+		},
+	}, make(chan error, 10), ctx, logrus.New())
+	if err != nil {
+		t.Fatalf("Failed to create simulator: %s", err)
+	}
+
+	s.now = func() time.Time {
+		return time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC)
+	}
+
+	return s
+}
+
+func TestTCP(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newTestSimulator(t, ctx)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find free port: %s", err)
+	}
+	s.config.TCPListen = listener.Addr().String()
+	listener.Close()
+
+	go s.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := modbusLib.NewClient(&modbusLib.ClientConfiguration{URL: "tcp://" + s.config.TCPListen})
+	if err != nil {
+		t.Fatalf("Failed to create client: %s", err)
+	}
+
+	err = client.Open()
+	if err != nil {
+		t.Fatalf("Failed to connect: %s", err)
+	}
+	defer client.Close()
+
+	capacity, err := client.ReadRegister(37004, modbusLib.HOLDING_REGISTER)
+	if err != nil {
+		t.Fatalf("Failed to read battery capacity: %s", err)
+	}
+
+	if capacity != 500 {
+		t.Fatalf("Incorrect battery capacity %d", capacity)
+	}
+
+	words, err := client.ReadRegisters(30000, 15, modbusLib.HOLDING_REGISTER)
+	if err != nil {
+		t.Fatalf("Failed to read model: %s", err)
+	}
+
+	_, model, err := modbus.DecodeRegister(modbus.Register{Name: "model", Quantity: 15, Type: modbus.RegisterTypeString}, words)
+	if err != nil || model != deviceModel {
+		t.Fatalf("Incorrect model %q: %v", model, err)
+	}
+
+	err = client.WriteRegister(32089, 1)
+	if err != modbusLib.ErrIllegalDataAddress {
+		t.Fatalf("Expected write to read only register to fail, got %v", err)
+	}
+}
+
+func TestRTUOverTCPForcibleCharge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s := newTestSimulator(t, ctx)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %s", err)
+	}
+	defer listener.Close()
+	go s.serveRTUOverTCP(listener)
+
+	store, err := metrics.NewStore(metrics.Config{}, prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("Failed to create metrics store: %s", err)
+	}
+
+	address := listener.Addr().(*net.TCPAddr)
+	client, err := modbus.New(modbus.Config{
+		Connections: []modbus.ConnectionConfig{
+			{
+				Name: "simulator",
+				IP: address.IP.String(),
+				Port: uint(address.Port),
+				Protocol: "rtuovertcp",
+				Timeout: 1,
+				Inverters: s.config.Inverters,
+			},
+		},
+	}, make(chan error, 10), ctx, logrus.New(), store)
+	if err != nil {
+		t.Fatalf("Failed to create modbus client: %s", err)
+	}
+	defer client.Close()
+
+	err = client.ChangeBatteryForceCharge(modbus.WriteOrigin{Caller: "test"}, "inverter1", modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_CHARGE, 2000, modbus.ForceChargeLimit{Duration: 2 * time.Hour})
+	if err != nil {
+		t.Fatalf("Failed to force charge: %s", err)
+	}
+
+	s.step(time.Hour)
+
+	soc := s.devices[1].soc
+	if soc != 70 {
+		t.Fatalf("Expected battery to charge to 70%%, got %f", soc)
+	}
+
+	if s.devices[1].get("power_meter_active_power") != -2500 {
+		t.Fatalf("Expected grid import of 2500W, got %f", s.devices[1].get("power_meter_active_power"))
+	}
+
+	// The command expires on the inverter after its duration of 2 hours
+	start := s.now()
+	s.now = func() time.Time {
+		return start.Add(2 * time.Hour)
+	}
+	s.step(time.Hour)
+
+	if s.devices[1].get("luna2000_forcible_charge_discharge_battery_1") != float64(modbus.MODBUS_STATE_BATTERY_FORCIBLE_CHARGE_DISCHARGE_STOP) || s.devices[1].batteryPower > 0 {
+		t.Fatalf("Expected the forcible charge to expire, battery power %fW", s.devices[1].batteryPower)
+	}
+}
+
+func TestClock(t *testing.T) {
+	s := newTestSimulator(t, context.Background())
+	d := s.devices[1]
+
+	s.step(time.Second)
+	if d.get("sun2000_system_time") != float64(s.now().Unix()) {
+		t.Fatalf("Expected the system time to follow the simulator clock, got %f", d.get("sun2000_system_time"))
+	}
+
+	// Setting the clock 5 minutes ahead keeps it ahead
+	ahead := uint32(s.now().Add(5 * time.Minute).Unix())
+	d.write(s.now(), d.registers["sun2000_system_time"].Address, []uint16{uint16(ahead >> 16), uint16(ahead)})
+
+	start := s.now()
+	s.now = func() time.Time {
+		return start.Add(time.Minute)
+	}
+	s.step(time.Minute)
+
+	if d.get("sun2000_system_time") != float64(ahead + 60) {
+		t.Fatalf("Expected the system time to run on from the written time, got %f", d.get("sun2000_system_time"))
+	}
+}